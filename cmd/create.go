@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gdme1320/zip/internal"
+	"github.com/gdme1320/zip/internal/utils"
+	zip "github.com/gdme1320/zip/pkg"
+)
+
+var compressionMethods = map[string]uint16{
+	"store":   zip.Store,
+	"deflate": zip.Deflate,
+	"zstd":    zip.Zstd,
+	"lzma":    zip.LZMA,
+	"xz":      zip.XZ,
+}
+
+var encryptionMethods = map[string]zip.EncryptionMethod{
+	"zipcrypto": zip.StandardEncryption,
+	"aes128":    zip.AES128Encryption,
+	"aes192":    zip.AES192Encryption,
+	"aes256":    zip.AES256Encryption,
+}
+
+// createOptions builds the options shared by the c, a and u commands.
+func createOptions(config *UnzipConfig) (internal.CreateOptions, error) {
+	var opts internal.CreateOptions
+	method, ok := compressionMethods[strings.ToLower(config.Method)]
+	if !ok {
+		return opts, fmt.Errorf("不支持的压缩方法: %s", config.Method)
+	}
+	enc, ok := encryptionMethods[strings.ToLower(config.Encrypt)]
+	if !ok {
+		return opts, fmt.Errorf("不支持的加密方法: %s", config.Encrypt)
+	}
+	password, err := getPassword(config)
+	if err != nil {
+		return opts, fmt.Errorf("获取密码失败: %v", err)
+	}
+	return internal.CreateOptions{
+		Method:       method,
+		Level:        config.Level,
+		Encryption:   enc,
+		Password:     password,
+		Encoding:     config.FileEncoding,
+		Include:      config.Include,
+		Exclude:      config.Exclude,
+		Comment:      config.Comment,
+		Reproducible: config.Reproducible,
+		Adaptive:     config.Adaptive,
+	}, nil
+}
+
+// createArchive implements the c command.
+func createArchive(config *UnzipConfig) error {
+	opts, err := createOptions(config)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer
+	var skip os.FileInfo
+	if config.ZipPath == "-" {
+		out = os.Stdout
+	} else {
+		f, err := os.Create(config.ZipPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if skip, err = f.Stat(); err != nil {
+			return err
+		}
+		opts.Seekable = skip.Mode().IsRegular()
+		out = f
+	}
+
+	n, err := internal.CreateArchive(out, config.Inputs, skip, opts)
+	if err != nil {
+		if config.ZipPath != "-" {
+			os.Remove(config.ZipPath)
+		}
+		return err
+	}
+	utils.Info("Created %s, %d entries", config.ZipPath, n)
+	return nil
+}
+
+// updateArchive implements the a and u commands. With onlyChanged, files
+// whose entry is up to date are skipped. A missing archive is created.
+func updateArchive(config *UnzipConfig, onlyChanged bool) error {
+	if _, err := os.Stat(config.ZipPath); os.IsNotExist(err) {
+		return createArchive(config)
+	}
+	opts, err := createOptions(config)
+	if err != nil {
+		return err
+	}
+	n, err := internal.UpdateArchive(config.ZipPath, config.Inputs, internal.UpdateOptions{
+		CreateOptions: opts,
+		OnlyChanged:   onlyChanged,
+		CompareCRC:    config.CompareCRC,
+	})
+	if err != nil {
+		return err
+	}
+	utils.Info("Updated %s, %d entries added", config.ZipPath, n)
+	return nil
+}
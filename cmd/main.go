@@ -1,13 +1,13 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"path"
-	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/gdme1320/zip/internal"
 	"github.com/gdme1320/zip/internal/utils"
@@ -28,10 +28,32 @@ type UnzipConfig struct {
 	FileEncoding     string // 文件编码 (gbk, utf8, windows)
 	Password         string // 密码
 	PasswordEncoding string // 密码编码 (gbk, utf8, windows)
-	ValidateCrc      bool
-	Workers          int  // 并发工作线程数
-	Verbose          bool // 详细输出
-	Quiet            bool // 静默输出
+	ValidateCrc      bool   // 解压时在数据流中校验 CRC/HMAC
+	VerifyDisk       bool   // 解压后重新读取磁盘文件校验大小和 CRC
+	Workers          int    // 并发工作线程数
+	Verbose          bool   // 详细输出
+	Quiet            bool   // 静默输出
+	CompareDir       bool   // t 命令: 与 -C 指定的目录比较
+	ListFormat       string // l 命令输出格式 (json, csv)
+
+	// c 命令
+	Inputs       []string   // 要添加的文件和目录
+	Method       string     // 压缩方法 (store, deflate, zstd, lzma, xz)
+	Level        int        // 压缩级别
+	Encrypt      string     // 加密方法 (zipcrypto, aes128, aes192, aes256)
+	PasswordFile string     // 从文件读取密码
+	PasswordEnv  string     // 从环境变量读取密码
+	Comment      string     // 归档注释
+	Include      stringList // 只添加匹配的文件
+	Exclude      stringList // 跳过匹配的文件
+	CompareCRC   bool       // u 命令: 用 CRC32 判断文件是否修改
+	Reproducible bool       // 可重现模式
+	Adaptive     bool       // 对无法压缩的文件自动使用 store
+
+	// passwd 命令
+	NewPassword    string // 新密码
+	NewPasswordEnv string // 从环境变量读取新密码
+	Decrypt        bool   // 去除加密
 
 	zipFile     *zip.File
 	password    []byte
@@ -56,6 +78,10 @@ func (t *UnzipConfig) GetPassword() []byte {
 	return t.password
 }
 
+func (t *UnzipConfig) GetVerify() bool {
+	return t.ValidateCrc
+}
+
 func (t *UnzipConfig) OnFileName(name string) bool {
 	if t.filePattern == "" || strings.Contains(name, t.filePattern) {
 		return true
@@ -75,10 +101,58 @@ func usage() {
 	fmt.Println("\n命令:")
 	fmt.Println("  x        从归档中解压文件")
 	fmt.Println("  l        列出归档中的内容")
-	fmt.Println("  t        Validate zip file with extracted")
+	fmt.Println("  t        测试归档完整性; 指定 -C 时与解压目录比较")
+	fmt.Println("  c        从文件和目录创建归档, 归档为 - 时写到标准输出")
+	fmt.Println("  a        向归档中添加文件, 同名文件被替换; 归档不存在时创建")
+	fmt.Println("  u        只添加新文件和修改时间 (或 -crc 时 CRC32) 不同的文件")
+	fmt.Println("  d        删除匹配的文件, 匹配的目录连同其内容一起删除")
+	fmt.Println("  mv       重命名文件或目录")
+	fmt.Println("  passwd   修改密码或加密方法, -decrypt 时去除加密")
 	fmt.Println("\n示例:")
 	fmt.Printf("  %s x archive.zip -C ./extracted -p 123456\n", os.Args[0])
+	fmt.Printf("  %s l archive.zip -v\n", os.Args[0])
+	fmt.Printf("  %s l archive.zip --format json\n", os.Args[0])
+	fmt.Printf("  %s l https://example.com/archive.zip\n", os.Args[0])
+	fmt.Printf("  %s x https://example.com/archive.zip docs/ -C ./extracted\n", os.Args[0])
 	fmt.Printf("  %s t archive.zip -e gbk\n", os.Args[0])
+	fmt.Printf("  %s t archive.zip -C ./extracted -workers 4\n", os.Args[0])
+	fmt.Printf("  %s c archive.zip ./dir -x '*.tmp' -encrypt aes256 -password-env ZIP_PASSWORD\n", os.Args[0])
+	fmt.Printf("  %s u archive.zip ./dir -crc\n", os.Args[0])
+	fmt.Printf("  %s d archive.zip secret.txt '*.log'\n", os.Args[0])
+	fmt.Printf("  %s mv archive.zip old/dir new/dir -e gbk\n", os.Args[0])
+	fmt.Printf("  %s passwd archive.zip -p old -new-password-env NEW_PASSWORD -encrypt aes256\n", os.Args[0])
+}
+
+// stringList is a flag.Value collecting repeated string flags.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// Exit codes
+const (
+	exitOK      = 0
+	exitFailure = 1 // 校验发现问题或操作失败
+	exitError   = 2 // 参数错误或无法读取归档
+)
+
+// parseInterspersed parses fs from args, allowing flags to follow
+// positional arguments, and returns the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
 }
 
 // parseAndValidateFlags parses command-line flags and validates the configuration.
@@ -98,9 +172,25 @@ func parseAndValidateFlags() (*UnzipConfig, string, error) {
 	fs.StringVar(&config.Password, "p", "", "解压密码")
 	fs.StringVar(&config.PasswordEncoding, "pwd-encoding", "utf8", "密码编码 (gbk, utf8)")
 	fs.IntVar(&config.Workers, "workers", 1, "并发工作线程数")
-	fs.BoolVar(&config.ValidateCrc, "c", false, "Validate CRC after extraction")
+	fs.BoolVar(&config.ValidateCrc, "c", false, "Verify CRC32/HMAC while extracting")
+	fs.BoolVar(&config.VerifyDisk, "verify-disk", false, "Re-read extracted files and verify size and CRC32")
 	fs.BoolVar(&config.Verbose, "v", false, "详细输出模式")
 	fs.BoolVar(&config.Quiet, "q", false, "静默模式，只输出错误")
+	fs.StringVar(&config.ListFormat, "format", "", "l 命令输出格式 (json, csv)")
+	fs.StringVar(&config.Method, "m", "deflate", "c 命令压缩方法 (store, deflate, zstd, lzma, xz)")
+	fs.IntVar(&config.Level, "level", -1, "c 命令压缩级别 (0-9, -1 为默认)")
+	fs.StringVar(&config.Encrypt, "encrypt", "aes256", "c 命令加密方法 (zipcrypto, aes128, aes192, aes256)")
+	fs.StringVar(&config.PasswordFile, "password-file", "", "从文件读取密码")
+	fs.StringVar(&config.PasswordEnv, "password-env", "", "从环境变量读取密码")
+	fs.StringVar(&config.Comment, "z", "", "c 命令归档注释")
+	fs.Var(&config.Include, "i", "c 命令只添加匹配的文件, 可重复")
+	fs.Var(&config.Exclude, "x", "c 命令跳过匹配的文件或目录, 可重复")
+	fs.BoolVar(&config.Adaptive, "auto", false, "c 命令按扩展名和内容采样, 对无法压缩的文件自动使用 store")
+	fs.BoolVar(&config.Reproducible, "reproducible", false, "c 命令可重现模式: 排序条目, 时间截断到 SOURCE_DATE_EPOCH, 统一权限")
+	fs.BoolVar(&config.CompareCRC, "crc", false, "u 命令用 CRC32 而不是修改时间判断文件是否修改")
+	fs.StringVar(&config.NewPassword, "new-password", "", "passwd 命令的新密码")
+	fs.StringVar(&config.NewPasswordEnv, "new-password-env", "", "passwd 命令从环境变量读取新密码")
+	fs.BoolVar(&config.Decrypt, "decrypt", false, "passwd 命令去除加密")
 
 	fs.Usage = func() {
 		fmt.Printf("用法: %s %s [选项] <zip文件>\n", os.Args[0], command)
@@ -108,15 +198,38 @@ func parseAndValidateFlags() (*UnzipConfig, string, error) {
 		fs.PrintDefaults()
 	}
 
-	fs.Parse(args)
+	positional := parseInterspersed(fs, args)
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "C" {
+			config.CompareDir = true
+		}
+	})
 
-	if fs.NArg() < 1 {
+	if len(positional) < 1 {
 		fs.Usage()
 		return nil, "", fmt.Errorf("需要指定一个zip文件")
 	}
-	config.ZipPath = fs.Arg(0)
-	if fs.NArg() > 1 {
-		config.ZipFile = fs.Arg(1)
+	config.ZipPath = positional[0]
+	switch command {
+	case "c", "a", "u":
+		config.Inputs = positional[1:]
+		if len(config.Inputs) == 0 {
+			return nil, "", fmt.Errorf("需要指定要添加的文件或目录")
+		}
+	case "d":
+		config.Inputs = positional[1:]
+		if len(config.Inputs) == 0 {
+			return nil, "", fmt.Errorf("需要指定要删除的文件")
+		}
+	case "mv":
+		config.Inputs = positional[1:]
+		if len(config.Inputs) != 2 {
+			return nil, "", fmt.Errorf("需要指定原名称和新名称")
+		}
+	default:
+		if len(positional) > 1 {
+			config.ZipFile = positional[1]
+		}
 	}
 
 	if config.Workers < 1 {
@@ -127,20 +240,41 @@ func parseAndValidateFlags() (*UnzipConfig, string, error) {
 		return nil, "", fmt.Errorf("verbose 和 quiet 选项不能同时使用")
 	}
 
+	switch config.ListFormat {
+	case "", "json", "csv":
+	default:
+		return nil, "", fmt.Errorf("不支持的输出格式: %s", config.ListFormat)
+	}
+
 	return config, command, nil
 }
 
 func getPassword(config *UnzipConfig) ([]byte, error) {
-	if config.Password != "" {
-		if config.PasswordEncoding != "" {
-			return internal.GetBytes(config.Password, config.PasswordEncoding)
+	password := config.Password
+	switch {
+	case password != "":
+	case config.PasswordFile != "":
+		b, err := os.ReadFile(config.PasswordFile)
+		if err != nil {
+			return nil, err
 		}
-		return []byte(config.Password), nil
+		password = strings.TrimRight(string(b), "\r\n")
+	case config.PasswordEnv != "":
+		v, ok := os.LookupEnv(config.PasswordEnv)
+		if !ok {
+			return nil, fmt.Errorf("环境变量 %s 未设置", config.PasswordEnv)
+		}
+		password = v
+	default:
+		return nil, nil
 	}
-	return nil, nil
+	if config.PasswordEncoding != "" {
+		return internal.GetBytes(password, config.PasswordEncoding)
+	}
+	return []byte(password), nil
 }
 
-func processFile(file *zip.File, config *UnzipConfig, password []byte, wg *sync.WaitGroup, semaphore chan struct{}) {
+func processFile(file *zip.File, config *UnzipConfig, password []byte, wg *sync.WaitGroup, semaphore chan struct{}, failed *atomic.Int64) {
 	defer wg.Done()
 	defer func() { <-semaphore }()
 	if file.IsEncrypted() {
@@ -156,32 +290,49 @@ func processFile(file *zip.File, config *UnzipConfig, password []byte, wg *sync.
 			file.DeferAuth = true
 		}
 	}
-	config.toZipFileProcessArgs(file, password, config.ZipFile)
-	outFile, err := internal.ProcessSingleFile(config)
-	if outFile == "" {
-		return
-	}
+	args := *config
+	args.toZipFileProcessArgs(file, password, config.ZipFile)
+	outFile, err := internal.ProcessSingleFile(&args)
 	if err != nil {
-		utils.Error("解压文件 %s 失败: %v", file.Name, err)
+		failed.Add(1)
+		var merr *internal.MismatchError
+		if errors.As(err, &merr) || errors.Is(err, zip.ErrChecksum) || errors.Is(err, zip.ErrAuthentication) {
+			utils.Error("文件校验不通过: %v", err)
+		} else {
+			utils.Error("解压文件 %s 失败: %v", file.Name, err)
+		}
 		return
 	}
-	// fileName := path.Base(outFile)
-	fileName, err := filepath.Rel(config.OutputPath, outFile)
-	if err != nil {
-		fileName = file.Name
+	if outFile == "" {
+		return
 	}
-	if config.ValidateCrc {
-		ok, err := internal.ValidateZip(file, outFile)
-		if err != nil {
-			utils.Error("校验文件 %s 失败: %v", fileName, err)
-			return
-		}
-		if !ok {
-			utils.Error("文件校验不通过 %s", fileName)
+	if config.VerifyDisk && !file.FileInfo().IsDir() {
+		if err := internal.VerifyExtracted(file, outFile); err != nil {
+			failed.Add(1)
+			utils.Error("文件校验不通过: %v", err)
 		}
 	}
 }
 
+// isURL reports whether path names a remote archive.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// openArchive opens the archive at path, read with HTTP range requests
+// if path is a URL, and returns it with the function closing it.
+func openArchive(path string) (*zip.Reader, func() error, error) {
+	if isURL(path) {
+		r, err := zip.OpenHTTPReader(path, nil)
+		return r, func() error { return nil }, err
+	}
+	rc, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &rc.Reader, rc.Close, nil
+}
+
 // 主解压函数
 func unzip(config *UnzipConfig) error {
 	// stat, err := os.Lstat(config.ZipPath)
@@ -189,11 +340,11 @@ func unzip(config *UnzipConfig) error {
 	// 	return utils.Errorf("获取zip文件信息失败: %v", err)
 	// }
 	// 打开zip文件
-	reader, err := zip.OpenReader(config.ZipPath)
+	reader, closer, err := openArchive(config.ZipPath)
 	if err != nil {
 		return utils.Errorf("打开zip文件失败: %v", err)
 	}
-	defer reader.Close()
+	defer closer()
 
 	// 创建输出目录
 	if err := os.MkdirAll(config.OutputPath, 0755); err != nil {
@@ -212,26 +363,42 @@ func unzip(config *UnzipConfig) error {
 	// 创建信号量控制并发数
 	semaphore := make(chan struct{}, config.Workers)
 	var wg sync.WaitGroup
+	var failed atomic.Int64
 
 	// 处理每个文件
 	for _, file := range reader.File {
 		wg.Add(1)
 		semaphore <- struct{}{} // 获取信号量
-		go processFile(file, config, password, &wg, semaphore)
+		go processFile(file, config, password, &wg, semaphore, &failed)
 	}
 
 	// 等待所有文件处理完成
 	wg.Wait()
 
+	if n := failed.Load(); n > 0 {
+		return fmt.Errorf("%d 个文件解压或校验失败", n)
+	}
 	return nil
 }
 
 func listFiles(config *UnzipConfig) error {
-	reader, err := zip.OpenReader(config.ZipPath)
+	reader, closer, err := openArchive(config.ZipPath)
 	if err != nil {
 		return utils.Errorf("打开zip文件失败: %v", err)
 	}
-	defer reader.Close()
+	defer closer()
+
+	if config.ListFormat != "" || config.Verbose {
+		listing := internal.NewListing(reader.File, reader.Comment, config.FileEncoding)
+		switch config.ListFormat {
+		case "json":
+			return listing.WriteJSON(os.Stdout)
+		case "csv":
+			return listing.WriteCSV(os.Stdout)
+		}
+		return listing.WriteVerbose(os.Stdout)
+	}
+
 	for _, file := range reader.File {
 		fileName, err := internal.ListFile(file, config.FileEncoding)
 		if err != nil {
@@ -242,39 +409,53 @@ func listFiles(config *UnzipConfig) error {
 	return nil
 }
 
-func validateExtracted(config *UnzipConfig) error {
+// testArchive tests the archive in memory, or against an extracted
+// directory when -C is given, and prints a summary.
+// It returns false if any problem was found.
+func testArchive(config *UnzipConfig) (bool, error) {
 	reader, err := zip.OpenReader(config.ZipPath)
 	if err != nil {
-		return utils.Errorf("打开zip文件失败: %v", err)
+		return false, utils.Errorf("打开zip文件失败: %v", err)
 	}
 	defer reader.Close()
-	for _, file := range reader.File {
-		fileName, err := internal.ListFile(file, config.FileEncoding)
-		if err != nil {
-			return utils.Errorf("列出文件 %s 失败: %v", file.Name, err)
-		}
-		utils.Info("Validating file: %s", fileName)
-		ok, err := internal.ValidateZip(file, path.Join(config.OutputPath, fileName))
-		if err != nil {
-			return utils.Errorf("Unable to validate file %s", fileName)
-		}
-		if !ok {
-			utils.Info("Vlidate file %s failed", fileName)
-			break
-		}
+
+	password, err := getPassword(config)
+	if err != nil {
+		return false, utils.Errorf("获取密码失败: %v", err)
 	}
-	return nil
+	opts := internal.CheckOptions{
+		Encoding: config.FileEncoding,
+		Password: password,
+		Workers:  config.Workers,
+	}
+
+	var report *internal.CheckReport
+	if config.CompareDir {
+		utils.Info("Comparing %s with %s", config.ZipPath, config.OutputPath)
+		report = internal.CompareDir(reader.File, config.OutputPath, opts)
+	} else {
+		utils.Info("Testing %s", config.ZipPath)
+		report = internal.CheckArchive(reader.File, opts)
+	}
+
+	for _, name := range report.Extra {
+		utils.Error("%s: extra file", name)
+	}
+	utils.Info("Tested %d entries: %d ok, %d failed, %d missing, %d extra, %d unreadable",
+		report.Tested, report.Tested-len(report.Failed)-len(report.Missing),
+		len(report.Failed), len(report.Missing), len(report.Extra), len(report.Unread))
+	return report.OK(), nil
 }
 
 func main() {
 	// 解析和验证命令行参数
 	config, command, err := parseAndValidateFlags()
 	if err != nil {
-		fmt.Errorf("参数错误: %v\n", err)
+		fmt.Fprintf(os.Stderr, "参数错误: %v\n", err)
 		if len(os.Args) < 2 {
 			usage()
 		}
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 
 	// 初始化日志系统
@@ -286,12 +467,20 @@ func main() {
 	} else {
 		logLevel = utils.Normal
 	}
+	if command == "c" && config.ZipPath == "-" {
+		// 归档写到标准输出, 不能再输出日志
+		logLevel = utils.Quiet
+	}
 	utils.InitLogger(logLevel)
 
 	// 检查zip文件是否存在
-	if _, err := os.Stat(config.ZipPath); os.IsNotExist(err) {
+	if isURL(config.ZipPath) && command != "l" && command != "x" {
+		utils.Error("错误: %s 命令不支持远程归档", command)
+		os.Exit(exitError)
+	}
+	if _, err := os.Stat(config.ZipPath); command != "c" && command != "a" && !isURL(config.ZipPath) && os.IsNotExist(err) {
 		utils.Error("错误: zip文件不存在: %s", config.ZipPath)
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 
 	switch command {
@@ -299,21 +488,51 @@ func main() {
 		// 开始解压
 		if err := unzip(config); err != nil {
 			utils.Error("解压失败: %v", err)
-			os.Exit(1)
+			os.Exit(exitFailure)
 		}
 	case "l":
 		// 列出文件
 		if err := listFiles(config); err != nil {
 			utils.Error("列出文件失败: %v", err)
-			os.Exit(1)
+			os.Exit(exitFailure)
+		}
+	case "c":
+		if err := createArchive(config); err != nil {
+			utils.Error("创建归档失败: %v", err)
+			os.Exit(exitFailure)
+		}
+	case "a", "u":
+		if err := updateArchive(config, command == "u"); err != nil {
+			utils.Error("更新归档失败: %v", err)
+			os.Exit(exitFailure)
+		}
+	case "d":
+		if err := deleteEntries(config); err != nil {
+			utils.Error("删除文件失败: %v", err)
+			os.Exit(exitFailure)
+		}
+	case "mv":
+		if err := renameEntries(config); err != nil {
+			utils.Error("重命名失败: %v", err)
+			os.Exit(exitFailure)
+		}
+	case "passwd":
+		if err := changePassword(config); err != nil {
+			utils.Error("修改密码失败: %v", err)
+			os.Exit(exitFailure)
 		}
 	case "t":
-		if err := validateExtracted(config); err != nil {
-			os.Exit(1)
+		ok, err := testArchive(config)
+		if err != nil {
+			os.Exit(exitError)
+		}
+		if !ok {
+			os.Exit(exitFailure)
 		}
 	default:
 		utils.Error("未知命令: %s", command)
 		usage()
-		os.Exit(1)
+		os.Exit(exitError)
 	}
+	os.Exit(exitOK)
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gdme1320/zip/internal"
+	"github.com/gdme1320/zip/internal/utils"
+	zip "github.com/gdme1320/zip/pkg"
+)
+
+// deleteEntries implements the d command.
+func deleteEntries(config *UnzipConfig) error {
+	n, err := internal.DeleteEntries(config.ZipPath, config.Inputs, config.FileEncoding)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("没有匹配的文件")
+	}
+	utils.Info("Deleted %d entries from %s", n, config.ZipPath)
+	return nil
+}
+
+// renameEntries implements the mv command.
+func renameEntries(config *UnzipConfig) error {
+	n, err := internal.RenameEntries(config.ZipPath, config.Inputs[0], config.Inputs[1], config.FileEncoding)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: 没有匹配的文件", config.Inputs[0])
+	}
+	utils.Info("Renamed %d entries in %s", n, config.ZipPath)
+	return nil
+}
+
+// changePassword implements the passwd command. The old password is
+// taken from -p, -password-file or -password-env as for extraction.
+func changePassword(config *UnzipConfig) error {
+	oldPassword, err := getPassword(config)
+	if err != nil {
+		return fmt.Errorf("获取密码失败: %v", err)
+	}
+	var password []byte
+	enc := zip.EncryptionMethod(0)
+	if !config.Decrypt {
+		p := config.NewPassword
+		if p == "" && config.NewPasswordEnv != "" {
+			v, ok := os.LookupEnv(config.NewPasswordEnv)
+			if !ok {
+				return fmt.Errorf("环境变量 %s 未设置", config.NewPasswordEnv)
+			}
+			p = v
+		}
+		if p == "" {
+			return fmt.Errorf("需要指定新密码或 -decrypt")
+		}
+		if password, err = internal.GetBytes(p, config.PasswordEncoding); err != nil {
+			return err
+		}
+		var ok bool
+		if enc, ok = encryptionMethods[strings.ToLower(config.Encrypt)]; !ok {
+			return fmt.Errorf("不支持的加密方法: %s", config.Encrypt)
+		}
+	}
+	if err := zip.ReencryptFile(config.ZipPath, oldPassword, password, enc); err != nil {
+		return err
+	}
+	utils.Info("Updated encryption of %s", config.ZipPath)
+	return nil
+}
@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/gdme1320/zip/internal/utils"
+	zip "github.com/gdme1320/zip/pkg"
+)
+
+// CheckOptions controls how an archive is tested.
+type CheckOptions struct {
+	Encoding string // 文件名编码
+	Password []byte // 加密文件的密码
+	Workers  int    // 并发工作线程数
+}
+
+// EntryResult is the outcome of testing a single zip entry.
+type EntryResult struct {
+	Name string
+	Err  error
+}
+
+// CheckReport collects the results of testing an archive.
+type CheckReport struct {
+	Tested  int
+	Failed  []EntryResult
+	Missing []string      // entries not found in the compared directory
+	Extra   []string      // files in the compared directory not in the archive
+	Unread  []EntryResult // paths of the compared directory that could not be read
+
+	mu sync.Mutex
+}
+
+// OK reports whether no problem was found.
+func (r *CheckReport) OK() bool {
+	return len(r.Failed) == 0 && len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Unread) == 0
+}
+
+// CheckArchive decompresses every entry in memory and verifies
+// CRC32, the AES HMAC, local header consistency and data descriptors.
+// Nothing is written to disk.
+func CheckArchive(files []*zip.File, opts CheckOptions) *CheckReport {
+	report := &CheckReport{}
+	forEachEntry(files, opts.Workers, func(f *zip.File) {
+		name := entryName(f, opts.Encoding)
+		report.add(name, checkEntry(f, opts.Password))
+	})
+	report.sort()
+	return report
+}
+
+func checkEntry(f *zip.File, password []byte) error {
+	if err := f.CheckHeaders(); err != nil {
+		return err
+	}
+	if f.IsEncrypted() {
+		if password == nil {
+			return errors.New("encrypted but no password provided")
+		}
+		f.SetPassword(password)
+		// authenticate while streaming instead of buffering the entry
+		f.DeferAuth = true
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	v := newStreamVerifier(f, "")
+	if _, err := io.Copy(v, rc); err != nil {
+		if errors.Is(err, zip.ErrChecksum) {
+			if merr := v.check(); merr != nil {
+				return merr
+			}
+		}
+		return err
+	}
+	return v.check()
+}
+
+// CompareDir compares the archive with a directory it was extracted to
+// and reports every mismatching, missing and extra file. Entries whose
+// names would lead outside dir fail without being looked up.
+func CompareDir(files []*zip.File, dir string, opts CheckOptions) *CheckReport {
+	report := &CheckReport{}
+	var mu sync.Mutex
+	known := map[string]bool{}
+	forEachEntry(files, opts.Workers, func(f *zip.File) {
+		name := entryName(f, opts.Encoding)
+		rel := filepath.FromSlash(name)
+		if !filepath.IsLocal(rel) {
+			report.add(name, errors.New("path outside the directory"))
+			return
+		}
+		rel = filepath.Clean(rel)
+		mu.Lock()
+		for p := rel; p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+			known[p] = true
+		}
+		mu.Unlock()
+
+		fullPath := filepath.Join(dir, rel)
+		info, err := os.Lstat(fullPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			report.addMissing(name)
+			return
+		}
+		if err != nil {
+			report.add(name, err)
+			return
+		}
+		if f.FileInfo().IsDir() {
+			if !info.IsDir() {
+				report.add(name, errors.New("expected a directory"))
+			} else {
+				report.add(name, nil)
+			}
+			return
+		}
+		report.add(name, VerifyExtracted(f, fullPath))
+	})
+
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			utils.Error("%s: %v", p, err)
+			report.Unread = append(report.Unread, EntryResult{Name: p, Err: err})
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return nil
+		}
+		if !known[rel] {
+			report.Extra = append(report.Extra, filepath.ToSlash(rel))
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	report.sort()
+	return report
+}
+
+func entryName(f *zip.File, encoding string) string {
+	name, err := getFileName(f, encoding)
+	if err != nil {
+		return f.Name
+	}
+	return name
+}
+
+func forEachEntry(files []*zip.File, workers int, fn func(f *zip.File)) {
+	if workers < 1 {
+		workers = 1
+	}
+	semaphore := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for _, f := range files {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(f *zip.File) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			fn(f)
+		}(f)
+	}
+	wg.Wait()
+}
+
+func (r *CheckReport) add(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Tested++
+	if err != nil {
+		utils.Error("%s: %v", name, err)
+		r.Failed = append(r.Failed, EntryResult{Name: name, Err: err})
+	} else {
+		utils.Debug("OK %s", name)
+	}
+}
+
+func (r *CheckReport) addMissing(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Tested++
+	utils.Error("%s: missing", name)
+	r.Missing = append(r.Missing, name)
+}
+
+func (r *CheckReport) sort() {
+	sort.Slice(r.Failed, func(i, j int) bool { return r.Failed[i].Name < r.Failed[j].Name })
+	sort.Strings(r.Missing)
+	sort.Strings(r.Extra)
+}
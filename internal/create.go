@@ -0,0 +1,369 @@
+package internal
+
+import (
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gdme1320/zip/internal/utils"
+	zip "github.com/gdme1320/zip/pkg"
+)
+
+// CreateOptions controls how an archive is created.
+type CreateOptions struct {
+	Method       uint16               // 压缩方法
+	Level        int                  // 压缩级别, -1 使用默认值
+	Encryption   zip.EncryptionMethod // 加密方法, 仅在设置密码时使用
+	Password     []byte               // 密码
+	Encoding     string               // 文件名编码; 非 utf8 时同时写入 Unicode Path 扩展字段
+	Include      []string             // 只添加匹配的文件
+	Exclude      []string             // 跳过匹配的文件和目录
+	Comment      string               // 归档注释
+	Reproducible bool                 // 按名称排序, 时间截断到 SOURCE_DATE_EPOCH, 统一权限和创建系统
+	Adaptive     bool                 // 按扩展名和内容采样, 对无法压缩的文件使用 store
+	Seekable     bool                 // 输出是从头写入的普通文件, 本地头回填 CRC32 和大小
+}
+
+// CreateArchive writes the given files and directory trees to w and
+// returns the number of entries added.
+// Directories are added recursively with zip.Writer.AddDir; modes and
+// modification times are preserved. A file equal to skip (typically
+// the output archive itself) is never added. With opts.Seekable, w must
+// be an io.WriteSeeker positioned at offset 0, such as a regular file
+// the caller created, and local headers carry the CRC32 and sizes
+// instead of data descriptors. Standard output is not seekable even
+// when it is redirected to a file, which may have been opened in
+// append mode.
+func CreateArchive(w io.Writer, inputs []string, skip os.FileInfo, opts CreateOptions) (int, error) {
+	var zw *zip.Writer
+	if ws, ok := w.(io.WriteSeeker); ok && opts.Seekable {
+		zw = zip.NewSeekableWriter(ws)
+	} else {
+		zw = zip.NewWriter(w)
+	}
+	if err := zw.SetComment(opts.Comment); err != nil {
+		return 0, err
+	}
+	a := &adder{zw: zw, skip: skip, opts: opts}
+	if err := a.addAll(inputs); err != nil {
+		return a.count, err
+	}
+	return a.count, zw.Close()
+}
+
+// UpdateOptions controls how an existing archive is updated.
+type UpdateOptions struct {
+	CreateOptions
+	OnlyChanged bool // 只添加新文件和已修改的文件
+	CompareCRC  bool // 用 CRC32 而不是修改时间判断文件是否修改
+}
+
+// UpdateArchive adds the given files and directory trees to the archive
+// at zipPath in place and returns the number of entries added. Entries
+// with the same name are replaced; their old data is left in the
+// archive as unused space. With OnlyChanged, files whose entry has the
+// same modification time (or CRC32 with CompareCRC) are skipped.
+// An empty Comment keeps the archive comment.
+func UpdateArchive(zipPath string, inputs []string, opts UpdateOptions) (int, error) {
+	zw, err := zip.OpenAppend(zipPath)
+	if err != nil {
+		return 0, err
+	}
+	existing := make(map[string]*zip.File, len(zw.File))
+	for _, f := range zw.File {
+		existing[entryName(f, opts.Encoding)] = f
+	}
+	if opts.Comment != "" {
+		if err := zw.SetComment(opts.Comment); err != nil {
+			zw.Close()
+			return 0, err
+		}
+	}
+	skip, _ := os.Stat(zipPath)
+	a := &adder{zw: zw.Writer, skip: skip, opts: opts.CreateOptions}
+	if opts.OnlyChanged {
+		a.keep = func(name, p string, info os.FileInfo) bool {
+			f, ok := existing[name]
+			if !ok {
+				return true
+			}
+			changed, err := fileChanged(f, p, info, opts.CompareCRC)
+			if err != nil {
+				utils.Error("比较文件失败 %s: %v", p, err)
+				return true
+			}
+			return changed
+		}
+	}
+	a.replace = func(name string) {
+		if f, ok := existing[name]; ok {
+			zw.Remove(f)
+			delete(existing, name)
+		}
+	}
+	err = a.addAll(inputs)
+	if err1 := zw.Close(); err == nil {
+		err = err1
+	}
+	return a.count, err
+}
+
+// fileChanged reports whether the file at p differs from the entry f.
+// Modification times are compared at the two second resolution of the
+// MS-DOS time fields. AE-2 entries carry no CRC32 and always fall back
+// to the modification time.
+func fileChanged(f *zip.File, p string, info os.FileInfo, byCRC bool) (bool, error) {
+	if uint64(info.Size()) != f.UncompressedSize64 && info.Mode().IsRegular() {
+		return true, nil
+	}
+	if !byCRC || !hasCRC(f) || !info.Mode().IsRegular() {
+		diff := info.ModTime().Sub(f.ModTime())
+		return diff >= 2*time.Second || diff <= -2*time.Second, nil
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, file); err != nil {
+		return false, err
+	}
+	return h.Sum32() != f.CRC32, nil
+}
+
+// adder adds files and directory trees to a zip.Writer.
+type adder struct {
+	zw   *zip.Writer
+	skip os.FileInfo
+	opts CreateOptions
+	// keep, if non-nil, decides whether a file (not a directory) with the
+	// given entry name and path is added.
+	keep func(name, p string, info os.FileInfo) bool
+	// replace, if non-nil, is called with the entry name before an entry
+	// is added.
+	replace func(name string)
+	count   int
+}
+
+func (a *adder) addAll(inputs []string) error {
+	if a.opts.Level != -1 {
+		if err := a.zw.SetLevel(a.opts.Level); err != nil {
+			return err
+		}
+	}
+	if a.opts.Adaptive {
+		a.zw.SetAdaptive(nil)
+	}
+	if a.opts.Reproducible {
+		if err := a.zw.SetReproducible(nil); err != nil {
+			return err
+		}
+		inputs = append([]string(nil), inputs...)
+		sort.Slice(inputs, func(i, j int) bool { return archiveName(inputs[i]) < archiveName(inputs[j]) })
+	}
+	for _, input := range inputs {
+		if err := a.add(input); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *adder) add(input string) error {
+	opts := a.opts
+	info, err := os.Lstat(input)
+	if err != nil {
+		return err
+	}
+	name := archiveName(input)
+	if name != "" && matchAny(opts.Exclude, name) {
+		return nil
+	}
+	if !info.IsDir() {
+		if a.skip != nil && os.SameFile(info, a.skip) {
+			return nil
+		}
+		if len(opts.Include) > 0 && !matchAny(opts.Include, name) {
+			return nil
+		}
+		if a.keep != nil && !a.keep(name, input, info) {
+			return nil
+		}
+		a.replaced(name)
+		if err := addFile(a.zw, input, name, info, opts); err != nil {
+			return err
+		}
+		a.count++
+		return nil
+	}
+
+	// the directory itself, then its contents
+	prefix := ""
+	if name != "" {
+		prefix = name + "/"
+		fh, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		fh.Method = zip.Store
+		if err := setHeader(fh, prefix, info, opts); err != nil {
+			return err
+		}
+		a.replaced(prefix)
+		if _, err := a.zw.CreateHeader(fh); err != nil {
+			return err
+		}
+		a.count++
+	}
+	return a.zw.AddDir(input, &zip.AddFSOptions{
+		Prefix: prefix,
+		Filter: func(p string, d fs.DirEntry) bool {
+			full := prefix + p
+			if matchAny(opts.Exclude, full) {
+				return false
+			}
+			if d.IsDir() {
+				return true
+			}
+			info, err := d.Info()
+			if err != nil {
+				return true // reported by AddDir
+			}
+			if a.skip != nil && os.SameFile(info, a.skip) {
+				return false
+			}
+			if len(opts.Include) > 0 && !matchAny(opts.Include, full) {
+				return false
+			}
+			return a.keep == nil || a.keep(full, filepath.Join(input, filepath.FromSlash(p)), info)
+		},
+		Header: func(fh *zip.FileHeader, p string, info fs.FileInfo) error {
+			a.replaced(fh.Name)
+			a.count++
+			return setHeader(fh, fh.Name, info, opts)
+		},
+	})
+}
+
+func (a *adder) replaced(name string) {
+	if a.replace != nil {
+		a.replace(name)
+	}
+}
+
+// setHeader applies the name encoding, method and encryption options.
+func setHeader(fh *zip.FileHeader, name string, info os.FileInfo, opts CreateOptions) error {
+	if err := encodeName(fh, name, opts.Encoding); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	fh.Method = opts.Method
+	if opts.Password != nil {
+		fh.SetPassword(opts.Password)
+		fh.SetEncryptionMethod(opts.Encryption)
+	}
+	utils.Debug("adding: %s", name)
+	return nil
+}
+
+// addFile adds a single file or symbolic link given on the command line.
+func addFile(zw *zip.Writer, p, name string, info os.FileInfo, opts CreateOptions) error {
+	fh, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	if err := setHeader(fh, name, info, opts); err != nil {
+		return err
+	}
+	w, err := zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, target)
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// encodeName sets the name of fh. Non-ASCII names are either flagged as
+// UTF-8 or, for other encodings, stored encoded with the UTF-8 form in
+// a Unicode Path extra field.
+func encodeName(fh *zip.FileHeader, name, encoding string) error {
+	fh.Name = name
+	fh.Flags &^= 0x800
+	if fh.UnicodePath != nil {
+		fh.SetUnicodePath("")
+	}
+	if isASCII(name) {
+		return nil
+	}
+	enc := strings.ToLower(encoding)
+	if enc == "" || enc == "utf8" || enc == "utf-8" {
+		fh.Flags |= 0x800 // language encoding flag (EFS)
+		return nil
+	}
+	b, err := GetBytes(name, enc)
+	if err != nil {
+		return err
+	}
+	fh.Name = string(b)
+	fh.SetUnicodePath(name)
+	return nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// archiveName converts a file system path to a relative, slash
+// separated entry name, dropping volume names, leading slashes and
+// parent directory references.
+func archiveName(p string) string {
+	p = filepath.ToSlash(strings.TrimPrefix(p, filepath.VolumeName(p)))
+	p = path.Clean("/" + p)
+	return strings.TrimPrefix(p, "/")
+}
+
+// matchAny reports whether name, or its base name, matches one of the
+// shell patterns.
+func matchAny(patterns []string, name string) bool {
+	base := path.Base(name)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	zip "github.com/gdme1320/zip/pkg"
+)
+
+func TestCreateArchive(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "src", "skip"), 0755)
+	os.WriteFile(filepath.Join(dir, "src", "a.txt"), []byte("hello"), 0600)
+	os.WriteFile(filepath.Join(dir, "src", "b.tmp"), []byte("tmp"), 0644)
+	os.WriteFile(filepath.Join(dir, "src", "测试.txt"), []byte("gbk"), 0644)
+	os.WriteFile(filepath.Join(dir, "src", "skip", "c.txt"), []byte("skip"), 0644)
+
+	buf := new(bytes.Buffer)
+	n, err := CreateArchive(buf, []string{filepath.Join(dir, "src")}, nil, CreateOptions{
+		Method:   zip.Deflate,
+		Level:    -1,
+		Encoding: "gbk",
+		Exclude:  []string{"*.tmp", "skip"},
+		Comment:  "comment",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || len(r.File) != 3 || r.Comment != "comment" {
+		t.Fatalf("got %d entries, comment %q", len(r.File), r.Comment)
+	}
+	prefix := archiveName(filepath.Join(dir, "src"))
+	for _, f := range r.File {
+		name := entryName(f, "gbk")
+		switch name {
+		case prefix + "/":
+			if !f.FileInfo().IsDir() {
+				t.Errorf("%s should be a directory", name)
+			}
+		case prefix + "/a.txt":
+			if f.Mode().Perm() != 0600 {
+				t.Errorf("%s mode: got %v", name, f.Mode())
+			}
+			rc, _ := f.Open()
+			b, _ := io.ReadAll(rc)
+			if string(b) != "hello" {
+				t.Errorf("%s content: got %q", name, b)
+			}
+		case prefix + "/测试.txt":
+			if f.UnicodePath == nil || f.Name == name {
+				t.Errorf("%s should be stored in GBK with a unicode path", name)
+			}
+		default:
+			t.Errorf("unexpected entry %q", name)
+		}
+	}
+}
+
+func TestUpdateArchive(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(src, 0755)
+	os.WriteFile(filepath.Join(src, "a.txt"), []byte("old a"), 0644)
+	os.WriteFile(filepath.Join(src, "b.txt"), []byte("old b"), 0644)
+
+	zipPath := filepath.Join(dir, "out.zip")
+	f, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := CreateOptions{Method: zip.Deflate, Level: -1, Comment: "keep me", Seekable: true}
+	if _, err := CreateArchive(f, []string{src}, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// same size, so only the content or the modification time tells
+	os.WriteFile(filepath.Join(src, "a.txt"), []byte("new a"), 0644)
+	os.WriteFile(filepath.Join(src, "c.txt"), []byte("new c"), 0644)
+
+	opts.Comment = ""
+	n, err := UpdateArchive(zipPath, []string{src}, UpdateOptions{CreateOptions: opts, OnlyChanged: true, CompareCRC: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the directory entry is always replaced
+	if n != 3 {
+		t.Errorf("added %d entries, want 3", n)
+	}
+
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Comment != "keep me" {
+		t.Errorf("comment: got %q", r.Comment)
+	}
+	prefix := archiveName(src) + "/"
+	want := map[string]string{prefix: "", prefix + "a.txt": "new a", prefix + "b.txt": "old b", prefix + "c.txt": "new c"}
+	if len(r.File) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(r.File), len(want))
+	}
+	for _, f := range r.File {
+		content, ok := want[f.Name]
+		if !ok {
+			t.Errorf("unexpected entry %q", f.Name)
+			continue
+		}
+		rc, _ := f.Open()
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(b) != content {
+			t.Errorf("%s: got %q, want %q", f.Name, b, content)
+		}
+	}
+}
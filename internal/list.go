@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	zip "github.com/gdme1320/zip/pkg"
+)
+
+// methodNames maps compression method IDs from APPNOTE.TXT 4.4.5 to
+// the names shown in listings.
+var methodNames = map[uint16]string{
+	0:  "Store",
+	1:  "Shrink",
+	2:  "Reduce1",
+	3:  "Reduce2",
+	4:  "Reduce3",
+	5:  "Reduce4",
+	6:  "Implode",
+	8:  "Deflate",
+	9:  "Deflate64",
+	12: "BZip2",
+	14: "LZMA",
+	93: "Zstd",
+	95: "XZ",
+	98: "PPMd",
+}
+
+// MethodName returns a readable name for a compression method.
+func MethodName(method uint16) string {
+	if n, ok := methodNames[method]; ok {
+		return n
+	}
+	return fmt.Sprintf("Unk:%03d", method)
+}
+
+// EncryptionName returns a readable name for the encryption of a file.
+func EncryptionName(f *zip.File) string {
+	switch f.Encryption() {
+	case 0:
+		return "None"
+	case zip.StandardEncryption:
+		return "ZipCrypto"
+	case zip.AES128Encryption:
+		return "AES-128"
+	case zip.AES192Encryption:
+		return "AES-192"
+	case zip.AES256Encryption:
+		return "AES-256"
+	}
+	return "Unknown"
+}
+
+// EntryInfo describes a zip entry for listings.
+type EntryInfo struct {
+	Name             string    `json:"name"`
+	Method           string    `json:"method"`
+	MethodID         uint16    `json:"method_id"`
+	CompressedSize   uint64    `json:"compressed_size"`
+	UncompressedSize uint64    `json:"uncompressed_size"`
+	Ratio            float64   `json:"ratio"` // 压缩节省的百分比
+	CRC32            string    `json:"crc32"`
+	Modified         time.Time `json:"modified"`
+	Mode             string    `json:"mode"`
+	Encryption       string    `json:"encryption"`
+	AESVersion       string    `json:"aes_version,omitempty"` // AE-1 or AE-2
+	Zip64            bool      `json:"zip64"`
+	IsDir            bool      `json:"is_dir"`
+	Comment          string    `json:"comment,omitempty"`
+}
+
+// ListTotals summarizes all entries of an archive.
+type ListTotals struct {
+	Entries          int     `json:"entries"`
+	CompressedSize   uint64  `json:"compressed_size"`
+	UncompressedSize uint64  `json:"uncompressed_size"`
+	Ratio            float64 `json:"ratio"`
+}
+
+// Listing is the machine readable form of an archive listing.
+type Listing struct {
+	Comment string      `json:"comment,omitempty"`
+	Entries []EntryInfo `json:"entries"`
+	Totals  ListTotals  `json:"totals"`
+}
+
+func ratio(compressed, uncompressed uint64) float64 {
+	if uncompressed == 0 {
+		return 0
+	}
+	r := 100 - float64(compressed)*100/float64(uncompressed)
+	return float64(int64(r*10)) / 10
+}
+
+// DescribeEntry collects the listing details of a zip entry.
+// The name is decoded with the given encoding as in ListFile.
+func DescribeEntry(f *zip.File, encoding string) EntryInfo {
+	name, err := getFileName(f, encoding)
+	if err != nil {
+		name = f.Name
+	}
+	info := EntryInfo{
+		Name:             name,
+		Method:           MethodName(f.Method),
+		MethodID:         f.Method,
+		CompressedSize:   f.CompressedSize64,
+		UncompressedSize: f.UncompressedSize64,
+		Ratio:            ratio(f.CompressedSize64, f.UncompressedSize64),
+		CRC32:            fmt.Sprintf("%08x", f.CRC32),
+		Modified:         f.ModTime(),
+		Mode:             f.Mode().String(),
+		Encryption:       EncryptionName(f),
+		Zip64:            f.IsZip64(),
+		IsDir:            f.FileInfo().IsDir(),
+		Comment:          f.Comment,
+	}
+	if v := f.AESVersion(); v != 0 {
+		info.AESVersion = fmt.Sprintf("AE-%d", v)
+	}
+	return info
+}
+
+// NewListing describes all files of an archive.
+func NewListing(files []*zip.File, comment, encoding string) *Listing {
+	l := &Listing{Comment: comment, Entries: make([]EntryInfo, 0, len(files))}
+	for _, f := range files {
+		info := DescribeEntry(f, encoding)
+		l.Entries = append(l.Entries, info)
+		l.Totals.Entries++
+		l.Totals.CompressedSize += info.CompressedSize
+		l.Totals.UncompressedSize += info.UncompressedSize
+	}
+	l.Totals.Ratio = ratio(l.Totals.CompressedSize, l.Totals.UncompressedSize)
+	return l
+}
+
+// WriteJSON writes the listing as an indented JSON document.
+func (l *Listing) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(l)
+}
+
+// WriteCSV writes one CSV record per entry, preceded by a header row.
+func (l *Listing) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "method", "method_id", "compressed_size", "uncompressed_size",
+		"ratio", "crc32", "modified", "mode", "encryption", "aes_version", "zip64", "is_dir", "comment"})
+	for _, e := range l.Entries {
+		cw.Write([]string{
+			e.Name,
+			e.Method,
+			strconv.Itoa(int(e.MethodID)),
+			strconv.FormatUint(e.CompressedSize, 10),
+			strconv.FormatUint(e.UncompressedSize, 10),
+			strconv.FormatFloat(e.Ratio, 'f', 1, 64),
+			e.CRC32,
+			e.Modified.Format(time.RFC3339),
+			e.Mode,
+			e.Encryption,
+			e.AESVersion,
+			strconv.FormatBool(e.Zip64),
+			strconv.FormatBool(e.IsDir),
+			e.Comment,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteVerbose writes a table in the spirit of `unzip -v`.
+func (l *Listing) WriteVerbose(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Length\tMethod\tSize\tCmpr\tDate Time\tCRC-32\tMode\tEncryption\tZip64\t  Name")
+	for _, e := range l.Entries {
+		enc := e.Encryption
+		if e.AESVersion != "" {
+			enc += "/" + e.AESVersion
+		}
+		zip64 := ""
+		if e.Zip64 {
+			zip64 = "zip64"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%.1f%%\t%s\t%s\t%s\t%s\t%s\t  %s\n",
+			e.UncompressedSize, e.Method, e.CompressedSize, e.Ratio,
+			e.Modified.Format("2006-01-02 15:04"), e.CRC32, e.Mode, enc, zip64, e.Name)
+		if e.Comment != "" {
+			fmt.Fprintf(tw, "\t\t\t\t\t\t\t\t\t    %s\n", e.Comment)
+		}
+	}
+	fmt.Fprintf(tw, "%d\t\t%d\t%.1f%%\t\t\t\t\t\t  %d files\n",
+		l.Totals.UncompressedSize, l.Totals.CompressedSize, l.Totals.Ratio, l.Totals.Entries)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if l.Comment != "" {
+		_, err := fmt.Fprintf(w, "Archive comment: %s\n", l.Comment)
+		return err
+	}
+	return nil
+}
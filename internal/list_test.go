@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	zip "github.com/gdme1320/zip/pkg"
+)
+
+func TestListing(t *testing.T) {
+	zf := buildTestZip(t, "a.txt", bytes.Repeat([]byte("a"), 1000))
+	l := NewListing([]*zip.File{zf}, "archive comment", "")
+	if l.Totals.Entries != 1 || l.Totals.UncompressedSize != 1000 {
+		t.Fatalf("unexpected totals: %+v", l.Totals)
+	}
+	e := l.Entries[0]
+	if e.Method != "Deflate" || e.Encryption != "None" || e.Ratio <= 90 {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+
+	var buf bytes.Buffer
+	if err := l.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var got Listing
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Comment != "archive comment" || got.Entries[0].CRC32 != e.CRC32 {
+		t.Errorf("json round trip: got %+v", got)
+	}
+
+	buf.Reset()
+	if err := l.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "a.txt,Deflate,8,") {
+		t.Errorf("unexpected csv: %q", buf.String())
+	}
+}
@@ -8,6 +8,9 @@ type ZipFileProcessArgs interface {
 	GetEncoding() string
 	GetPassword() []byte
 
+	// Whether to verify size and checksums while extracting.
+	GetVerify() bool
+
 	// Called after the file name is decoded using the correct encoding.
 	// Return false to skip processing this file.
 	OnFileName(name string) bool
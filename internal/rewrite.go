@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gdme1320/zip/internal/utils"
+	zip "github.com/gdme1320/zip/pkg"
+)
+
+// DeleteEntries removes the entries matching any of the patterns from
+// the archive and returns the number of entries removed. Patterns are
+// matched as in CreateOptions.Exclude; a matching directory is removed
+// together with its contents.
+func DeleteEntries(zipPath string, patterns []string, encoding string) (int, error) {
+	removed := 0
+	err := zip.RewriteFile(zipPath, func(f *zip.File, fh *zip.FileHeader) (bool, error) {
+		name := entryName(f, encoding)
+		if !matchPath(patterns, name) {
+			return true, nil
+		}
+		utils.Debug("deleting: %s", name)
+		removed++
+		return false, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// matchPath reports whether name or one of its parent directories
+// matches one of the patterns.
+func matchPath(patterns []string, name string) bool {
+	name = strings.TrimSuffix(name, "/")
+	for name != "" {
+		if matchAny(patterns, name) {
+			return true
+		}
+		i := strings.LastIndexByte(name, '/')
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return false
+}
+
+// RenameEntries renames the entry oldName to newName and returns the
+// number of entries renamed. If oldName is a directory, every entry
+// below it is moved as well. Names are encoded as by CreateArchive, so
+// a Unicode Path extra field is rewritten with the CRC-32 of the new
+// name. Renaming onto an existing entry is an error.
+func RenameEntries(zipPath, oldName, newName, encoding string) (int, error) {
+	oldName = strings.TrimSuffix(archiveName(oldName), "/")
+	newName = strings.TrimSuffix(archiveName(newName), "/")
+	if oldName == "" || newName == "" {
+		return 0, fmt.Errorf("invalid name")
+	}
+
+	renamed := 0
+	names := make(map[string]bool)
+	err := zip.RewriteFile(zipPath, func(f *zip.File, fh *zip.FileHeader) (bool, error) {
+		name := entryName(f, encoding)
+		target := name
+		if name == oldName || strings.HasPrefix(name, oldName+"/") {
+			target = newName + name[len(oldName):]
+		}
+		if names[target] {
+			return false, fmt.Errorf("%s: entry already exists", target)
+		}
+		names[target] = true
+		if target == name {
+			return true, nil
+		}
+		utils.Debug("renaming: %s -> %s", name, target)
+		renamed++
+		return true, encodeName(fh, target, encoding)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return renamed, nil
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	zip "github.com/gdme1320/zip/pkg"
+)
+
+func rewriteTestArchive(t *testing.T) string {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(filepath.Join(src, "dir", "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "dir", "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(src, "dir", "sub", "测试.txt"), []byte("b"), 0644)
+	os.WriteFile(filepath.Join(src, "secret.txt"), []byte("c"), 0644)
+	os.WriteFile(filepath.Join(src, "x.log"), []byte("d"), 0644)
+
+	zipPath := filepath.Join(dir, "out.zip")
+	f, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	wd, _ := os.Getwd()
+	os.Chdir(src)
+	defer os.Chdir(wd)
+	_, err = CreateArchive(f, []string{"dir", "secret.txt", "x.log"}, nil, CreateOptions{
+		Method:   zip.Deflate,
+		Level:    -1,
+		Encoding: "gbk",
+		Comment:  "comment",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zipPath
+}
+
+func archiveNames(t *testing.T, zipPath string) []string {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Comment != "comment" {
+		t.Errorf("comment: got %q", r.Comment)
+	}
+	var names []string
+	for _, f := range r.File {
+		names = append(names, entryName(f, "gbk"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDeleteEntries(t *testing.T) {
+	zipPath := rewriteTestArchive(t)
+	n, err := DeleteEntries(zipPath, []string{"secret.txt", "*.log", "sub"}, "gbk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("deleted %d entries, want 4", n)
+	}
+	want := []string{"dir/", "dir/a.txt"}
+	if got := archiveNames(t, zipPath); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRenameEntries(t *testing.T) {
+	zipPath := rewriteTestArchive(t)
+	n, err := RenameEntries(zipPath, "dir", "新目录", "gbk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("renamed %d entries, want 4", n)
+	}
+	want := []string{"secret.txt", "x.log", "新目录/", "新目录/a.txt", "新目录/sub/", "新目录/sub/测试.txt"}
+	got := archiveNames(t, zipPath)
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %q, want %q", got, want)
+			break
+		}
+	}
+
+	if _, err := RenameEntries(zipPath, "secret.txt", "x.log", "gbk"); err == nil {
+		t.Error("expected an error renaming onto an existing entry")
+	}
+}
@@ -2,7 +2,7 @@ package internal
 
 import (
 	"errors"
-	"hash/crc32"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -94,10 +94,32 @@ func ProcessSingleFile(args ZipFileProcessArgs) (string, error) {
 	}
 	defer outFile.Close()
 
-	if _, err := io.Copy(outFile, rc); err != nil {
+	// Integrity is checked while the data streams through: the zip
+	// reader verifies CRC32 (plain and ZipCrypto) and the AES HMAC,
+	// and the verifier records both values for a readable report.
+	var dst io.Writer = outFile
+	var verifier *streamVerifier
+	if args.GetVerify() {
+		verifier = newStreamVerifier(zipFile, fileName)
+		dst = io.MultiWriter(outFile, verifier)
+	}
+	if _, err := io.Copy(dst, rc); err != nil {
+		if verifier != nil && errors.Is(err, zip.ErrChecksum) {
+			if merr := verifier.check(); merr != nil {
+				return fullPath, merr
+			}
+		}
+		if errors.Is(err, zip.ErrChecksum) || errors.Is(err, zip.ErrAuthentication) {
+			return fullPath, fmt.Errorf("%s: %w", fileName, err)
+		}
 		utils.Error("复制文件失败 %s: %v", fileName, err)
 		return "", err
 	}
+	if verifier != nil {
+		if err := verifier.check(); err != nil {
+			return fullPath, err
+		}
+	}
 
 	// Set file permissions
 	if err := outFile.Chmod(zipFile.Mode()); err != nil {
@@ -105,30 +127,3 @@ func ProcessSingleFile(args ZipFileProcessArgs) (string, error) {
 	}
 	return fullPath, nil
 }
-
-func ValidateZip(zipFile *zip.File, fullPath string) (bool, error) {
-	utils.Stdout(utils.ZipValidator, "Validating file %s: ", fullPath)
-
-	info, err := os.Stat(fullPath)
-	if err != nil {
-		utils.Error("获取文件信息失败 %s: %v", fullPath, err)
-		return false, err
-	}
-	if info.Size() != int64(zipFile.UncompressedSize64) {
-		return false, nil
-	}
-	utils.Stdout(utils.ZipValidator, "Size matched: %d; ", info.Size())
-
-	hasher := crc32.NewIEEE()
-	outFile, _ := os.Open(fullPath)
-	if _, err := io.Copy(hasher, outFile); err != nil {
-		return false, errors.New("CRC计算失败")
-	}
-
-	calculatedCRC32 := hasher.Sum32()
-	if calculatedCRC32 != zipFile.CRC32 {
-		return false, nil
-	}
-	utils.Stdout(utils.ZipValidator, "Crc matched: %d; \n", calculatedCRC32)
-	return true, nil
-}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/gdme1320/zip/internal/utils"
+	zip "github.com/gdme1320/zip/pkg"
+)
+
+// MismatchError reports a size or CRC32 mismatch between a zip entry
+// and the data that was produced from it.
+type MismatchError struct {
+	Name  string
+	Field string // "size" or "crc32"
+	Want  uint64
+	Got   uint64
+}
+
+func (e *MismatchError) Error() string {
+	var msg string
+	if e.Field == "crc32" {
+		msg = fmt.Sprintf("crc32 mismatch: want %08x, got %08x", e.Want, e.Got)
+	} else {
+		msg = fmt.Sprintf("%s mismatch: want %d, got %d", e.Field, e.Want, e.Got)
+	}
+	if e.Name == "" {
+		return msg
+	}
+	return e.Name + ": " + msg
+}
+
+// hasCRC reports whether the entry carries a CRC32 that can be checked.
+// WinZip AE-2 entries store zero and rely on the HMAC instead.
+func hasCRC(zipFile *zip.File) bool {
+	return !zipFile.IsAE2()
+}
+
+// streamVerifier observes the bytes produced during extraction so that
+// size and CRC32 can be checked without reading the output back.
+type streamVerifier struct {
+	name  string
+	f     *zip.File
+	hash  hash.Hash32
+	count uint64
+}
+
+func newStreamVerifier(zipFile *zip.File, name string) *streamVerifier {
+	return &streamVerifier{name: name, f: zipFile, hash: crc32.NewIEEE()}
+}
+
+func (v *streamVerifier) Write(p []byte) (int, error) {
+	v.hash.Write(p)
+	v.count += uint64(len(p))
+	return len(p), nil
+}
+
+// check compares what has been written so far with the entry header.
+func (v *streamVerifier) check() error {
+	return compareEntry(v.f, v.name, v.count, v.hash.Sum32())
+}
+
+func compareEntry(zipFile *zip.File, name string, size uint64, crc uint32) error {
+	if size != zipFile.UncompressedSize64 {
+		return &MismatchError{Name: name, Field: "size", Want: zipFile.UncompressedSize64, Got: size}
+	}
+	if hasCRC(zipFile) && crc != zipFile.CRC32 {
+		return &MismatchError{Name: name, Field: "crc32", Want: uint64(zipFile.CRC32), Got: uint64(crc)}
+	}
+	return nil
+}
+
+// VerifyExtracted re-reads an already extracted file from disk and
+// compares its size and CRC32 with the zip entry.
+// It returns a *MismatchError when the contents differ.
+func VerifyExtracted(zipFile *zip.File, fullPath string) error {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+	if uint64(info.Size()) != zipFile.UncompressedSize64 {
+		return &MismatchError{Name: fullPath, Field: "size", Want: zipFile.UncompressedSize64, Got: uint64(info.Size())}
+	}
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hasher := crc32.NewIEEE()
+	n, err := io.Copy(hasher, f)
+	if err != nil {
+		return fmt.Errorf("CRC计算失败: %v", err)
+	}
+	if err := compareEntry(zipFile, fullPath, uint64(n), hasher.Sum32()); err != nil {
+		return err
+	}
+	if hasCRC(zipFile) {
+		utils.Stdout(utils.ZipValidator, "Validating file %s: Size matched: %d; Crc matched: %08x\n", fullPath, n, hasher.Sum32())
+	} else {
+		utils.Stdout(utils.ZipValidator, "Validating file %s: Size matched: %d; no crc (AE-2)\n", fullPath, n)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gdme1320/zip/internal/utils"
+	zip "github.com/gdme1320/zip/pkg"
+)
+
+func init() {
+	utils.InitLogger(utils.Quiet)
+}
+
+func buildTestZip(t *testing.T, name string, data []byte) *zip.File {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	f, err := w.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.File[0]
+}
+
+func TestVerifyExtracted(t *testing.T) {
+	data := []byte("hello, verifier")
+	zf := buildTestZip(t, "a.txt", data)
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a.txt")
+
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyExtracted(zf, p); err != nil {
+		t.Errorf("expected match, got %v", err)
+	}
+
+	// same size, different content
+	bad := append([]byte(nil), data...)
+	bad[0] ^= 1
+	os.WriteFile(p, bad, 0644)
+	var merr *MismatchError
+	if err := VerifyExtracted(zf, p); !errors.As(err, &merr) || merr.Field != "crc32" {
+		t.Errorf("expected crc32 mismatch, got %v", err)
+	} else if merr.Want != uint64(zf.CRC32) || merr.Want == merr.Got {
+		t.Errorf("unexpected mismatch values: %+v", merr)
+	}
+
+	os.WriteFile(p, data[:3], 0644)
+	if err := VerifyExtracted(zf, p); !errors.As(err, &merr) || merr.Field != "size" {
+		t.Errorf("expected size mismatch, got %v", err)
+	}
+
+	if err := VerifyExtracted(zf, filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestCompareDir(t *testing.T) {
+	data := []byte("compare me")
+	zf := buildTestZip(t, "sub/a.txt", data)
+	dir := t.TempDir()
+
+	report := CompareDir([]*zip.File{zf}, dir, CheckOptions{Workers: 2})
+	if len(report.Missing) != 1 || report.Missing[0] != "sub/a.txt" {
+		t.Errorf("expected sub/a.txt missing, got %+v", report.Missing)
+	}
+
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "sub", "a.txt"), data, 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "b.txt"), data, 0644)
+	report = CompareDir([]*zip.File{zf}, dir, CheckOptions{})
+	if len(report.Failed) != 0 || len(report.Missing) != 0 {
+		t.Errorf("unexpected failures: %+v", report)
+	}
+	if len(report.Extra) != 1 || report.Extra[0] != "sub/b.txt" {
+		t.Errorf("expected sub/b.txt extra, got %+v", report.Extra)
+	}
+
+	// a name leading outside dir fails even if the file it names matches
+	zf = buildTestZip(t, "../a.txt", data)
+	os.WriteFile(filepath.Join(dir, "a.txt"), data, 0644)
+	report = CompareDir([]*zip.File{zf}, filepath.Join(dir, "sub"), CheckOptions{})
+	if report.Tested != 1 || len(report.Failed) != 1 || report.Failed[0].Name != "../a.txt" {
+		t.Errorf("expected ../a.txt to fail, got %+v", report)
+	}
+}
+
+func TestCheckArchive(t *testing.T) {
+	zf := buildTestZip(t, "a.txt", []byte("check me"))
+	report := CheckArchive([]*zip.File{zf}, CheckOptions{Workers: 2})
+	if !report.OK() || report.Tested != 1 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
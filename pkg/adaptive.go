@@ -0,0 +1,185 @@
+package zip
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// AdaptiveOptions configures Writer.SetAdaptive.
+type AdaptiveOptions struct {
+	// StoreExtensions lists the extensions, such as ".jpg", of the
+	// names of entries stored without looking at their data. Case is
+	// ignored. If nil, DefaultStoreExtensions is used.
+	StoreExtensions []string
+
+	// SampleSize is the number of leading bytes of an entry that are
+	// compressed to judge its data. If zero, 64 KiB is used.
+	SampleSize int
+
+	// Store, if non-nil, decides whether an entry is stored, given its
+	// header, the sample, which holds the whole data if complete is
+	// set, and the size the sample compressed to. By default entries
+	// are stored unless the sample shrinks by at least 1/32.
+	Store func(fh *FileHeader, sample []byte, compressed int, complete bool) bool
+}
+
+// DefaultStoreExtensions lists the extensions of already compressed
+// formats: images, audio, video, archives and packages.
+var DefaultStoreExtensions = []string{
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic", ".avif",
+	".mp3", ".m4a", ".aac", ".ogg", ".opus", ".flac",
+	".mp4", ".m4v", ".mov", ".mkv", ".webm", ".avi",
+	".zip", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".lz4", ".7z", ".rar",
+	".jar", ".apk", ".docx", ".xlsx", ".pptx", ".odt", ".ods", ".epub",
+	".woff", ".woff2",
+}
+
+const defaultSampleSize = 64 << 10
+
+// SetAdaptive makes w choose between Store and the method of each
+// entry created after the call with CreateHeader, as it is written.
+// Entries with a name listed in opts.StoreExtensions are stored. For
+// the others the header is held back until SampleSize bytes have been
+// written, or the entry is closed, and the sample is compressed to see
+// whether compressing pays off. Entries that fit in the sample are
+// judged by all of their data and never grow.
+//
+// Larger ones may still grow if their data gets less compressible
+// after the sample. With a Writer from NewSeekableWriter on an output
+// that can also be read, such as an *os.File, such an unencrypted
+// entry is rewritten stored, its local header padded to keep the
+// following data in place. Entries written by CreateRaw, Copy and
+// ParallelWriter are left alone. A nil opts uses the zero
+// AdaptiveOptions.
+func (w *Writer) SetAdaptive(opts *AdaptiveOptions) {
+	o := AdaptiveOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.StoreExtensions == nil {
+		o.StoreExtensions = DefaultStoreExtensions
+	}
+	if o.SampleSize <= 0 {
+		o.SampleSize = defaultSampleSize
+	}
+	w.adaptive = &o
+}
+
+// storeByName reports whether entries called name are stored.
+func (o *AdaptiveOptions) storeByName(name string) bool {
+	ext := path.Ext(name)
+	for _, e := range o.StoreExtensions {
+		if strings.EqualFold(ext, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide chooses the method of the adaptive entry fh from the sample
+// buffered by fw, writes its header and then the sample.
+func (w *Writer) decide(fw *fileWriter, fh *FileHeader) error {
+	sample := fw.sample
+	complete := len(sample) < cap(sample)
+	fw.decide, fw.sample = nil, nil
+	comp, err := w.entryCompressor(fh)
+	if err != nil {
+		return err
+	}
+	cw := &countWriter{w: io.Discard}
+	zw, err := comp(cw)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(sample); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	store := w.adaptive.Store
+	if store == nil {
+		store = storeSample
+	}
+	if store(fh, sample, int(cw.count), complete) {
+		fh.Method = Store
+		fh.comp = nil
+	}
+	if err := w.startEntry(fw, fh); err != nil {
+		return err
+	}
+	_, err = fw.Write(sample)
+	return err
+}
+
+// storeSample is the default AdaptiveOptions.Store.
+func storeSample(fh *FileHeader, sample []byte, compressed int, complete bool) bool {
+	return compressed > len(sample)-len(sample)/32
+}
+
+// storeFallback rewrites the entry h of a seekable Writer, whose data
+// came out larger than stored, as stored. The local header gets an
+// alignment extra field padding it by the difference, so that the
+// entry ends where it did, and storeFallback reports false if that
+// does not fit.
+func (w *Writer) storeFallback(h *header) (bool, error) {
+	fh := h.FileHeader
+	end := w.cw.count
+	dataOff := end - int64(fh.CompressedSize64)
+	extraLen := len(fh.Extra)
+	if fh.UncompressedSize64 > uint32max {
+		extraLen += 20 // zip64 extra
+	}
+	pad := end - int64(h.offset) - fileHeaderLen - int64(len(fh.Name)) - int64(extraLen) - int64(fh.UncompressedSize64)
+	if pad < minPadLen || int64(extraLen)+pad > uint16max {
+		return false, nil
+	}
+	dcomp := decompressor(fh.Method)
+	if dcomp == nil {
+		return false, nil
+	}
+	if err := w.Flush(); err != nil {
+		return false, err
+	}
+
+	// Decompress the data to a buffer, as it is to be overwritten.
+	spill := &spillBuffer{limit: defaultSampleSize}
+	defer spill.Close()
+	rc := dcomp(io.NewSectionReader(w.ws.(io.ReaderAt), w.seekBase+dataOff, int64(fh.CompressedSize64)))
+	n, err := io.Copy(spill, rc)
+	if err1 := rc.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return false, err
+	}
+	if uint64(n) != fh.UncompressedSize64 {
+		return false, fmt.Errorf("zip: %s: store fallback read %d bytes, want %d", fh.Name, n, fh.UncompressedSize64)
+	}
+
+	fh.Method = Store
+	fh.CompressedSize64 = fh.UncompressedSize64
+	fh.CompressedSize = fh.UncompressedSize
+	h.raw = true // sizes go into the local header
+	h.reserve64 = false
+	h.pad = int(pad)
+	var buf bytes.Buffer
+	if err := writeHeader(&buf, h); err != nil {
+		return false, err
+	}
+	if err := w.writeAt(buf.Bytes(), w.seekBase+int64(h.offset)); err != nil {
+		return false, err
+	}
+	r, err := spill.reader()
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(w.ws, r); err != nil {
+		return false, err
+	}
+	_, err = w.ws.Seek(w.seekBase+end, io.SeekStart)
+	return true, err
+}
@@ -0,0 +1,130 @@
+package zip
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// NewWriterAppend returns an AppendWriter that adds files to the
+// archive in f, which r must have been read from. The local entries of
+// the archive are kept as they are: new entries are written where the
+// old central directory began, and Close writes a central directory
+// covering both old and new entries, switching to zip64 records when
+// the number of entries or the offsets require it.
+//
+// The old central directory is kept in memory until Close succeeds. Until
+// then the file does not hold a valid archive; if Close fails, the old
+// directory is written back, which leaves the archive as it was. The
+// files of r remain readable while appending, since their data is never
+// overwritten. Close does not close f.
+func NewWriterAppend(f *os.File, r *Reader) (*AppendWriter, error) {
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if r.dirOffset > end {
+		return nil, ErrFormat
+	}
+	oldDir := make([]byte, end-r.dirOffset)
+	if _, err := f.ReadAt(oldDir, r.dirOffset); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(r.dirOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	w := NewWriter(f)
+	w.cw.count = r.dirOffset
+	w.comment = r.Comment
+	for _, zf := range r.File {
+		fh := zf.FileHeader
+		fh.Extra = removeExtra(zf.Extra, zip64ExtraId)
+		if fh.ae != 0 {
+			fh.Method = 99
+		}
+		if !fh.isZip64() {
+			fh.CompressedSize = uint32(fh.CompressedSize64)
+			fh.UncompressedSize = uint32(fh.UncompressedSize64)
+		}
+		w.dir = append(w.dir, &header{
+			FileHeader: &fh,
+			offset:     uint64(zf.headerOffset),
+			raw:        true,
+		})
+	}
+	return &AppendWriter{Writer: w, File: r.File, f: f, dirOffset: r.dirOffset, oldDir: oldDir}, nil
+}
+
+// Remove drops the existing file f from the central directory that
+// will be written by Close. Its data stays in the archive as unused
+// space. It reports whether f was found.
+func (w *Writer) Remove(f *File) bool {
+	for i, h := range w.dir {
+		if h.raw && h.offset == uint64(f.headerOffset) {
+			w.dir = append(w.dir[:i], w.dir[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// AppendWriter adds files to an archive on disk. See NewWriterAppend.
+type AppendWriter struct {
+	*Writer
+	File      []*File // the entries the archive had when it was opened
+	f         *os.File
+	owned     bool   // f was opened by OpenAppend
+	dirOffset int64  // offset of the old central directory
+	oldDir    []byte // the old central directory and end records
+}
+
+// OpenAppend opens the named archive for appending. Close closes the
+// file.
+func OpenAppend(name string) (*AppendWriter, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := new(Reader)
+	if err := r.init(f, fi.Size()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	a, err := NewWriterAppend(f, r)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a.owned = true
+	return a, nil
+}
+
+// Close writes the central directory and cuts the file after it. If
+// that fails, the old central directory is written back, which leaves
+// the archive as it was when opened.
+func (a *AppendWriter) Close() error {
+	if a.oldDir == nil {
+		return errors.New("zip: AppendWriter closed twice")
+	}
+	err := a.Writer.Close()
+	if err == nil {
+		err = a.f.Truncate(a.cw.count)
+	}
+	if err != nil {
+		if _, err1 := a.f.WriteAt(a.oldDir, a.dirOffset); err1 == nil {
+			a.f.Truncate(a.dirOffset + int64(len(a.oldDir)))
+		}
+	}
+	a.oldDir = nil
+	if a.owned {
+		if err1 := a.f.Close(); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+package zip
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	defaultCacheBlockSize = 64 << 10
+	defaultCacheBlocks    = 64
+)
+
+// A CachedReaderAt reads an io.ReaderAt in blocks and keeps the most
+// recently used ones, so that the many small reads of a Reader, such as
+// the central directory and the local file headers, are served from
+// memory. It helps where each read is slow, as on network file systems.
+// It is safe for concurrent use.
+type CachedReaderAt struct {
+	cache *blockCache
+}
+
+// NewCachedReaderAt returns a CachedReaderAt reading size bytes of r in
+// blocks of blockSize bytes and keeping up to blocks of them. If zero,
+// blockSize is 64 KiB and blocks is 64.
+func NewCachedReaderAt(r io.ReaderAt, size int64, blockSize, blocks int) *CachedReaderAt {
+	if blockSize <= 0 {
+		blockSize = defaultCacheBlockSize
+	}
+	if blocks <= 0 {
+		blocks = defaultCacheBlocks
+	}
+	return &CachedReaderAt{cache: newBlockCache(size, int64(blockSize), blocks, func(p []byte, off int64) error {
+		n, err := r.ReadAt(p, off)
+		if err == io.EOF {
+			if n == len(p) {
+				return nil // a full read may report EOF at the end
+			}
+			err = io.ErrUnexpectedEOF // the size is known, so EOF is short data
+		}
+		return err
+	})}
+}
+
+// Size returns the size of the data read.
+func (r *CachedReaderAt) Size() int64 { return r.cache.size }
+
+func (r *CachedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.cache.readAt(p, off)
+}
+
+// blockCache caches the blocks of data of a known size read by fetch,
+// which fills p, a run of whole blocks, from offset off. A read missing
+// several adjacent blocks fetches them with a single call.
+type blockCache struct {
+	size      int64
+	blockSize int64
+	capacity  int
+	fetch     func(p []byte, off int64) error
+
+	mu     sync.Mutex
+	blocks map[int64]*cacheBlock
+	lru    *list.List // of block numbers, most recently used first
+}
+
+// cacheBlock is a cached block, or one being fetched until ready is
+// closed.
+type cacheBlock struct {
+	data  []byte
+	err   error
+	ready chan struct{}
+	elem  *list.Element
+}
+
+func newBlockCache(size, blockSize int64, capacity int, fetch func(p []byte, off int64) error) *blockCache {
+	return &blockCache{
+		size:      size,
+		blockSize: blockSize,
+		capacity:  capacity,
+		fetch:     fetch,
+		blocks:    make(map[int64]*cacheBlock),
+		lru:       list.New(),
+	}
+}
+
+func (c *blockCache) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("zip: negative offset")
+	}
+	if off >= c.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), c.size)
+	bs := c.blockSize
+	first := off / bs
+	blocks := c.acquire(first, (end-1)/bs)
+	n := 0
+	for i, b := range blocks {
+		<-b.ready
+		if b.err != nil {
+			return n, b.err
+		}
+		from := int64(0)
+		if i == 0 {
+			from = off - first*bs
+		}
+		n += copy(p[n:], b.data[from:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// acquire returns the blocks first to last, starting to fetch those
+// that are neither cached nor being fetched, a run of adjacent ones per
+// call.
+func (c *blockCache) acquire(first, last int64) []*cacheBlock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	blocks := make([]*cacheBlock, 0, last-first+1)
+	var run []*cacheBlock
+	start := func() {
+		if len(run) > 0 {
+			go c.load(first+int64(len(blocks)-len(run)), run)
+			run = nil
+		}
+	}
+	for n := first; n <= last; n++ {
+		b := c.blocks[n]
+		if b != nil {
+			c.lru.MoveToFront(b.elem)
+			start()
+		} else {
+			b = &cacheBlock{ready: make(chan struct{})}
+			c.insert(n, b)
+			run = append(run, b)
+		}
+		blocks = append(blocks, b)
+	}
+	start()
+	return blocks
+}
+
+// insert caches b as block n, evicting the least recently used blocks
+// beyond the capacity. c.mu must be held.
+func (c *blockCache) insert(n int64, b *cacheBlock) {
+	b.elem = c.lru.PushFront(n)
+	c.blocks[n] = b
+	for c.lru.Len() > c.capacity {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.blocks, e.Value.(int64))
+	}
+}
+
+// load fetches blocks, numbered from first, with one call.
+func (c *blockCache) load(first int64, blocks []*cacheBlock) {
+	bs := c.blockSize
+	start := first * bs
+	end := min(start+int64(len(blocks))*bs, c.size)
+	data := make([]byte, end-start)
+	err := c.fetch(data, start)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, b := range blocks {
+		if err != nil {
+			b.err = err
+			// Forget the failed block, unless evicted already, for
+			// later reads to retry.
+			if n := first + int64(i); c.blocks[n] == b {
+				c.lru.Remove(b.elem)
+				delete(c.blocks, n)
+			}
+		} else {
+			b.data = data[int64(i)*bs : min(int64(i+1)*bs, end-start)]
+		}
+		close(b.ready)
+	}
+}
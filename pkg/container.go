@@ -0,0 +1,261 @@
+package zip
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// A Container is a document format packaged as a zip file, which
+// restricts how the entries of the archive are stored.
+type Container int
+
+const (
+	EPUB  Container = iota + 1 // EPUB Open Container Format
+	ODF                        // OpenDocument package
+	OOXML                      // Office Open XML package
+)
+
+const (
+	mimetypeName       = "mimetype"
+	epubMediaType      = "application/epub+zip"
+	odfMediaTypePrefix = "application/vnd.oasis.opendocument."
+	maxMediaTypeLen    = 256
+)
+
+func (c Container) String() string {
+	switch c {
+	case EPUB:
+		return "EPUB"
+	case ODF:
+		return "ODF"
+	case OOXML:
+		return "OOXML"
+	}
+	return fmt.Sprintf("Container(%d)", int(c))
+}
+
+// hasMimetype reports whether containers of kind c start with a stored
+// mimetype entry holding their media type.
+func (c Container) hasMimetype() bool {
+	return c == EPUB || c == ODF
+}
+
+// required returns the entry every container of kind c must have.
+func (c Container) required() string {
+	switch c {
+	case EPUB:
+		return "META-INF/container.xml"
+	case ODF:
+		return "META-INF/manifest.xml"
+	}
+	return "[Content_Types].xml"
+}
+
+func (c Container) validMediaType(mediaType string) bool {
+	if c == EPUB {
+		return mediaType == epubMediaType
+	}
+	return len(mediaType) > len(odfMediaTypePrefix) && len(mediaType) <= maxMediaTypeLen &&
+		strings.HasPrefix(mediaType, odfMediaTypePrefix)
+}
+
+// checkEntry returns how an entry other than the leading mimetype
+// breaks the rules of c: none of the formats allows zip encryption or
+// methods other than Store and Deflate.
+func (c Container) checkEntry(fh *FileHeader) []string {
+	var v []string
+	if c.hasMimetype() && fh.Name == mimetypeName {
+		v = append(v, "mimetype is not the first entry")
+	}
+	if fh.IsEncrypted() {
+		v = append(v, fh.Name+": encrypted")
+	}
+	if fh.Method != Store && fh.Method != Deflate {
+		v = append(v, fmt.Sprintf("%s: compression method %d", fh.Name, fh.Method))
+	}
+	return v
+}
+
+// A ContainerError lists the rules of a container format an archive
+// breaks. It is returned by Reader.CheckContainer, by Writer.Close for
+// missing entries and by the Writer methods refusing an entry.
+type ContainerError struct {
+	Container  Container
+	Violations []string
+}
+
+func (e *ContainerError) Error() string {
+	return "zip: invalid " + e.Container.String() + " container: " + strings.Join(e.Violations, "; ")
+}
+
+// SetContainer makes w write a container of kind c. For EPUB and ODF
+// it first writes the mimetype entry holding mediaType: stored,
+// unencrypted and without extra field or data descriptor. An empty
+// mediaType selects application/epub+zip for EPUB; ODF needs the media
+// type of the document, and OOXML, which has no mimetype entry, none.
+// The mimetype entry is not aligned, even after SetAlignment.
+// SetContainer must be called before any entry is added.
+//
+// Entries that break the rules of c are then refused with a
+// *ContainerError: a second mimetype entry, encrypted entries and
+// methods other than Store and Deflate. Close reports a missing
+// META-INF/container.xml (EPUB), META-INF/manifest.xml (ODF) or
+// [Content_Types].xml (OOXML) the same way, leaving w open so that the
+// entry can still be added.
+func (w *Writer) SetContainer(c Container, mediaType string) error {
+	if len(w.dir) > 0 {
+		return errors.New("zip: SetContainer called after entries were added")
+	}
+	switch {
+	case c == EPUB && mediaType == "":
+		mediaType = epubMediaType
+	case c == OOXML && mediaType != "":
+		return errors.New("zip: OOXML containers have no media type")
+	case c != EPUB && c != ODF && c != OOXML:
+		return fmt.Errorf("zip: unknown container %v", c)
+	}
+	if c.hasMimetype() {
+		if !c.validMediaType(mediaType) {
+			return &ContainerError{c, []string{"invalid media type " + mediaType}}
+		}
+		fh := &FileHeader{
+			Name:               mimetypeName,
+			Method:             Store,
+			CRC32:              crc32.ChecksumIEEE([]byte(mediaType)),
+			CompressedSize64:   uint64(len(mediaType)),
+			UncompressedSize64: uint64(len(mediaType)),
+		}
+		fh.SetAlignment(0) // the alignment padding is an extra field
+		fw, err := w.CreateRaw(fh)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(fw, mediaType); err != nil {
+			return err
+		}
+	}
+	w.container = c
+	return nil
+}
+
+// checkEntry refuses entries breaking the rules of the container.
+func (w *Writer) checkEntry(fh *FileHeader) error {
+	if w.container == 0 {
+		return nil
+	}
+	if v := w.container.checkEntry(fh); len(v) > 0 {
+		return &ContainerError{w.container, v}
+	}
+	return nil
+}
+
+// checkContainer reports a missing required entry before Close
+// finishes the archive.
+func (w *Writer) checkContainer() error {
+	if w.container == 0 {
+		return nil
+	}
+	name := w.container.required()
+	for _, h := range w.dir {
+		if h.Name == name {
+			return nil
+		}
+	}
+	return &ContainerError{w.container, []string{"missing " + name}}
+}
+
+// CheckContainer reports whether z follows the rules of container kind
+// c, returning a *ContainerError listing every violation: for EPUB and
+// ODF the archive must start with a stored, unencrypted mimetype entry
+// without extra field or data descriptor, holding a valid media type.
+// No entry may be encrypted or use methods other than Store and
+// Deflate, and each format requires one entry, as described for
+// Writer.SetContainer. Errors reading the archive are returned as is.
+func (z *Reader) CheckContainer(c Container) error {
+	if c != EPUB && c != ODF && c != OOXML {
+		return fmt.Errorf("zip: unknown container %v", c)
+	}
+	var v []string
+	files := z.File
+	if c.hasMimetype() {
+		if len(files) == 0 || files[0].Name != mimetypeName {
+			v = append(v, "first entry is not mimetype")
+		} else {
+			mv, err := checkMimetype(c, files[0])
+			if err != nil {
+				return err
+			}
+			v = append(v, mv...)
+			files = files[1:]
+		}
+	}
+	found := false
+	for _, f := range files {
+		v = append(v, c.checkEntry(&f.FileHeader)...)
+		if f.Name == c.required() {
+			found = true
+		}
+	}
+	if !found {
+		v = append(v, "missing "+c.required())
+	}
+	if len(v) > 0 {
+		return &ContainerError{c, v}
+	}
+	return nil
+}
+
+// checkMimetype returns how the mimetype entry f breaks the rules of c.
+func checkMimetype(c Container, f *File) ([]string, error) {
+	var v []string
+	if f.headerOffset != 0 {
+		v = append(v, "mimetype does not start the file")
+	}
+	if f.IsEncrypted() {
+		v = append(v, "mimetype is encrypted")
+	}
+	if f.Method != Store {
+		v = append(v, "mimetype is compressed")
+	}
+	if len(f.Extra) > 0 {
+		v = append(v, "mimetype has an extra field")
+	}
+	var buf [fileHeaderLen]byte
+	if _, err := f.zipr.ReadAt(buf[:], f.headerOffset); err != nil {
+		return nil, err
+	}
+	b := readBuf(buf[:])
+	if sig := b.uint32(); sig != fileHeaderSignature {
+		return nil, ErrFormat
+	}
+	b = b[2:] // skip version needed to extract
+	if b.uint16()&0x8 != 0 || f.hasDataDescriptor() {
+		v = append(v, "mimetype has a data descriptor")
+	}
+	b = b[20:] // skip to the extra field length
+	if b.uint16() != 0 && len(f.Extra) == 0 {
+		v = append(v, "mimetype has an extra field")
+	}
+	if len(v) > 0 {
+		return v, nil
+	}
+	if f.UncompressedSize64 > maxMediaTypeLen {
+		return append(v, "mimetype is too long"), nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	mediaType, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if !c.validMediaType(string(mediaType)) {
+		v = append(v, fmt.Sprintf("invalid media type %q", mediaType))
+	}
+	return v, nil
+}
@@ -9,9 +9,9 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
-	"crypto/rand"
 	"crypto/sha1"
 	"crypto/subtle"
+	"encoding/binary"
 	"errors"
 	"hash"
 	"io"
@@ -124,6 +124,20 @@ func (x *ctr) refill() {
 	x.outUsed = 0
 }
 
+// seek positions the key stream at byte off. Block i of the stream is
+// encrypted with counter i+1.
+func (x *ctr) seek(off int64) {
+	bs := int64(x.b.BlockSize())
+	clear(x.ctr)
+	binary.LittleEndian.PutUint64(x.ctr, uint64(off/bs)+1)
+	x.out = x.out[:0]
+	x.outUsed = 0
+	if skip := off % bs; skip > 0 {
+		buf := make([]byte, skip)
+		x.XORKeyStream(buf, buf)
+	}
+}
+
 func (x *ctr) XORKeyStream(dst, src []byte) {
 	for len(src) > 0 {
 		if x.outUsed >= len(x.out)-x.b.BlockSize() {
@@ -283,41 +297,76 @@ func generateKeys(password, salt []byte, keySize int) (encKey, authKey, pwv []by
 
 // newDecryptionReader returns an authenticated, decryption reader
 func newDecryptionReader(r *io.SectionReader, f *File) (io.Reader, error) {
+	decKey, authKey, data, err := aesKeys(r, f)
+	if err != nil {
+		return nil, err
+	}
+	authOff := r.Size() - 10
+	authcode := io.NewSectionReader(r, authOff, 10)
+	ar := newAuthReader(authKey, data, authcode, f.DeferAuth)
+	dr := decryptStream(decKey, ar)
+	if dr == nil {
+		return nil, ErrDecryption
+	}
+	return dr, nil
+}
+
+// aesKeys reads the salt and password verification value at the start
+// of r, the data of the AES encrypted f, checks the password and
+// returns the keys and the encrypted data.
+func aesKeys(r *io.SectionReader, f *File) (decKey, authKey []byte, data *io.SectionReader, err error) {
 	keyLen := aesKeyLen(f.aesStrength)
 	saltLen := keyLen / 2 // salt is half of key len
 	if saltLen == 0 {
-		return nil, ErrDecryption
+		return nil, nil, nil, ErrDecryption
 	}
 	// grab the salt and pwvv
 	saltpwvv := make([]byte, saltLen+2)
-	if _, err := r.Read(saltpwvv); err != nil {
-		return nil, err
+	if _, err := r.ReadAt(saltpwvv, 0); err != nil {
+		return nil, nil, nil, err
 	}
 	salt := saltpwvv[:saltLen]
 	pwvv := saltpwvv[saltLen : saltLen+2]
 	// generate keys only if we have a password
 	if f.password == nil {
-		return nil, ErrPassword
+		return nil, nil, nil, ErrPassword
 	}
 	decKey, authKey, pwv := generateKeys(f.password(), salt, keyLen)
 	if !checkPasswordVerification(pwv, pwvv) {
-		return nil, ErrPassword
+		return nil, nil, nil, ErrPassword
 	}
 	dataOff := int64(saltLen + 2)
 	dataLen := int64(f.CompressedSize64 - uint64(saltLen) - 2 - 10)
-	// // TODO(alex): Should the compressed sizes be fixed?
-	// // Not the ideal place to do this.
-	// f.CompressedSize64 = uint64(dataLen)
-	// f.CompressedSize = uint32(dataLen)
-	data := io.NewSectionReader(r, dataOff, dataLen)
-	authOff := dataOff + dataLen
-	authcode := io.NewSectionReader(r, authOff, 10)
-	ar := newAuthReader(authKey, data, authcode, f.DeferAuth)
-	dr := decryptStream(decKey, ar)
-	if dr == nil {
+	return decKey, authKey, io.NewSectionReader(r, dataOff, dataLen), nil
+}
+
+// newDecryptionReaderAt returns the decrypted data of the AES encrypted
+// f for random access. The authentication code is not checked.
+func newDecryptionReaderAt(r *io.SectionReader, f *File) (*io.SectionReader, error) {
+	decKey, _, data, err := aesKeys(r, f)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(decKey)
+	if err != nil {
 		return nil, ErrDecryption
 	}
-	return dr, nil
+	return io.NewSectionReader(&ctrReaderAt{r: data, b: block}, 0, data.Size()), nil
+}
+
+// ctrReaderAt decrypts r at any offset, positioning the counter at the
+// block holding it.
+type ctrReaderAt struct {
+	r io.ReaderAt
+	b cipher.Block
+}
+
+func (c *ctrReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	x := newWinZipCTR(c.b).(*ctr)
+	x.seek(off)
+	x.XORKeyStream(p[:n], p[:n])
+	return n, err
 }
 
 func decryptStream(key []byte, ciphertext io.Reader) io.Reader {
@@ -385,11 +434,12 @@ func encryptStream(key []byte, w io.Writer) (io.Writer, error) {
 
 // newEncryptionWriter returns an io.Writer that when written to, 1. writes
 // out the salt, 2. writes out pwv, and 3. writes out authenticated, encrypted
-// data. The authcode will be written out in fileWriter.close().
-func newEncryptionWriter(w io.Writer, password passwordFn, fw *fileWriter, aesstrength byte) (io.Writer, error) {
+// data. The authcode will be written out in fileWriter.close(). The salt
+// is read from rnd.
+func newEncryptionWriter(w io.Writer, password passwordFn, fw *fileWriter, aesstrength byte, rnd io.Reader) (io.Writer, error) {
 	keysize := aesKeyLen(aesstrength)
 	salt := make([]byte, keysize/2)
-	_, err := rand.Read(salt[:])
+	_, err := io.ReadFull(rnd, salt[:])
 	if err != nil {
 		return nil, errors.New("zip: unable to generate random salt")
 	}
@@ -424,16 +474,53 @@ func (h *FileHeader) isAE2() bool {
 	return h.ae == 2
 }
 
+// Encryption returns the encryption method used by the file, or 0 if
+// the file isn't encrypted. For files read from an archive the AES key
+// size is taken from the WinZip AES extra field.
+func (h *FileHeader) Encryption() EncryptionMethod {
+	if !h.IsEncrypted() {
+		return 0
+	}
+	if h.ae == 0 && h.aesStrength == 0 {
+		return StandardEncryption
+	}
+	switch h.aesStrength {
+	case 1:
+		return AES128Encryption
+	case 2:
+		return AES192Encryption
+	case 3:
+		return AES256Encryption
+	}
+	return h.encryption
+}
+
+// AESVersion returns the WinZip AES vendor version (1 for AE-1, 2 for
+// AE-2) of a file read from an archive, or 0 if it isn't AES encrypted.
+func (h *FileHeader) AESVersion() uint16 {
+	return h.ae
+}
+
+// IsAE2 reports whether the file is encrypted with WinZip AE-2, in which
+// case no CRC32 is stored and integrity is covered by the HMAC alone.
+func (h *FileHeader) IsAE2() bool {
+	return h.isAE2()
+}
+
 func (h *FileHeader) writeWinZipExtra() {
 	// total size is 11 bytes
 	var buf [11]byte
 	eb := writeBuf(buf[:])
 	eb.uint16(winzipAesExtraId) // 0x9901
 	eb.uint16(7)                // following data size is 7
-	eb.uint16(2)                // ae 2
-	eb.uint16(0x4541)           // "AE"
-	eb.uint8(h.aesStrength)     // aes256
-	eb.uint16(h.Method)         // original compression method
+	if h.ae == 1 {
+		eb.uint16(1) // ae 1, used when the CRC is kept
+	} else {
+		eb.uint16(2) // ae 2
+	}
+	eb.uint16(0x4541)       // "AE"
+	eb.uint8(h.aesStrength) // aes256
+	eb.uint16(h.Method)     // original compression method
 	h.Extra = append(h.Extra, buf[:]...)
 }
 
@@ -0,0 +1,221 @@
+package zip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HTTPOptions configures an HTTPReaderAt.
+type HTTPOptions struct {
+	// Client sends the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Header holds extra request headers, such as Authorization.
+	Header http.Header
+
+	// BlockSize is the unit of the requests and of the cache. If zero,
+	// 1 MiB is used.
+	BlockSize int64
+
+	// CacheBlocks is the number of blocks kept, least recently used
+	// first out. If zero, 64 are kept.
+	CacheBlocks int
+
+	// ReadAhead is the number of bytes at the end of the archive
+	// fetched with the first request, which usually covers the end of
+	// central directory record and the central directory. If zero,
+	// 1 MiB is used.
+	ReadAhead int64
+
+	// Concurrency is the number of requests in flight at a time. If
+	// zero, 4 is used.
+	Concurrency int
+}
+
+const (
+	defaultHTTPBlockSize   = 1 << 20
+	defaultHTTPCacheBlocks = 64
+	defaultHTTPReadAhead   = 1 << 20
+	defaultHTTPConcurrency = 4
+)
+
+// An HTTPReaderAt reads a remote file with HTTP Range requests, so that
+// a Reader can list and extract the entries of an archive kept on a web
+// server or in an object store without downloading all of it. Data is
+// fetched in blocks, cached as by a CachedReaderAt; a read missing
+// several adjacent blocks fetches them with a single request. If the
+// server reports an ETag, later requests require it to match, so that a
+// file replaced while being read fails rather than mixes versions.
+//
+// An HTTPReaderAt is safe for concurrent use.
+type HTTPReaderAt struct {
+	url  string
+	opts HTTPOptions
+	size int64
+	etag string
+	sem  chan struct{} // one per request in flight
+
+	tail    []byte // the end of the file, fetched first
+	tailOff int64
+	cache   *blockCache
+}
+
+// NewHTTPReaderAt returns an HTTPReaderAt reading url. It fetches the
+// last opts.ReadAhead bytes, learning the size of the file, and fails
+// if the server does not support Range requests. A nil opts uses the
+// zero HTTPOptions.
+func NewHTTPReaderAt(url string, opts *HTTPOptions) (*HTTPReaderAt, error) {
+	r := &HTTPReaderAt{url: url}
+	if opts != nil {
+		r.opts = *opts
+	}
+	if r.opts.Client == nil {
+		r.opts.Client = http.DefaultClient
+	}
+	if r.opts.BlockSize <= 0 {
+		r.opts.BlockSize = defaultHTTPBlockSize
+	}
+	if r.opts.CacheBlocks <= 0 {
+		r.opts.CacheBlocks = defaultHTTPCacheBlocks
+	}
+	if r.opts.ReadAhead <= 0 {
+		r.opts.ReadAhead = defaultHTTPReadAhead
+	}
+	if r.opts.Concurrency <= 0 {
+		r.opts.Concurrency = defaultHTTPConcurrency
+	}
+	r.sem = make(chan struct{}, r.opts.Concurrency)
+
+	tail, off, err := r.get(fmt.Sprintf("bytes=-%d", r.opts.ReadAhead), nil)
+	if err != nil {
+		return nil, err
+	}
+	r.tail, r.tailOff = tail, off
+	r.cache = newBlockCache(r.size, r.opts.BlockSize, r.opts.CacheBlocks, func(p []byte, off int64) error {
+		_, _, err := r.get(fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1), p)
+		return err
+	})
+	return r, nil
+}
+
+// OpenHTTPReader returns a Reader for the archive at url, read with an
+// HTTPReaderAt. The central directory is fetched with a single request
+// if the first one did not cover it.
+func OpenHTTPReader(url string, opts *HTTPOptions) (*Reader, error) {
+	ra, err := NewHTTPReaderAt(url, opts)
+	if err != nil {
+		return nil, err
+	}
+	end, err := readDirectoryEnd(ra, ra.size)
+	if err != nil {
+		return nil, err
+	}
+	if off, n := int64(end.directoryOffset), int64(end.directorySize); off < ra.tailOff && n > 0 && off+n <= ra.size {
+		// Leave half the cache to the entries.
+		n = min(n, ra.tailOff-off, ra.opts.BlockSize*int64(ra.opts.CacheBlocks)/2)
+		if _, err := ra.ReadAt(make([]byte, n), off); err != nil {
+			return nil, err
+		}
+	}
+	return NewReader(ra, ra.size)
+}
+
+// Size returns the size of the remote file.
+func (r *HTTPReaderAt) Size() int64 { return r.size }
+
+func (r *HTTPReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("zip: negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if off >= r.tailOff {
+		n := copy(p, r.tail[off-r.tailOff:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	return r.cache.readAt(p, off)
+}
+
+// get sends a request for rng and reads the body into p, returning it
+// and its offset. On the first request, p is nil: get allocates the
+// body and learns the size and ETag of the file.
+func (r *HTTPReaderAt) get(rng string, p []byte) ([]byte, int64, error) {
+	r.sem <- struct{}{}
+	defer func() { <-r.sem }()
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	for k, v := range r.opts.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Range", rng)
+	if r.etag != "" {
+		req.Header.Set("If-Match", r.etag)
+	}
+	resp, err := r.opts.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return nil, 0, fmt.Errorf("zip: %s: server does not support range requests", r.url)
+	case http.StatusPreconditionFailed:
+		return nil, 0, fmt.Errorf("zip: %s: file changed while reading", r.url)
+	default:
+		return nil, 0, fmt.Errorf("zip: %s: %s", r.url, resp.Status)
+	}
+	start, last, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok {
+		return nil, 0, fmt.Errorf("zip: %s: invalid Content-Range %q", r.url, resp.Header.Get("Content-Range"))
+	}
+	if p == nil {
+		r.size = size
+		r.etag = resp.Header.Get("ETag")
+		if strings.HasPrefix(r.etag, "W/") {
+			r.etag = "" // weak validators do not guard byte ranges
+		}
+		p = make([]byte, last-start+1)
+	} else if size != r.size || last-start+1 != int64(len(p)) {
+		return nil, 0, fmt.Errorf("zip: %s: unexpected Content-Range %q", r.url, resp.Header.Get("Content-Range"))
+	}
+	if _, err := io.ReadFull(resp.Body, p); err != nil {
+		return nil, 0, err
+	}
+	return p, start, nil
+}
+
+// parseContentRange parses the value of a Content-Range header of the
+// form "bytes first-last/size".
+func parseContentRange(s string) (first, last, size int64, ok bool) {
+	s, found := strings.CutPrefix(s, "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	rng, total, found := strings.Cut(s, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	a, b, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	var err1, err2, err3 error
+	first, err1 = strconv.ParseInt(a, 10, 64)
+	last, err2 = strconv.ParseInt(b, 10, 64)
+	size, err3 = strconv.ParseInt(total, 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || first < 0 || last < first || last >= size {
+		return 0, 0, 0, false
+	}
+	return first, last, size, true
+}
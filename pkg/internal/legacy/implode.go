@@ -0,0 +1,182 @@
+package legacy
+
+import (
+	"io"
+	"sort"
+)
+
+// Implode is LZ77 with a 4 or 8 KiB window and up to three Shannon-Fano
+// trees, for literals, copy lengths and the high six bits of copy
+// distances. The trees are stored as run-length coded bit lengths at
+// the start of the data.
+const (
+	implodeMaxBits = 16
+	implodeLenCode = 63 // length code followed by 8 more bits
+)
+
+type sfTree struct {
+	first [implodeMaxBits + 1]int   // code of syms[n][0]
+	syms  [implodeMaxBits + 1][]int // symbols of each length, by code
+}
+
+// init builds the code from the bit lengths of the symbols as APPNOTE
+// describes: symbols sorted by increasing length get decreasing codes,
+// so that the longest code is all zeros.
+func (t *sfTree) init(lengths []int) bool {
+	order := make([]int, len(lengths))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return lengths[order[i]] < lengths[order[j]] })
+	code, inc, last := 0, 0, 0
+	for i := len(order) - 1; i >= 0; i-- {
+		sym := order[i]
+		n := lengths[sym]
+		code += inc
+		if n != last {
+			last = n
+			inc = 1 << (implodeMaxBits - n)
+		}
+		if code+inc > 1<<implodeMaxBits {
+			return false
+		}
+		if len(t.syms[n]) == 0 {
+			t.first[n] = code >> (implodeMaxBits - n)
+		}
+		t.syms[n] = append(t.syms[n], sym)
+	}
+	return true
+}
+
+type exploder struct {
+	br       bitReader
+	large    bool // 8 KiB window
+	literal  bool // literals are coded with a tree
+	loaded   bool
+	litTree  sfTree
+	lenTree  sfTree
+	distTree sfTree
+}
+
+// NewImplodeReader returns a reader decompressing size bytes of
+// Implode (method 6) data from r. largeWindow and literalTree are
+// general purpose flag bits 1 and 2 of the entry.
+func NewImplodeReader(r io.Reader, size int64, largeWindow, literalTree bool) io.ReadCloser {
+	e := &exploder{br: newBitReader(r), large: largeWindow, literal: literalTree}
+	return newReader(e, size)
+}
+
+// readTree reads the bit lengths of n symbols: a byte holding the
+// number of bytes that follow minus one, each holding a count minus one
+// in its high and a bit length minus one in its low nibble.
+func (e *exploder) readTree(t *sfTree, n int) error {
+	c, err := e.br.readBits(8)
+	if err != nil {
+		return err
+	}
+	lengths := make([]int, 0, n)
+	for i := int(c) + 1; i > 0; i-- {
+		c, err := e.br.readBits(8)
+		if err != nil {
+			return err
+		}
+		count, length := int(c>>4)+1, int(c&0xf)+1
+		if len(lengths)+count > n {
+			return CorruptInputError("explode")
+		}
+		for ; count > 0; count-- {
+			lengths = append(lengths, length)
+		}
+	}
+	if len(lengths) != n || !t.init(lengths) {
+		return CorruptInputError("explode")
+	}
+	return nil
+}
+
+func (e *exploder) loadTrees() error {
+	if e.literal {
+		if err := e.readTree(&e.litTree, 256); err != nil {
+			return err
+		}
+	}
+	if err := e.readTree(&e.lenTree, 64); err != nil {
+		return err
+	}
+	return e.readTree(&e.distTree, 64)
+}
+
+// sym reads the next symbol coded with t. The stream holds the most
+// significant bit of each code first.
+func (e *exploder) sym(t *sfTree) (int, error) {
+	code := 0
+	for n := 1; n <= implodeMaxBits; n++ {
+		b, err := e.br.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | int(b)
+		if i := code - t.first[n]; i >= 0 && i < len(t.syms[n]) {
+			return t.syms[n][i], nil
+		}
+	}
+	return 0, CorruptInputError("explode")
+}
+
+func (e *exploder) decode(w *window) error {
+	if !e.loaded {
+		if err := e.loadTrees(); err != nil {
+			return err
+		}
+		e.loaded = true
+	}
+	literal, err := e.br.readBits(1)
+	if err != nil {
+		return err
+	}
+	if literal == 1 {
+		var c int
+		if e.literal {
+			c, err = e.sym(&e.litTree)
+		} else {
+			var b uint32
+			b, err = e.br.readBits(8)
+			c = int(b)
+		}
+		if err != nil {
+			return err
+		}
+		w.writeByte(byte(c))
+		return nil
+	}
+
+	lowBits := uint(6)
+	if e.large {
+		lowBits = 7
+	}
+	low, err := e.br.readBits(lowBits)
+	if err != nil {
+		return err
+	}
+	high, err := e.sym(&e.distTree)
+	if err != nil {
+		return err
+	}
+	length, err := e.sym(&e.lenTree)
+	if err != nil {
+		return err
+	}
+	if length == implodeLenCode {
+		more, err := e.br.readBits(8)
+		if err != nil {
+			return err
+		}
+		length += int(more)
+	}
+	length += 2
+	if e.literal {
+		length++
+	}
+	w.writeCopy(high<<lowBits+int(low)+1, length)
+	return nil
+}
@@ -0,0 +1,139 @@
+// Package legacy implements decoders for the compression methods of
+// PKZIP 1.x and earlier: Shrink (method 1), Reduce (methods 2 to 5) and
+// Implode (method 6), as described in section 5 of the PKWARE
+// APPNOTE.TXT. None of them marks the end of its data reliably, so each
+// decoder needs the uncompressed size from the file header.
+package legacy
+
+import (
+	"bufio"
+	"io"
+)
+
+// A CorruptInputError reports corrupt input to the named method.
+type CorruptInputError string
+
+func (e CorruptInputError) Error() string {
+	return string(e) + ": corrupt input"
+}
+
+// windowSize is the largest distance a copy may reach back, 8 KiB for
+// Implode and 4 KiB for Reduce.
+const windowSize = 1 << 13
+
+// A decoder decodes the next code of its stream into w, writing
+// nothing for codes that only change its state.
+type decoder interface {
+	decode(w *window) error
+}
+
+// window holds the history copies refer to and the decoded bytes not
+// yet returned by Read.
+type window struct {
+	hist [windowSize]byte
+	pos  int64 // bytes written so far
+	left int64 // bytes still to be written
+	out  []byte
+}
+
+func (w *window) writeByte(c byte) {
+	if w.left == 0 {
+		return
+	}
+	w.hist[w.pos&(windowSize-1)] = c
+	w.pos++
+	w.left--
+	w.out = append(w.out, c)
+}
+
+// writeCopy copies length bytes from dist bytes back; bytes before the
+// start of the output read as zero.
+func (w *window) writeCopy(dist, length int) {
+	for ; length > 0 && w.left > 0; length-- {
+		var c byte
+		if int64(dist) <= w.pos {
+			c = w.hist[(w.pos-int64(dist))&(windowSize-1)]
+		}
+		w.writeByte(c)
+	}
+}
+
+type reader struct {
+	dec decoder
+	w   window
+	rd  int // bytes of w.out already read
+	err error
+}
+
+func newReader(dec decoder, size int64) *reader {
+	r := &reader{dec: dec}
+	r.w.left = size
+	return r
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for r.rd == len(r.w.out) {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.rd = 0
+		r.w.out = r.w.out[:0]
+		if r.w.left == 0 {
+			r.err = io.EOF
+			continue
+		}
+		if err := r.dec.decode(&r.w); err != nil {
+			r.err = noEOF(err)
+		}
+	}
+	n := copy(p, r.w.out[r.rd:])
+	r.rd += n
+	return n, nil
+}
+
+func (r *reader) Close() error {
+	if r.err == io.EOF {
+		return nil
+	}
+	return r.err
+}
+
+// noEOF returns err, unless err == io.EOF, in which case it returns io.ErrUnexpectedEOF.
+func noEOF(e error) error {
+	if e == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return e
+}
+
+// bitReader reads the least significant bits of each byte first.
+type bitReader struct {
+	r  io.ByteReader
+	b  uint32
+	nb uint
+}
+
+func newBitReader(r io.Reader) bitReader {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return bitReader{r: br}
+}
+
+// readBits returns the next n bits, n <= 16, or io.EOF if the input
+// ends before them.
+func (br *bitReader) readBits(n uint) (uint32, error) {
+	for br.nb < n {
+		c, err := br.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		br.b |= uint32(c) << br.nb
+		br.nb += 8
+	}
+	v := br.b & (1<<n - 1)
+	br.b >>= n
+	br.nb -= n
+	return v, nil
+}
@@ -0,0 +1,127 @@
+package legacy
+
+import (
+	"io"
+	"math/bits"
+)
+
+// Reduce codes each byte using a follower set, the up to 32 bytes most
+// likely to follow the previous one, and then compresses the result
+// further with byte-oriented run copies escaped by DLE.
+const (
+	reduceDLE          = 144
+	reduceMaxFollowers = 32
+)
+
+type unreducer struct {
+	br        bitReader
+	factor    uint // compression factor, 1 to 4
+	followers [256][]byte
+	loaded    bool
+	last      byte // previous byte of the follower coded stream
+
+	state  int
+	v      uint32 // length and distance byte of the current copy
+	length int
+}
+
+// NewReduceReader returns a reader decompressing size bytes of data
+// reduced with the given compression factor, 1 to 4, from r. Methods 2
+// to 5 use compression factors 1 to 4.
+func NewReduceReader(r io.Reader, factor int, size int64) io.ReadCloser {
+	u := &unreducer{br: newBitReader(r), factor: uint(factor)}
+	return newReader(u, size)
+}
+
+func (u *unreducer) loadFollowers() error {
+	for i := 255; i >= 0; i-- {
+		n, err := u.br.readBits(6)
+		if err != nil {
+			return err
+		}
+		if n > reduceMaxFollowers {
+			return CorruptInputError("unreduce")
+		}
+		set := make([]byte, n)
+		for j := range set {
+			c, err := u.br.readBits(8)
+			if err != nil {
+				return err
+			}
+			set[j] = byte(c)
+		}
+		u.followers[i] = set
+	}
+	return nil
+}
+
+// next returns the next byte of the follower coded stream.
+func (u *unreducer) next() (byte, error) {
+	set := u.followers[u.last]
+	if len(set) > 0 {
+		literal, err := u.br.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		if literal == 0 {
+			i, err := u.br.readBits(uint(max(bits.Len(uint(len(set)-1)), 1)))
+			if err != nil {
+				return 0, err
+			}
+			if int(i) >= len(set) {
+				return 0, CorruptInputError("unreduce")
+			}
+			u.last = set[i]
+			return u.last, nil
+		}
+	}
+	c, err := u.br.readBits(8)
+	if err != nil {
+		return 0, err
+	}
+	u.last = byte(c)
+	return u.last, nil
+}
+
+func (u *unreducer) decode(w *window) error {
+	if !u.loaded {
+		if err := u.loadFollowers(); err != nil {
+			return err
+		}
+		u.loaded = true
+	}
+	c, err := u.next()
+	if err != nil {
+		return err
+	}
+	lengthMask := uint32(0x7f) >> (u.factor - 1)
+	switch u.state {
+	case 0:
+		if c == reduceDLE {
+			u.state = 1
+		} else {
+			w.writeByte(c)
+		}
+	case 1:
+		if c == 0 {
+			w.writeByte(reduceDLE)
+			u.state = 0
+			break
+		}
+		u.v = uint32(c)
+		u.length = int(u.v & lengthMask)
+		if u.v&lengthMask == lengthMask {
+			u.state = 2
+		} else {
+			u.state = 3
+		}
+	case 2:
+		u.length += int(c)
+		u.state = 3
+	case 3:
+		dist := int(u.v>>(8-u.factor))<<8 + int(c) + 1
+		w.writeCopy(dist, u.length+3)
+		u.state = 0
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package legacy
+
+import "io"
+
+// Shrink is LZW with codes growing from 9 to 13 bits. Code 256 escapes
+// a control code: 1 makes codes one bit longer, 2 frees every code no
+// other code extends (a partial clear). New strings take the lowest
+// free code.
+const (
+	shrinkMinBits = 9
+	shrinkMaxBits = 13
+	shrinkCodes   = 1 << shrinkMaxBits
+	shrinkControl = 256
+	shrinkFree    = -1
+)
+
+type unshrinker struct {
+	br       bitReader
+	codeBits uint
+	parent   [shrinkCodes]int16 // prefix code of each string, or shrinkFree
+	value    [shrinkCodes]byte  // last byte of each string
+	lastCode int                // last code assigned
+	prev     int                // previous string code, or -1
+	first    byte               // first byte of the previous string
+	stack    [shrinkCodes]byte
+}
+
+// NewShrinkReader returns a reader decompressing size bytes of Shrink
+// (method 1) data from r.
+func NewShrinkReader(r io.Reader, size int64) io.ReadCloser {
+	u := &unshrinker{
+		br:       newBitReader(r),
+		codeBits: shrinkMinBits,
+		lastCode: shrinkControl,
+		prev:     -1,
+	}
+	for c := shrinkControl + 1; c < shrinkCodes; c++ {
+		u.parent[c] = shrinkFree
+	}
+	return newReader(u, size)
+}
+
+func (u *unshrinker) decode(w *window) error {
+	c, err := u.br.readBits(u.codeBits)
+	if err != nil {
+		return err
+	}
+	code := int(c)
+	if code == shrinkControl {
+		c, err := u.br.readBits(u.codeBits)
+		if err != nil {
+			return noEOF(err)
+		}
+		switch {
+		case c == 1 && u.codeBits < shrinkMaxBits:
+			u.codeBits++
+		case c == 2:
+			u.partialClear()
+		default:
+			return CorruptInputError("unshrink")
+		}
+		return nil
+	}
+	if u.prev < 0 {
+		if code > 0xff {
+			return CorruptInputError("unshrink")
+		}
+		w.writeByte(byte(code))
+		u.prev, u.first = code, byte(code)
+		return nil
+	}
+
+	next := u.lastCode + 1
+	for next < shrinkCodes && u.parent[next] != shrinkFree {
+		next++
+	}
+	i := len(u.stack)
+	s := code
+	if code > 0xff && u.parent[code] == shrinkFree {
+		// the string about to get code: the previous one and its first byte
+		if code != next {
+			return CorruptInputError("unshrink")
+		}
+		i--
+		u.stack[i] = u.first
+		s = u.prev
+	}
+	for s > 0xff {
+		if i == 0 || u.parent[s] == shrinkFree {
+			return CorruptInputError("unshrink")
+		}
+		i--
+		u.stack[i] = u.value[s]
+		s = int(u.parent[s])
+	}
+	if i == 0 {
+		return CorruptInputError("unshrink")
+	}
+	i--
+	u.stack[i] = byte(s)
+	for _, b := range u.stack[i:] {
+		w.writeByte(b)
+	}
+
+	if next < shrinkCodes {
+		u.parent[next] = int16(u.prev)
+		u.value[next] = byte(s)
+		u.lastCode = next
+	}
+	u.prev, u.first = code, byte(s)
+	return nil
+}
+
+// partialClear frees the codes of all strings that are not the prefix
+// of another one.
+func (u *unshrinker) partialClear() {
+	var prefix [shrinkCodes]bool
+	for c := shrinkControl + 1; c < shrinkCodes; c++ {
+		if p := u.parent[c]; p > shrinkControl {
+			prefix[p] = true
+		}
+	}
+	for c := shrinkControl + 1; c < shrinkCodes; c++ {
+		if !prefix[c] {
+			u.parent[c] = shrinkFree
+		}
+	}
+	u.lastCode = shrinkControl
+}
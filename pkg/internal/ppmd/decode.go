@@ -0,0 +1,336 @@
+package ppmd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrMemoryLimit is returned for streams whose model needs more
+	// memory than the reader allows.
+	ErrMemoryLimit = errors.New("ppmd: model memory exceeds limit")
+
+	errCorrupt = errors.New("ppmd: corrupt input")
+)
+
+// MaxMemory is the most model memory the stream header can ask for.
+const MaxMemory = 256 << 20
+
+// The zip stream starts with a 16 bit little-endian header: the model
+// order minus one in bits 0-3, the memory size in MiB minus one in bits
+// 4-11 and the restore method in bits 12-15.
+const headerLen = 2
+
+type header struct {
+	order   int
+	memSize int
+	restore int
+}
+
+func parseHeader(b [headerLen]byte) (header, error) {
+	v := binary.LittleEndian.Uint16(b[:])
+	h := header{
+		order:   int(v&0xf) + 1,
+		memSize: (int(v>>4&0xff) + 1) << 20,
+		restore: int(v >> 12),
+	}
+	if h.order < minOrder {
+		return h, errCorrupt
+	}
+	switch h.restore {
+	case restoreRestart, restoreCutOff:
+	case 2:
+		return h, errors.New("ppmd: unsupported restore method freeze")
+	default:
+		return h, errCorrupt
+	}
+	return h, nil
+}
+
+const (
+	rangeTop = 1 << 24
+	rangeBot = 1 << 15
+)
+
+// rangeDecoder is the range decoder of Dmitry Subbotin used by var.I.
+type rangeDecoder struct {
+	r    io.ByteReader
+	low  uint32
+	rng  uint32
+	code uint32
+	err  error
+}
+
+func (rc *rangeDecoder) readByte() uint32 {
+	c, err := rc.r.ReadByte()
+	if err != nil && rc.err == nil {
+		rc.err = noEOF(err)
+	}
+	return uint32(c)
+}
+
+func (rc *rangeDecoder) init() error {
+	rc.low = 0
+	rc.rng = 0xFFFFFFFF
+	rc.code = 0
+	for i := 0; i < 4; i++ {
+		rc.code = rc.code<<8 | rc.readByte()
+	}
+	if rc.err == nil && rc.code == 0xFFFFFFFF {
+		return errCorrupt
+	}
+	return rc.err
+}
+
+func (rc *rangeDecoder) threshold(total uint32) uint32 {
+	if rc.rng /= total; rc.rng == 0 {
+		rc.rng = 1
+		if rc.err == nil {
+			rc.err = errCorrupt
+		}
+	}
+	return rc.code / rc.rng
+}
+
+func (rc *rangeDecoder) decode(start, size uint32) {
+	start *= rc.rng
+	rc.low += start
+	rc.code -= start
+	rc.rng *= size
+	for {
+		if rc.low^(rc.low+rc.rng) >= rangeTop {
+			if rc.rng >= rangeBot {
+				break
+			}
+			rc.rng = -rc.low & (rangeBot - 1)
+		}
+		rc.code = rc.code<<8 | rc.readByte()
+		rc.rng <<= 8
+		rc.low <<= 8
+	}
+}
+
+// Results of decodeSymbol other than a byte.
+const (
+	endMark = -1
+	badData = -2
+)
+
+type decoder struct {
+	*model
+	rc rangeDecoder
+}
+
+// decodeSymbol returns the next byte, endMark or badData.
+func (p *decoder) decodeSymbol() int {
+	var charMask [256]bool // masked symbols
+	rc := &p.rc
+	if ns := p.numStats(p.minContext); ns != 0 {
+		s := p.stats(p.minContext)
+		count := rc.threshold(p.summFreq(p.minContext))
+		hiCnt := p.freq(s)
+		if count < hiCnt {
+			rc.decode(0, p.freq(s))
+			p.foundState = s
+			sym := p.symbol(s)
+			p.update1_0()
+			return int(sym)
+		}
+		p.prevSuccess = 0
+		for i := ns; i > 0; i-- {
+			s += stateSize
+			if hiCnt += p.freq(s); hiCnt > count {
+				rc.decode(hiCnt-p.freq(s), p.freq(s))
+				p.foundState = s
+				sym := p.symbol(s)
+				p.update1()
+				return int(sym)
+			}
+		}
+		if count >= p.summFreq(p.minContext) {
+			return badData
+		}
+		rc.decode(hiCnt, p.summFreq(p.minContext)-hiCnt)
+		for i := ns + 1; i > 0; i-- {
+			charMask[p.symbol(s)] = true
+			s -= stateSize
+		}
+	} else {
+		prob := p.binProb(p.minContext)
+		rc.rng >>= 14
+		if rc.code/rc.rng < uint32(*prob) {
+			rc.decode(0, uint32(*prob))
+			*prob = updateProb0(*prob)
+			p.foundState = oneState(p.minContext)
+			sym := p.symbol(p.foundState)
+			p.updateBin()
+			return int(sym)
+		}
+		rc.decode(uint32(*prob), binScale-uint32(*prob))
+		*prob = updateProb1(*prob)
+		p.initEsc = uint32(expEscape[*prob>>10])
+		charMask[p.symbol(oneState(p.minContext))] = true
+		p.prevSuccess = 0
+	}
+
+	var ps [256]uint32
+	for {
+		numMasked := p.numStats(p.minContext)
+		for {
+			p.orderFall++
+			if p.suffix(p.minContext) == 0 {
+				return endMark
+			}
+			p.minContext = p.suffix(p.minContext)
+			if p.numStats(p.minContext) != numMasked {
+				break
+			}
+		}
+		var hiCnt uint32
+		s := p.stats(p.minContext)
+		num := p.numStats(p.minContext) - numMasked
+		i := uint32(0)
+		for ; i != num; s += stateSize {
+			if !charMask[p.symbol(s)] {
+				hiCnt += p.freq(s)
+				ps[i] = s
+				i++
+			}
+		}
+
+		see, freqSum := p.makeEscFreq(numMasked)
+		freqSum += hiCnt
+		count := rc.threshold(freqSum)
+		if count < hiCnt {
+			k := 0
+			hiCnt = p.freq(ps[0])
+			for hiCnt <= count {
+				k++
+				hiCnt += p.freq(ps[k])
+			}
+			s = ps[k]
+			rc.decode(hiCnt-p.freq(s), p.freq(s))
+			see.update()
+			p.foundState = s
+			sym := p.symbol(s)
+			p.update2()
+			return int(sym)
+		}
+		if count >= freqSum {
+			return badData
+		}
+		rc.decode(hiCnt, freqSum-hiCnt)
+		see.summ += uint16(freqSum)
+		for _, s := range ps[:i] {
+			charMask[p.symbol(s)] = true
+		}
+	}
+}
+
+func probMean(prob uint16) uint16 {
+	return (prob + 1<<(periodBits-2)) >> periodBits
+}
+
+func updateProb0(prob uint16) uint16 { return prob + 1<<intBits - probMean(prob) }
+func updateProb1(prob uint16) uint16 { return prob - probMean(prob) }
+
+type reader struct {
+	br     io.ByteReader
+	size   int64 // bytes left, or -1 to decode up to the end mark
+	maxMem int
+	dec    *decoder
+	err    error
+}
+
+// NewReader returns a reader decompressing PPMd data as stored in zip
+// files, header included, from r. It decodes size bytes, or up to the
+// end mark if size is negative. Streams that need more than maxMem bytes
+// of model memory fail with ErrMemoryLimit before any is allocated.
+func NewReader(r io.Reader, size int64, maxMem int) io.ReadCloser {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &reader{br: br, size: size, maxMem: maxMem}
+}
+
+func (r *reader) init() error {
+	var b [headerLen]byte
+	for i := range b {
+		c, err := r.br.ReadByte()
+		if err != nil {
+			return noEOF(err)
+		}
+		b[i] = c
+	}
+	h, err := parseHeader(b)
+	if err != nil {
+		return err
+	}
+	if h.memSize > r.maxMem {
+		return fmt.Errorf("%w: %d MiB needed", ErrMemoryLimit, h.memSize>>20)
+	}
+	r.dec = &decoder{model: newModel(h.order, h.restore, uint32(h.memSize))}
+	r.dec.rc.r = r.br
+	return r.dec.rc.init()
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.dec == nil {
+		if r.err = r.init(); r.err != nil {
+			return 0, r.err
+		}
+	}
+	n := 0
+	for ; n < len(b); n++ {
+		if r.size == 0 {
+			r.err = io.EOF
+			break
+		}
+		sym := r.dec.decodeSymbol()
+		if r.dec.rc.err != nil {
+			r.err = r.dec.rc.err
+			break
+		}
+		if sym < 0 {
+			switch {
+			case sym == endMark && r.size < 0:
+				r.err = io.EOF
+			case sym == endMark:
+				r.err = io.ErrUnexpectedEOF
+			default:
+				r.err = errCorrupt
+			}
+			break
+		}
+		b[n] = byte(sym)
+		if r.size > 0 {
+			r.size--
+		}
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, r.err
+}
+
+func (r *reader) Close() error {
+	if r.err == io.EOF {
+		return nil
+	}
+	return r.err
+}
+
+// noEOF returns err, unless err == io.EOF, in which case it returns io.ErrUnexpectedEOF.
+func noEOF(e error) error {
+	if e == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return e
+}
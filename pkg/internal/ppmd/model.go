@@ -0,0 +1,1012 @@
+// Package ppmd implements a decoder for PPMd variant I revision 1, the
+// compression method 98 of the zip format. The model is that of Dmitry
+// Shkarin's PPMd var.I and of the Ppmd8 code in 7-Zip, which writes most
+// PPMd zips; the restore methods "restart" and "cut off" are supported.
+//
+// The model keeps its contexts, statistics and text in one block of
+// memory addressed by offsets, laid out exactly as in the reference
+// code: how the model reacts to that memory running out is part of the
+// format.
+package ppmd
+
+import "encoding/binary"
+
+const (
+	minOrder = 2
+	maxOrder = 16
+
+	restoreRestart = 0
+	restoreCutOff  = 1
+
+	maxFreq    = 124
+	unitSize   = 12
+	intBits    = 7
+	periodBits = 7
+	binScale   = 1 << (intBits + periodBits)
+	numIndexes = 4 + 4 + 4 + 26
+	emptyNode  = 0xFFFFFFFF
+)
+
+var expEscape = [16]byte{25, 14, 9, 7, 5, 5, 4, 4, 4, 3, 3, 3, 2, 2, 2, 2}
+
+var initBinEsc = [8]uint16{0x3CDD, 0x1F3F, 0x59BF, 0x48F3, 0x64A1, 0x5ABC, 0x6632, 0x6051}
+
+// see is a secondary escape estimation context.
+type see struct {
+	summ  uint16
+	shift byte
+	count byte
+}
+
+func (s *see) mean() uint32 {
+	r := uint32(s.summ >> s.shift)
+	s.summ -= uint16(r)
+	if r == 0 {
+		return 1
+	}
+	return r
+}
+
+func (s *see) update() {
+	if s.shift < periodBits {
+		if s.count--; s.count == 0 {
+			s.summ <<= 1
+			s.count = byte(3 << s.shift)
+			s.shift++
+		}
+	}
+}
+
+// A state is 6 bytes: symbol, frequency and successor. A context is 12:
+// number of symbols minus one, flags, frequency sum, statistics and
+// suffix; a context of one symbol keeps its state in place of the
+// frequency sum and statistics. Free blocks of units are nodes: stamp,
+// next free block and size in units.
+const stateSize = 6
+
+type model struct {
+	mem         []byte // offsets into mem are the references of the reference code
+	size        uint32
+	alignOffset uint32
+	text        uint32
+	unitsStart  uint32
+	loUnit      uint32
+	hiUnit      uint32
+	glueCount   uint32
+
+	indx2Units [numIndexes]byte
+	units2Indx [128]byte
+	freeList   [numIndexes]uint32
+	stamps     [numIndexes]uint32
+
+	ns2BSIndx [256]byte
+	ns2Indx   [260]byte
+	dummySee  see
+	see       [24][32]see
+	binSumm   [25][64]uint16
+
+	minContext  uint32
+	maxContext  uint32
+	foundState  uint32
+	orderFall   uint32
+	initEsc     uint32
+	prevSuccess uint32
+	maxOrder    uint32
+	runLength   int32
+	initRL      int32
+	restore     int
+}
+
+func newModel(order, restore int, size uint32) *model {
+	p := &model{size: size, maxOrder: uint32(order), restore: restore}
+	k := 0
+	for i := 0; i < numIndexes; i++ {
+		step := 4
+		if i < 12 {
+			step = i>>2 + 1
+		}
+		for ; step > 0; step-- {
+			p.units2Indx[k] = byte(i)
+			k++
+		}
+		p.indx2Units[i] = byte(k)
+	}
+	p.ns2BSIndx[0] = 0 << 1
+	p.ns2BSIndx[1] = 1 << 1
+	for i := 2; i < 11; i++ {
+		p.ns2BSIndx[i] = 2 << 1
+	}
+	for i := 11; i < 256; i++ {
+		p.ns2BSIndx[i] = 3 << 1
+	}
+	for i := 0; i < 5; i++ {
+		p.ns2Indx[i] = byte(i)
+	}
+	for i, m, k := 5, 5, 1; i < 260; i++ {
+		p.ns2Indx[i] = byte(m)
+		if k--; k == 0 {
+			m++
+			k = m - 4
+		}
+	}
+	p.alignOffset = 4 - size&3
+	// one more unit keeps the guard read past the last block in bounds
+	p.mem = make([]byte, p.alignOffset+size+unitSize)
+	p.restartModel()
+	p.dummySee.shift = periodBits
+	p.dummySee.count = 64
+	return p
+}
+
+// Field accessors. c is a context, s a state and n a node.
+
+func (p *model) u16(off uint32) uint16       { return binary.LittleEndian.Uint16(p.mem[off:]) }
+func (p *model) setU16(off uint32, v uint16) { binary.LittleEndian.PutUint16(p.mem[off:], v) }
+func (p *model) u32(off uint32) uint32       { return binary.LittleEndian.Uint32(p.mem[off:]) }
+func (p *model) setU32(off uint32, v uint32) { binary.LittleEndian.PutUint32(p.mem[off:], v) }
+
+func (p *model) numStats(c uint32) uint32     { return uint32(p.mem[c]) }
+func (p *model) setNumStats(c, v uint32)      { p.mem[c] = byte(v) }
+func (p *model) flags(c uint32) uint32        { return uint32(p.mem[c+1]) }
+func (p *model) setFlags(c, v uint32)         { p.mem[c+1] = byte(v) }
+func (p *model) summFreq(c uint32) uint32     { return uint32(p.u16(c + 2)) }
+func (p *model) setSummFreq(c, v uint32)      { p.setU16(c+2, uint16(v)) }
+func (p *model) stats(c uint32) uint32        { return p.u32(c + 4) }
+func (p *model) setStats(c, s uint32)         { p.setU32(c+4, s) }
+func (p *model) suffix(c uint32) uint32       { return p.u32(c + 8) }
+func (p *model) setSuffix(c, v uint32)        { p.setU32(c+8, v) }
+func oneState(c uint32) uint32                { return c + 2 }
+func (p *model) symbol(s uint32) uint32       { return uint32(p.mem[s]) }
+func (p *model) freq(s uint32) uint32         { return uint32(p.mem[s+1]) }
+func (p *model) setFreq(s, v uint32)          { p.mem[s+1] = byte(v) }
+func (p *model) successor(s uint32) uint32    { return p.u32(s + 2) }
+func (p *model) setSuccessor(s, v uint32)     { p.setU32(s+2, v) }
+func (p *model) copyState(dst, src uint32)    { copy(p.mem[dst:dst+stateSize], p.mem[src:src+stateSize]) }
+func (p *model) stamp(n uint32) uint32        { return p.u32(n) }
+func (p *model) setStamp(n, v uint32)         { p.setU32(n, v) }
+func (p *model) next(n uint32) uint32         { return p.u32(n + 4) }
+func (p *model) setNext(n, v uint32)          { p.setU32(n+4, v) }
+func (p *model) nu(n uint32) uint32           { return p.u32(n + 8) }
+func (p *model) setNU(n, v uint32)            { p.setU32(n+8, v) }
+func (p *model) i2u(indx uint32) uint32       { return uint32(p.indx2Units[indx]) }
+func (p *model) u2i(nu uint32) uint32         { return uint32(p.units2Indx[nu-1]) }
+func u2b(nu uint32) uint32                    { return nu * unitSize }
+func (p *model) state(stats, i uint32) uint32 { return stats + i*stateSize }
+func (p *model) hiBit(s uint32) uint32        { return b2u(p.symbol(s) >= 0x40) }
+func (p *model) swapStates(s1, s2 uint32) {
+	var tmp [stateSize]byte
+	copy(tmp[:], p.mem[s1:s1+stateSize])
+	p.copyState(s1, s2)
+	copy(p.mem[s2:s2+stateSize], tmp[:])
+}
+
+func b2u(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Memory allocation.
+
+func (p *model) insertNode(n, indx uint32) {
+	p.setStamp(n, emptyNode)
+	p.setNext(n, p.freeList[indx])
+	p.setNU(n, p.i2u(indx))
+	p.freeList[indx] = n
+	p.stamps[indx]++
+}
+
+func (p *model) removeNode(indx uint32) uint32 {
+	n := p.freeList[indx]
+	p.freeList[indx] = p.next(n)
+	p.stamps[indx]--
+	return n
+}
+
+func (p *model) splitBlock(ptr, oldIndx, newIndx uint32) {
+	nu := p.i2u(oldIndx) - p.i2u(newIndx)
+	ptr += u2b(p.i2u(newIndx))
+	i := p.u2i(nu)
+	if p.i2u(i) != nu {
+		i--
+		k := p.i2u(i)
+		p.insertNode(ptr+u2b(k), nu-k-1)
+	}
+	p.insertNode(ptr, i)
+}
+
+func (p *model) glueFreeBlocks() {
+	var head uint32
+	prev := func(v uint32) { head = v }
+	p.glueCount = 1 << 13
+	p.stamps = [numIndexes]uint32{}
+	if p.loUnit != p.hiUnit {
+		p.setStamp(p.loUnit, 0)
+	}
+
+	// glue free blocks
+	for i := range p.freeList {
+		next := p.freeList[i]
+		p.freeList[i] = 0
+		for next != 0 {
+			n := next
+			if p.nu(n) != 0 {
+				prev(n)
+				prev = func(v uint32) { p.setNext(n, v) }
+				for {
+					n2 := n + u2b(p.nu(n))
+					if p.stamp(n2) != emptyNode {
+						break
+					}
+					p.setNU(n, p.nu(n)+p.nu(n2))
+					p.setNU(n2, 0)
+				}
+			}
+			next = p.next(n)
+		}
+	}
+	prev(0)
+
+	// fill lists of free blocks
+	for head != 0 {
+		n := head
+		head = p.next(n)
+		nu := p.nu(n)
+		if nu == 0 {
+			continue
+		}
+		for ; nu > 128; nu, n = nu-128, n+u2b(128) {
+			p.insertNode(n, numIndexes-1)
+		}
+		i := p.u2i(nu)
+		if p.i2u(i) != nu {
+			i--
+			k := p.i2u(i)
+			p.insertNode(n+u2b(k), nu-k-1)
+		}
+		p.insertNode(n, i)
+	}
+}
+
+// allocUnitsRare returns 0 if memory has run out.
+func (p *model) allocUnitsRare(indx uint32) uint32 {
+	if p.glueCount == 0 {
+		p.glueFreeBlocks()
+		if p.freeList[indx] != 0 {
+			return p.removeNode(indx)
+		}
+	}
+	i := indx
+	for {
+		if i++; i == numIndexes {
+			numBytes := u2b(p.i2u(indx))
+			p.glueCount--
+			if p.unitsStart-p.text > numBytes {
+				p.unitsStart -= numBytes
+				return p.unitsStart
+			}
+			return 0
+		}
+		if p.freeList[i] != 0 {
+			break
+		}
+	}
+	r := p.removeNode(i)
+	p.splitBlock(r, i, indx)
+	return r
+}
+
+func (p *model) allocUnits(indx uint32) uint32 {
+	if p.freeList[indx] != 0 {
+		return p.removeNode(indx)
+	}
+	numBytes := u2b(p.i2u(indx))
+	if numBytes <= p.hiUnit-p.loUnit {
+		r := p.loUnit
+		p.loUnit += numBytes
+		return r
+	}
+	return p.allocUnitsRare(indx)
+}
+
+func (p *model) allocContext() uint32 {
+	if p.hiUnit != p.loUnit {
+		p.hiUnit -= unitSize
+		return p.hiUnit
+	}
+	if p.freeList[0] != 0 {
+		return p.removeNode(0)
+	}
+	return p.allocUnitsRare(0)
+}
+
+func (p *model) copyUnits(dst, src, nu uint32) {
+	copy(p.mem[dst:dst+u2b(nu)], p.mem[src:src+u2b(nu)])
+}
+
+func (p *model) shrinkUnits(oldPtr, oldNU, newNU uint32) uint32 {
+	i0 := p.u2i(oldNU)
+	i1 := p.u2i(newNU)
+	if i0 == i1 {
+		return oldPtr
+	}
+	if p.freeList[i1] != 0 {
+		ptr := p.removeNode(i1)
+		p.copyUnits(ptr, oldPtr, newNU)
+		p.insertNode(oldPtr, i0)
+		return ptr
+	}
+	p.splitBlock(oldPtr, i0, i1)
+	return oldPtr
+}
+
+func (p *model) freeUnits(ptr, nu uint32) {
+	p.insertNode(ptr, p.u2i(nu))
+}
+
+func (p *model) specialFreeUnit(ptr uint32) {
+	if ptr != p.unitsStart {
+		p.insertNode(ptr, 0)
+	} else {
+		p.unitsStart += unitSize
+	}
+}
+
+func (p *model) moveUnitsUp(oldPtr, nu uint32) uint32 {
+	indx := p.u2i(nu)
+	if oldPtr > p.unitsStart+16*1024 || oldPtr > p.freeList[indx] {
+		return oldPtr
+	}
+	ptr := p.removeNode(indx)
+	p.copyUnits(ptr, oldPtr, nu)
+	if oldPtr != p.unitsStart {
+		p.insertNode(oldPtr, indx)
+	} else {
+		p.unitsStart += u2b(p.i2u(indx))
+	}
+	return ptr
+}
+
+func (p *model) expandTextArea() {
+	var count [numIndexes]uint32
+	if p.loUnit != p.hiUnit {
+		p.setStamp(p.loUnit, 0)
+	}
+	n := p.unitsStart
+	for ; p.stamp(n) == emptyNode; n += u2b(p.nu(n)) {
+		p.setStamp(n, 0)
+		count[p.u2i(p.nu(n))]++
+	}
+	p.unitsStart = n
+
+	for i := range p.freeList {
+		// next is the free list head, or the node whose Next field links on
+		next := func() uint32 { return p.freeList[i] }
+		setNext := func(v uint32) { p.freeList[i] = v }
+		for count[i] != 0 {
+			n := next()
+			for p.stamp(n) == 0 {
+				setNext(p.next(n))
+				n = next()
+				p.stamps[i]--
+				if count[i]--; count[i] == 0 {
+					break
+				}
+			}
+			node := n
+			next = func() uint32 { return p.next(node) }
+			setNext = func(v uint32) { p.setNext(node, v) }
+		}
+	}
+}
+
+// Model.
+
+func (p *model) restartModel() {
+	p.freeList = [numIndexes]uint32{}
+	p.stamps = [numIndexes]uint32{}
+	p.text = p.alignOffset
+	p.hiUnit = p.text + p.size
+	p.loUnit = p.hiUnit - p.size/8/unitSize*7*unitSize
+	p.unitsStart = p.loUnit
+	p.glueCount = 0
+
+	p.orderFall = p.maxOrder
+	p.initRL = -int32(min(p.maxOrder, 12)) - 1
+	p.runLength = p.initRL
+	p.prevSuccess = 0
+
+	p.hiUnit -= unitSize
+	c := p.hiUnit
+	p.minContext, p.maxContext = c, c
+	p.setSuffix(c, 0)
+	p.setNumStats(c, 255)
+	p.setFlags(c, 0)
+	p.setSummFreq(c, 256+1)
+	p.foundState = p.loUnit
+	p.setStats(c, p.loUnit)
+	for i := uint32(0); i < 256; i++ {
+		s := p.state(p.loUnit, i)
+		p.mem[s] = byte(i)
+		p.setFreq(s, 1)
+		p.setSuccessor(s, 0)
+	}
+	p.loUnit += u2b(256 / 2)
+
+	i := 0
+	for m := range p.binSumm {
+		for int(p.ns2Indx[i]) == m {
+			i++
+		}
+		for k := 0; k < 8; k++ {
+			val := uint16(binScale - uint32(initBinEsc[k])/uint32(i+1))
+			for r := 0; r < 64; r += 8 {
+				p.binSumm[m][k+r] = val
+			}
+		}
+	}
+	i = 0
+	for m := range p.see {
+		for int(p.ns2Indx[i+3]) == m+3 {
+			i++
+		}
+		for k := range p.see[m] {
+			p.see[m][k] = see{summ: uint16((2*i + 5) << (periodBits - 4)), shift: periodBits - 4, count: 7}
+		}
+	}
+}
+
+func (p *model) refresh(c, oldNU, scale uint32) {
+	i := p.numStats(c)
+	s := p.shrinkUnits(p.stats(c), oldNU, (i+2)>>1)
+	p.setStats(c, s)
+	flags := p.flags(c)&(0x10+0x04*scale) + 0x08*p.hiBit(s)
+	escFreq := p.summFreq(c) - p.freq(s)
+	p.setFreq(s, (p.freq(s)+scale)>>scale)
+	sumFreq := p.freq(s)
+	for ; i > 0; i-- {
+		s += stateSize
+		escFreq -= p.freq(s)
+		p.setFreq(s, (p.freq(s)+scale)>>scale)
+		sumFreq += p.freq(s)
+		flags |= 0x08 * p.hiBit(s)
+	}
+	p.setSummFreq(c, sumFreq+(escFreq+scale)>>scale)
+	p.setFlags(c, flags)
+}
+
+// cutOff removes the states whose successors point into the text from
+// the contexts of order at least order below c, returning c or 0 if c
+// was removed itself.
+func (p *model) cutOff(c, order uint32) uint32 {
+	if p.numStats(c) == 0 {
+		s := oneState(c)
+		if p.successor(s) >= p.unitsStart {
+			if order < p.maxOrder {
+				p.setSuccessor(s, p.cutOff(p.successor(s), order+1))
+			} else {
+				p.setSuccessor(s, 0)
+			}
+			if p.successor(s) != 0 || order <= 9 {
+				return c
+			}
+		}
+		p.specialFreeUnit(c)
+		return 0
+	}
+
+	tmp := (p.numStats(c) + 2) >> 1
+	p.setStats(c, p.moveUnitsUp(p.stats(c), tmp))
+	stats := p.stats(c)
+	i := int(p.numStats(c))
+	for s := p.state(stats, uint32(i)); s >= stats; s -= stateSize {
+		if p.successor(s) < p.unitsStart {
+			s2 := p.state(stats, uint32(i))
+			i--
+			p.setSuccessor(s, 0)
+			p.swapStates(s, s2)
+		} else if order < p.maxOrder {
+			p.setSuccessor(s, p.cutOff(p.successor(s), order+1))
+		} else {
+			p.setSuccessor(s, 0)
+		}
+		if s == stats {
+			break
+		}
+	}
+
+	if i != int(p.numStats(c)) && order != 0 {
+		p.setNumStats(c, uint32(i))
+		s := stats
+		if i < 0 {
+			p.freeUnits(s, tmp)
+			p.specialFreeUnit(c)
+			return 0
+		}
+		if i == 0 {
+			p.setFlags(c, p.flags(c)&0x10+0x08*p.hiBit(s))
+			p.copyState(oneState(c), s)
+			p.freeUnits(s, tmp)
+			p.setFreq(oneState(c), (p.freq(oneState(c))+11)>>3)
+		} else {
+			p.refresh(c, tmp, b2u(p.summFreq(c) > 16*uint32(i)))
+		}
+	}
+	return c
+}
+
+func (p *model) getUsedMemory() uint32 {
+	var v uint32
+	for i := range p.stamps {
+		v += p.stamps[i] * p.i2u(uint32(i))
+	}
+	return p.size - (p.hiUnit - p.loUnit) - (p.unitsStart - p.text) - u2b(v)
+}
+
+// restoreModel recovers from running out of memory. The contexts from
+// maxContext down to c1 have just been given a new symbol, which is
+// taken back.
+func (p *model) restoreModel(c1 uint32) {
+	p.text = p.alignOffset
+	c := p.maxContext
+	for ; c != c1; c = p.suffix(c) {
+		p.setNumStats(c, p.numStats(c)-1)
+		if p.numStats(c) == 0 {
+			s := p.stats(c)
+			p.setFlags(c, p.flags(c)&0x10+0x08*p.hiBit(s))
+			p.copyState(oneState(c), s)
+			p.specialFreeUnit(s)
+			p.setFreq(oneState(c), (p.freq(oneState(c))+11)>>3)
+		} else {
+			p.refresh(c, (p.numStats(c)+3)>>1, 0)
+		}
+	}
+	for ; c != p.minContext; c = p.suffix(c) {
+		if p.numStats(c) == 0 {
+			s := oneState(c)
+			p.setFreq(s, p.freq(s)-p.freq(s)>>1)
+		} else {
+			p.setSummFreq(c, p.summFreq(c)+4)
+			if p.summFreq(c) > 128+4*p.numStats(c) {
+				p.refresh(c, (p.numStats(c)+2)>>1, 1)
+			}
+		}
+	}
+
+	if p.restore == restoreRestart || p.getUsedMemory() < p.size>>1 {
+		p.restartModel()
+		return
+	}
+	for p.suffix(p.maxContext) != 0 {
+		p.maxContext = p.suffix(p.maxContext)
+	}
+	for {
+		p.cutOff(p.maxContext, 0)
+		p.expandTextArea()
+		if p.getUsedMemory() <= 3*(p.size>>2) {
+			break
+		}
+	}
+	p.glueCount = 0
+	p.orderFall = p.maxOrder
+}
+
+// createSuccessors returns the context following the found state in
+// c, creating the missing contexts along the suffix chain, or 0 if
+// memory ran out.
+func (p *model) createSuccessors(skip bool, s1, c uint32) uint32 {
+	upBranch := p.successor(p.foundState)
+	var ps [maxOrder + 1]uint32
+	numPs := 0
+	if !skip {
+		ps[numPs] = p.foundState
+		numPs++
+	}
+	fSymbol := p.symbol(p.foundState)
+	for p.suffix(c) != 0 {
+		var s uint32
+		c = p.suffix(c)
+		if s1 != 0 {
+			s = s1
+			s1 = 0
+		} else if p.numStats(c) != 0 {
+			for s = p.stats(c); p.symbol(s) != fSymbol; s += stateSize {
+			}
+			if p.freq(s) < maxFreq-9 {
+				p.setFreq(s, p.freq(s)+1)
+				p.setSummFreq(c, p.summFreq(c)+1)
+			}
+		} else {
+			s = oneState(c)
+			p.setFreq(s, p.freq(s)+b2u(p.numStats(p.suffix(c)) == 0 && p.freq(s) < 24))
+		}
+		successor := p.successor(s)
+		if successor != upBranch {
+			c = successor
+			if numPs == 0 {
+				return c
+			}
+			break
+		}
+		ps[numPs] = s
+		numPs++
+	}
+
+	upSymbol := uint32(p.mem[upBranch])
+	upSuccessor := upBranch + 1
+	flags := 0x10*p.hiBit(p.foundState) + 0x08*b2u(upSymbol >= 0x40)
+	var upFreq uint32
+	if p.numStats(c) == 0 {
+		upFreq = p.freq(oneState(c))
+	} else {
+		s := p.stats(c)
+		for ; p.symbol(s) != upSymbol; s += stateSize {
+		}
+		cf := p.freq(s) - 1
+		s0 := p.summFreq(c) - p.numStats(c) - cf
+		if 2*cf <= s0 {
+			upFreq = 1 + b2u(5*cf > s0)
+		} else {
+			upFreq = 1 + (cf+2*s0-3)/s0
+		}
+	}
+
+	for numPs != 0 {
+		c1 := p.allocContext()
+		if c1 == 0 {
+			return 0
+		}
+		p.setNumStats(c1, 0)
+		p.setFlags(c1, flags)
+		s := oneState(c1)
+		p.mem[s] = byte(upSymbol)
+		p.setFreq(s, upFreq)
+		p.setSuccessor(s, upSuccessor)
+		p.setSuffix(c1, c)
+		numPs--
+		p.setSuccessor(ps[numPs], c1)
+		c = c1
+	}
+	return c
+}
+
+// reduceOrder is createSuccessors for a found state without successor.
+func (p *model) reduceOrder(s1, c uint32) uint32 {
+	var s uint32
+	c1 := c
+	upBranch := p.text
+	fSymbol := p.symbol(p.foundState)
+
+	p.setSuccessor(p.foundState, upBranch)
+	p.orderFall++
+
+	for {
+		if s1 != 0 {
+			c = p.suffix(c)
+			s = s1
+			s1 = 0
+		} else {
+			if p.suffix(c) == 0 {
+				return c
+			}
+			c = p.suffix(c)
+			if p.numStats(c) != 0 {
+				for s = p.stats(c); p.symbol(s) != fSymbol; s += stateSize {
+				}
+				if p.freq(s) < maxFreq-9 {
+					p.setFreq(s, p.freq(s)+2)
+					p.setSummFreq(c, p.summFreq(c)+2)
+				}
+			} else {
+				s = oneState(c)
+				p.setFreq(s, p.freq(s)+b2u(p.freq(s) < 32))
+			}
+		}
+		if p.successor(s) != 0 {
+			break
+		}
+		p.setSuccessor(s, upBranch)
+		p.orderFall++
+	}
+
+	if p.successor(s) <= upBranch {
+		s2 := p.foundState
+		p.foundState = s
+		p.setSuccessor(s, p.createSuccessors(false, 0, c))
+		p.foundState = s2
+	}
+	if p.orderFall == 1 && c1 == p.maxContext {
+		p.setSuccessor(p.foundState, p.successor(s))
+		p.text--
+	}
+	return p.successor(s)
+}
+
+func (p *model) updateModel() {
+	fs := p.foundState
+	fSuccessor := p.successor(fs)
+	fFreq := p.freq(fs)
+	fSymbol := p.symbol(fs)
+	var s uint32
+
+	if fFreq < maxFreq/4 && p.suffix(p.minContext) != 0 {
+		c := p.suffix(p.minContext)
+		if p.numStats(c) == 0 {
+			s = oneState(c)
+			if p.freq(s) < 32 {
+				p.setFreq(s, p.freq(s)+1)
+			}
+		} else {
+			s = p.stats(c)
+			if p.symbol(s) != fSymbol {
+				for s += stateSize; p.symbol(s) != fSymbol; s += stateSize {
+				}
+				if p.freq(s) >= p.freq(s-stateSize) {
+					p.swapStates(s, s-stateSize)
+					s -= stateSize
+				}
+			}
+			if p.freq(s) < maxFreq-9 {
+				p.setFreq(s, p.freq(s)+2)
+				p.setSummFreq(c, p.summFreq(c)+2)
+			}
+		}
+	}
+
+	c := p.maxContext
+	if p.orderFall == 0 && fSuccessor != 0 {
+		cs := p.createSuccessors(true, s, p.minContext)
+		p.setSuccessor(p.foundState, cs)
+		if cs == 0 {
+			p.restoreModel(c)
+		} else {
+			p.maxContext = cs
+		}
+		return
+	}
+
+	p.mem[p.text] = byte(fSymbol)
+	p.text++
+	successor := p.text
+	if p.text >= p.unitsStart {
+		p.restoreModel(c)
+		return
+	}
+
+	if fSuccessor == 0 {
+		cs := p.reduceOrder(s, p.minContext)
+		if cs == 0 {
+			p.restoreModel(c)
+			return
+		}
+		fSuccessor = cs
+	} else if fSuccessor < p.unitsStart {
+		cs := p.createSuccessors(false, s, p.minContext)
+		if cs == 0 {
+			p.restoreModel(c)
+			return
+		}
+		fSuccessor = cs
+	}
+
+	if p.orderFall--; p.orderFall == 0 {
+		successor = fSuccessor
+		if p.maxContext != p.minContext {
+			p.text--
+		}
+	}
+
+	ns := p.numStats(p.minContext)
+	s0 := p.summFreq(p.minContext) - ns - fFreq
+	flag := 0x08 * b2u(fSymbol >= 0x40)
+
+	for ; c != p.minContext; c = p.suffix(c) {
+		ns1 := p.numStats(c)
+		if ns1 != 0 {
+			if ns1&1 != 0 {
+				// expand for one unit
+				oldNU := (ns1 + 1) >> 1
+				i := p.u2i(oldNU)
+				if i != p.u2i(oldNU+1) {
+					ptr := p.allocUnits(i + 1)
+					if ptr == 0 {
+						p.restoreModel(c)
+						return
+					}
+					oldPtr := p.stats(c)
+					p.copyUnits(ptr, oldPtr, oldNU)
+					p.insertNode(oldPtr, i)
+					p.setStats(c, ptr)
+				}
+			}
+			p.setSummFreq(c, p.summFreq(c)+b2u(3*ns1+1 < ns))
+		} else {
+			s2 := p.allocUnits(0)
+			if s2 == 0 {
+				p.restoreModel(c)
+				return
+			}
+			p.copyState(s2, oneState(c))
+			p.setStats(c, s2)
+			if p.freq(s2) < maxFreq/4-1 {
+				p.setFreq(s2, p.freq(s2)<<1)
+			} else {
+				p.setFreq(s2, maxFreq-4)
+			}
+			p.setSummFreq(c, p.freq(s2)+p.initEsc+b2u(ns > 2))
+		}
+		cf := 2 * fFreq * (p.summFreq(c) + 6)
+		sf := s0 + p.summFreq(c)
+		if cf < 6*sf {
+			cf = 1 + b2u(cf > sf) + b2u(cf >= 4*sf)
+			p.setSummFreq(c, p.summFreq(c)+4)
+		} else {
+			cf = 4 + b2u(cf > 9*sf) + b2u(cf > 12*sf) + b2u(cf > 15*sf)
+			p.setSummFreq(c, p.summFreq(c)+cf)
+		}
+		s2 := p.state(p.stats(c), ns1+1)
+		p.setSuccessor(s2, successor)
+		p.mem[s2] = byte(fSymbol)
+		p.setFreq(s2, cf)
+		p.setFlags(c, p.flags(c)|flag)
+		p.setNumStats(c, ns1+1)
+	}
+	p.maxContext = fSuccessor
+	p.minContext = fSuccessor
+}
+
+func (p *model) rescale() {
+	stats := p.stats(p.minContext)
+	s := p.foundState
+	// move the found state to the front
+	if s != stats {
+		var tmp [stateSize]byte
+		copy(tmp[:], p.mem[s:s+stateSize])
+		copy(p.mem[stats+stateSize:s+stateSize], p.mem[stats:s])
+		copy(p.mem[stats:stats+stateSize], tmp[:])
+		s = stats
+	}
+	escFreq := p.summFreq(p.minContext) - p.freq(s)
+	adder := b2u(p.orderFall != 0)
+	p.setFreq(s, (p.freq(s)+4+adder)>>1)
+	sumFreq := p.freq(s)
+
+	i := p.numStats(p.minContext)
+	for ; i > 0; i-- {
+		s += stateSize
+		escFreq -= p.freq(s)
+		p.setFreq(s, (p.freq(s)+adder)>>1)
+		sumFreq += p.freq(s)
+		if p.freq(s) > p.freq(s-stateSize) {
+			// insertion sort by decreasing frequency
+			var tmp [stateSize]byte
+			copy(tmp[:], p.mem[s:s+stateSize])
+			freq := uint32(tmp[1])
+			s1 := s
+			for {
+				p.copyState(s1, s1-stateSize)
+				s1 -= stateSize
+				if s1 == stats || freq <= p.freq(s1-stateSize) {
+					break
+				}
+			}
+			copy(p.mem[s1:s1+stateSize], tmp[:])
+		}
+	}
+
+	if p.freq(s) == 0 {
+		numStats := p.numStats(p.minContext)
+		i = 0
+		for {
+			i++
+			s -= stateSize
+			if p.freq(s) != 0 {
+				break
+			}
+		}
+		escFreq += i
+		p.setNumStats(p.minContext, numStats-i)
+		if p.numStats(p.minContext) == 0 {
+			var tmp [stateSize]byte
+			copy(tmp[:], p.mem[stats:stats+stateSize])
+			freq := (2*uint32(tmp[1]) + escFreq - 1) / escFreq
+			tmp[1] = byte(min(freq, maxFreq/3))
+			p.insertNode(stats, p.u2i((numStats+2)>>1))
+			p.setFlags(p.minContext, p.flags(p.minContext)&0x10+0x08*b2u(tmp[0] >= 0x40))
+			p.foundState = oneState(p.minContext)
+			copy(p.mem[p.foundState:p.foundState+stateSize], tmp[:])
+			return
+		}
+		n0 := (numStats + 2) >> 1
+		n1 := (p.numStats(p.minContext) + 2) >> 1
+		if n0 != n1 {
+			p.setStats(p.minContext, p.shrinkUnits(stats, n0, n1))
+		}
+		s = p.stats(p.minContext)
+		flags := p.flags(p.minContext)&^0x08 | 0x08*p.hiBit(s)
+		for i = p.numStats(p.minContext); i > 0; i-- {
+			s += stateSize
+			flags |= 0x08 * p.hiBit(s)
+		}
+		p.setFlags(p.minContext, flags)
+	}
+	p.setSummFreq(p.minContext, sumFreq+escFreq-escFreq>>1)
+	p.setFlags(p.minContext, p.flags(p.minContext)|0x04)
+	p.foundState = p.stats(p.minContext)
+}
+
+func (p *model) nextContext() {
+	c := p.successor(p.foundState)
+	if p.orderFall == 0 && c >= p.unitsStart {
+		p.minContext, p.maxContext = c, c
+	} else {
+		p.updateModel()
+		p.minContext = p.maxContext
+	}
+}
+
+func (p *model) update1() {
+	s := p.foundState
+	p.setFreq(s, p.freq(s)+4)
+	p.setSummFreq(p.minContext, p.summFreq(p.minContext)+4)
+	if p.freq(s) > p.freq(s-stateSize) {
+		p.swapStates(s, s-stateSize)
+		s -= stateSize
+		p.foundState = s
+		if p.freq(s) > maxFreq {
+			p.rescale()
+		}
+	}
+	p.nextContext()
+}
+
+func (p *model) update1_0() {
+	p.prevSuccess = b2u(2*p.freq(p.foundState) >= p.summFreq(p.minContext))
+	p.runLength += int32(p.prevSuccess)
+	p.setSummFreq(p.minContext, p.summFreq(p.minContext)+4)
+	p.setFreq(p.foundState, p.freq(p.foundState)+4)
+	if p.freq(p.foundState) > maxFreq {
+		p.rescale()
+	}
+	p.nextContext()
+}
+
+func (p *model) updateBin() {
+	p.setFreq(p.foundState, p.freq(p.foundState)+b2u(p.freq(p.foundState) < 196))
+	p.prevSuccess = 1
+	p.runLength++
+	p.nextContext()
+}
+
+func (p *model) update2() {
+	p.setSummFreq(p.minContext, p.summFreq(p.minContext)+4)
+	p.setFreq(p.foundState, p.freq(p.foundState)+4)
+	if p.freq(p.foundState) > maxFreq {
+		p.rescale()
+	}
+	p.runLength = p.initRL
+	p.updateModel()
+	p.minContext = p.maxContext
+}
+
+// binProb returns the binSumm entry of the binary context c.
+func (p *model) binProb(c uint32) *uint16 {
+	s := oneState(c)
+	return &p.binSumm[p.ns2Indx[p.freq(s)-1]][uint32(p.ns2BSIndx[p.numStats(p.suffix(c))])+
+		p.prevSuccess+p.flags(c)+uint32(p.runLength>>26)&0x20]
+}
+
+// makeEscFreq returns the see context of minContext after symbols of
+// a context with numMasked+1 symbols were masked, and its escape
+// frequency.
+func (p *model) makeEscFreq(numMasked uint32) (*see, uint32) {
+	c := p.minContext
+	numStats := p.numStats(c)
+	if numStats == 0xFF {
+		return &p.dummySee, 1
+	}
+	s := &p.see[p.ns2Indx[numStats+2]-3][b2u(p.summFreq(c) > 11*(numStats+1))+
+		2*b2u(2*numStats < p.numStats(p.suffix(c))+numMasked)+p.flags(c)]
+	return s, s.mean()
+}
@@ -0,0 +1,267 @@
+package ppmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// encoder is the encoder of the reference code, driving the same model
+// as the decoder.
+type encoder struct {
+	*model
+	low uint32
+	rng uint32
+	out bytes.Buffer
+}
+
+func (e *encoder) normalize() {
+	for {
+		if e.low^(e.low+e.rng) >= rangeTop {
+			if e.rng >= rangeBot {
+				break
+			}
+			e.rng = -e.low & (rangeBot - 1)
+		}
+		e.out.WriteByte(byte(e.low >> 24))
+		e.rng <<= 8
+		e.low <<= 8
+	}
+}
+
+func (e *encoder) encode(start, size, total uint32) {
+	e.rng /= total
+	e.low += start * e.rng
+	e.rng *= size
+	e.normalize()
+}
+
+func (e *encoder) flush() {
+	for i := 0; i < 4; i++ {
+		e.out.WriteByte(byte(e.low >> 24))
+		e.low <<= 8
+	}
+}
+
+// encodeSymbol encodes a byte, or the end mark for -1.
+func (e *encoder) encodeSymbol(symbol int) {
+	var charMask [256]bool
+	if ns := e.numStats(e.minContext); ns != 0 {
+		s := e.stats(e.minContext)
+		summ := e.summFreq(e.minContext)
+		if int(e.symbol(s)) == symbol {
+			e.encode(0, e.freq(s), summ)
+			e.foundState = s
+			e.update1_0()
+			return
+		}
+		e.prevSuccess = 0
+		sum := e.freq(s)
+		for i := ns; i > 0; i-- {
+			s += stateSize
+			if int(e.symbol(s)) == symbol {
+				e.encode(sum, e.freq(s), summ)
+				e.foundState = s
+				e.update1()
+				return
+			}
+			sum += e.freq(s)
+		}
+		for i := ns + 1; i > 0; i-- {
+			charMask[e.symbol(s)] = true
+			s -= stateSize
+		}
+		e.encode(sum, summ-sum, summ)
+	} else {
+		prob := e.binProb(e.minContext)
+		s := oneState(e.minContext)
+		if int(e.symbol(s)) == symbol {
+			e.rng = (e.rng >> 14) * uint32(*prob)
+			e.normalize()
+			*prob = updateProb0(*prob)
+			e.foundState = s
+			e.updateBin()
+			return
+		}
+		e.rng >>= 14
+		e.low += uint32(*prob) * e.rng
+		e.rng *= binScale - uint32(*prob)
+		e.normalize()
+		*prob = updateProb1(*prob)
+		e.initEsc = uint32(expEscape[*prob>>10])
+		charMask[e.symbol(s)] = true
+		e.prevSuccess = 0
+	}
+	for {
+		numMasked := e.numStats(e.minContext)
+		for {
+			e.orderFall++
+			if e.suffix(e.minContext) == 0 {
+				return
+			}
+			e.minContext = e.suffix(e.minContext)
+			if e.numStats(e.minContext) != numMasked {
+				break
+			}
+		}
+		see, escFreq := e.makeEscFreq(numMasked)
+		s := e.stats(e.minContext)
+		var sum uint32
+		for i := e.numStats(e.minContext) + 1; i > 0; i-- {
+			cur := e.symbol(s)
+			if int(cur) == symbol {
+				low, s1 := sum, s
+				for ; i > 0; i-- {
+					if !charMask[e.symbol(s)] {
+						sum += e.freq(s)
+					}
+					s += stateSize
+				}
+				e.encode(low, e.freq(s1), sum+escFreq)
+				see.update()
+				e.foundState = s1
+				e.update2()
+				return
+			}
+			if !charMask[cur] {
+				sum += e.freq(s)
+			}
+			charMask[cur] = true
+			s += stateSize
+		}
+		e.encode(sum, escFreq, sum+escFreq)
+		see.summ += uint16(sum + escFreq)
+	}
+}
+
+// compress returns data as a zip PPMd stream, end mark included.
+func compress(data []byte, order, memMiB, restore int) []byte {
+	e := &encoder{model: newModel(order, restore, uint32(memMiB)<<20), rng: 0xFFFFFFFF}
+	var h [headerLen]byte
+	binary.LittleEndian.PutUint16(h[:], uint16(order-1|(memMiB-1)<<4|restore<<12))
+	e.out.Write(h[:])
+	for _, c := range data {
+		e.encodeSymbol(int(c))
+	}
+	e.encodeSymbol(-1)
+	e.flush()
+	return e.out.Bytes()
+}
+
+func testData() []byte {
+	rnd := rand.New(rand.NewSource(1))
+	words := make([]string, 500)
+	for i := range words {
+		w := make([]byte, 2+rnd.Intn(8))
+		for j := range w {
+			w[j] = byte('a' + rnd.Intn(26))
+		}
+		words[i] = string(w)
+	}
+	var b bytes.Buffer
+	for b.Len() < 3<<17 {
+		b.WriteString(words[rnd.Intn(len(words))])
+		b.WriteByte(" \n"[rnd.Intn(10)/9])
+	}
+	b.Write(bytes.Repeat([]byte{'A'}, 5000))
+	for i := 0; i < 1<<17; i++ {
+		b.WriteByte(byte(rnd.Intn(256)))
+	}
+	b.Write(b.Bytes()[:1<<16])
+	return b.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := testData()
+	tests := []struct {
+		name                   string
+		data                   []byte
+		order, memMiB, restore int
+	}{
+		{"empty", nil, 6, 1, restoreRestart},
+		{"byte", []byte{'x'}, 2, 1, restoreRestart},
+		{"order2", data, 2, 16, restoreRestart},
+		{"order6", data, 6, 16, restoreRestart},
+		{"restart", data, 8, 1, restoreRestart},
+		{"cutoff", data, 8, 1, restoreCutOff},
+		{"order16-cutoff", data, 16, 2, restoreCutOff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z := compress(tt.data, tt.order, tt.memMiB, tt.restore)
+			for _, size := range []int64{int64(len(tt.data)), -1} {
+				got, err := io.ReadAll(NewReader(bytes.NewReader(z), size, MaxMemory))
+				if err != nil {
+					t.Fatalf("size %d: %v", size, err)
+				}
+				if !bytes.Equal(got, tt.data) {
+					t.Fatalf("size %d: data differs", size)
+				}
+			}
+		})
+	}
+}
+
+// TestRestartModel checks the initial escape estimates against those of
+// the Ppmd8 code in libarchive, which the round trips cannot catch: the
+// encoder shares the model.
+func TestRestartModel(t *testing.T) {
+	binSumm := [25]uint16{8594, 11191, 12489, 13268, 13788, 14159, 14653, 15086, 15411, 15643, 15807, 15926,
+		16014, 16079, 16129, 16168, 16199, 16224, 16244, 16261, 16275, 16287, 16296, 16305, 16312}
+	seeSumm := [24]uint16{56, 72, 88, 120, 168, 232, 312, 408, 520, 648, 792, 952,
+		1128, 1320, 1528, 1752, 1992, 2248, 2520, 2808, 3112, 3432, 3768, 4120}
+	p := newModel(6, restoreRestart, 1<<20)
+	for i, want := range binSumm {
+		if got := p.binSumm[i][0]; got != want {
+			t.Errorf("binSumm[%d][0] = %d, want %d", i, got, want)
+		}
+	}
+	for i, want := range seeSumm {
+		if got := p.see[i][0].summ; got != want {
+			t.Errorf("see[%d][0].summ = %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		hdr  uint16
+		want error
+	}{
+		{"order1", 0x0050, errCorrupt},
+		{"restore3", 0x3055, errCorrupt},
+		{"memory", 0x00f5, ErrMemoryLimit},
+	} {
+		var b [headerLen + 4]byte
+		binary.LittleEndian.PutUint16(b[:], tt.hdr)
+		_, err := io.ReadAll(NewReader(bytes.NewReader(b[:]), 10, 8<<20))
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	var b [headerLen + 4]byte
+	binary.LittleEndian.PutUint16(b[:], 0x2055)
+	if _, err := io.ReadAll(NewReader(bytes.NewReader(b[:]), 10, MaxMemory)); err == nil {
+		t.Error("freeze: no error")
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	data := testData()[:100000]
+	z := compress(data, 6, 1, restoreRestart)
+	for _, n := range []int{1, 4, len(z) / 2, len(z) - 5} {
+		_, err := io.ReadAll(NewReader(bytes.NewReader(z[:n]), int64(len(data)), MaxMemory))
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%d of %d bytes: got %v, want %v", n, len(z), err, io.ErrUnexpectedEOF)
+		}
+	}
+	// The end mark before the entry's size is reached.
+	_, err := io.ReadAll(NewReader(bytes.NewReader(z), int64(len(data))+1, MaxMemory))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("short: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -0,0 +1,42 @@
+package zip
+
+import (
+	"errors"
+	"io"
+
+	"github.com/gdme1320/zip/pkg/internal/legacy"
+)
+
+// The legacy methods do not mark the end of their data, so their
+// decompressors only work on the entryReader File.Open passes them.
+var errNoEntry = errors.New("zip: method needs the entry's uncompressed size")
+
+// Implode flag bits.
+const (
+	implodeLargeWindow = 0x2 // 8 KiB instead of 4 KiB window
+	implodeLiteralTree = 0x4 // three Shannon-Fano trees instead of two
+)
+
+func newShrinkReader(r io.Reader) io.ReadCloser {
+	e, ok := r.(*entryReader)
+	if !ok {
+		return io.NopCloser(&errReader{errNoEntry})
+	}
+	return legacy.NewShrinkReader(e, int64(e.size))
+}
+
+func newReduceReader(r io.Reader) io.ReadCloser {
+	e, ok := r.(*entryReader)
+	if !ok {
+		return io.NopCloser(&errReader{errNoEntry})
+	}
+	return legacy.NewReduceReader(e, int(e.method-Reduce1)+1, int64(e.size))
+}
+
+func newImplodeReader(r io.Reader) io.ReadCloser {
+	e, ok := r.(*entryReader)
+	if !ok {
+		return io.NopCloser(&errReader{errNoEntry})
+	}
+	return legacy.NewImplodeReader(e, int64(e.size), e.flags&implodeLargeWindow != 0, e.flags&implodeLiteralTree != 0)
+}
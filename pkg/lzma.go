@@ -0,0 +1,134 @@
+package zip
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// A zip LZMA stream starts with a 4 byte header, the LZMA SDK version
+// and the size of the properties that follow, instead of the 13 byte
+// header of a classic .lzma file. The uncompressed size is only known
+// from the file header, and general purpose flag bit 1 marks streams
+// ending with an end of stream marker.
+const (
+	lzmaHeaderLen   = 4
+	lzmaPropsLen    = 5              // properties byte and dictionary size
+	lzmaClassicLen  = lzma.HeaderLen // properties, dictionary and uncompressed size
+	lzmaVersionMaj  = 9
+	lzmaVersionMin  = 20
+	lzmaEOSFlag     = 0x2
+	lzmaUnknownSize = ^uint64(0)
+)
+
+func newLZMAReader(r io.Reader) io.ReadCloser {
+	size := lzmaUnknownSize
+	if e, ok := r.(*entryReader); ok && e.flags&lzmaEOSFlag == 0 {
+		size = e.size
+	}
+	var hdr [lzmaHeaderLen + lzmaPropsLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return io.NopCloser(&errReader{err})
+	}
+	if binary.LittleEndian.Uint16(hdr[2:]) != lzmaPropsLen {
+		return io.NopCloser(&errReader{errors.New("zip: invalid LZMA properties")})
+	}
+	classic := make([]byte, lzmaClassicLen)
+	copy(classic, hdr[lzmaHeaderLen:])
+	binary.LittleEndian.PutUint64(classic[lzmaPropsLen:], size)
+	lr, err := lzma.NewReader(io.MultiReader(bytes.NewReader(classic), r))
+	if err != nil {
+		return io.NopCloser(&errReader{err})
+	}
+	return io.NopCloser(lr)
+}
+
+// lzmaCompressor writes LZMA streams with an end of stream marker, as
+// the size is not known in advance.
+func lzmaCompressor(w io.Writer) (io.WriteCloser, error) {
+	hw := &lzmaHeaderWriter{w: w}
+	lw, err := lzma.WriterConfig{EOSMarker: true}.NewWriter(hw)
+	if err != nil {
+		return nil, err
+	}
+	return lw, nil
+}
+
+// lzmaHeaderWriter replaces the classic header written by lzma.Writer
+// with the zip one.
+type lzmaHeaderWriter struct {
+	w   io.Writer
+	hdr []byte
+}
+
+func (w *lzmaHeaderWriter) Write(p []byte) (int, error) {
+	n := 0
+	if len(w.hdr) < lzmaClassicLen {
+		n = min(len(p), lzmaClassicLen-len(w.hdr))
+		w.hdr = append(w.hdr, p[:n]...)
+		p = p[n:]
+		if len(w.hdr) < lzmaClassicLen {
+			return n, nil
+		}
+		b := []byte{lzmaVersionMaj, lzmaVersionMin, lzmaPropsLen, 0}
+		b = append(b, w.hdr[:lzmaPropsLen]...)
+		if _, err := w.w.Write(b); err != nil {
+			return 0, err
+		}
+	}
+	m, err := w.w.Write(p)
+	return n + m, err
+}
+
+func xzCompressor(w io.Writer) (io.WriteCloser, error) {
+	return &xzWriter{w: w}, nil
+}
+
+// xzWriter delays creating the xz.Writer, which writes the stream
+// header right away, as Writer.CreateHeader sets up the compressor
+// before writing the local file header.
+type xzWriter struct {
+	w  io.Writer
+	xw *xz.Writer
+}
+
+func (w *xzWriter) init() (err error) {
+	if w.xw == nil {
+		w.xw, err = xz.NewWriter(w.w)
+	}
+	return err
+}
+
+func (w *xzWriter) Write(p []byte) (int, error) {
+	if err := w.init(); err != nil {
+		return 0, err
+	}
+	return w.xw.Write(p)
+}
+
+func (w *xzWriter) Close() error {
+	if err := w.init(); err != nil {
+		return err
+	}
+	return w.xw.Close()
+}
+
+func newXZReader(r io.Reader) io.ReadCloser {
+	xr, err := xz.NewReader(r)
+	if err != nil {
+		return io.NopCloser(&errReader{err})
+	}
+	return io.NopCloser(xr)
+}
+
+func newBzip2Reader(r io.Reader) io.ReadCloser {
+	return io.NopCloser(bzip2.NewReader(r))
+}
@@ -0,0 +1,21 @@
+//go:build linux
+
+package zip
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the size bytes of f into memory, read only.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	if int64(int(size)) != size {
+		return nil, errors.New("zip: " + f.Name() + ": size too large to map")
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(b []byte) error {
+	return syscall.Munmap(b)
+}
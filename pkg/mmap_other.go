@@ -0,0 +1,17 @@
+//go:build !linux
+
+package zip
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile is only implemented on Linux.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
@@ -0,0 +1,313 @@
+package zip
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// ParallelOptions configures a ParallelWriter.
+type ParallelOptions struct {
+	// Concurrency is the number of entries in progress at a time,
+	// compressed or waiting to be written. If zero, runtime.GOMAXPROCS
+	// is used.
+	Concurrency int
+
+	// MaxMemory is the number of bytes of compressed data held in
+	// memory, shared evenly between the entries in progress. The data
+	// of an entry beyond its share goes to a temporary file. If zero,
+	// 64 MiB is used.
+	MaxMemory int64
+
+	// TempDir is the directory of the temporary files, os.TempDir if
+	// empty.
+	TempDir string
+}
+
+const defaultParallelMemory = 64 << 20
+
+// A ParallelWriter compresses, and encrypts, several entries of a
+// Writer at the same time. Each entry is compressed into a buffer
+// that spills to a temporary file, and is written to the Writer with
+// CreateRaw once it and all entries created before it are done. The
+// archive holds the entries in the order of the CreateHeader calls.
+type ParallelWriter struct {
+	w       *Writer
+	opts    ParallelOptions
+	slots   chan struct{} // one per entry in progress
+	mu      sync.Mutex
+	pending []*parallelEntry // not yet written to w, in order
+	err     error
+	closed  bool
+}
+
+// NewParallelWriter returns a ParallelWriter adding entries to w, with
+// the compression settings of w. w must not be used directly until
+// the ParallelWriter is closed. A nil opts uses the zero
+// ParallelOptions.
+func NewParallelWriter(w *Writer, opts *ParallelOptions) *ParallelWriter {
+	p := &ParallelWriter{w: w}
+	if opts != nil {
+		p.opts = *opts
+	}
+	if p.opts.Concurrency <= 0 {
+		p.opts.Concurrency = runtime.GOMAXPROCS(0)
+	}
+	if p.opts.MaxMemory <= 0 {
+		p.opts.MaxMemory = defaultParallelMemory
+	}
+	p.slots = make(chan struct{}, p.opts.Concurrency)
+	return p
+}
+
+// Create adds a file to the archive using the provided name, as
+// Writer.Create does.
+func (p *ParallelWriter) Create(name string) (io.WriteCloser, error) {
+	header := &FileHeader{
+		Name:   name,
+		Method: Deflate,
+	}
+	return p.CreateHeader(header)
+}
+
+// CreateHeader adds a file to the archive using the provided FileHeader
+// and returns a WriteCloser to which the file contents should be
+// written. The entry is complete once the WriteCloser is closed; its
+// Close reports errors writing the entry, or an earlier one, to the
+// underlying Writer. An entry whose compression fails is left out of
+// the archive, its Close reporting the error, and the others are still
+// written.
+//
+// Different entries may be written from different goroutines. Once
+// Concurrency entries are in progress, CreateHeader blocks until the
+// oldest one has been written, so a goroutine must not create more
+// entries than that without closing them.
+func (p *ParallelWriter) CreateHeader(fh *FileHeader) (io.WriteCloser, error) {
+	p.slots <- struct{}{}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, err := p.create(fh)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	p.pending = append(p.pending, e)
+	return e, nil
+}
+
+func (p *ParallelWriter) create(fh *FileHeader) (*parallelEntry, error) {
+	switch {
+	case p.err != nil:
+		return nil, p.err
+	case p.closed:
+		return nil, errors.New("zip: ParallelWriter is closed")
+	}
+	if err := p.w.checkEntry(fh); err != nil {
+		return nil, err
+	}
+	if _, err := p.w.alignment(fh); err != nil {
+		return nil, err
+	}
+	fh.Flags |= 0x8 // the check byte of StandardEncryption uses the time
+	e := &parallelEntry{
+		p: p,
+		spill: &spillBuffer{
+			limit: int(p.opts.MaxMemory / int64(p.opts.Concurrency)),
+			dir:   p.opts.TempDir,
+		},
+	}
+	fw := &fileWriter{}
+	if err := p.w.initFileWriter(fw, fh, e.spill); err != nil {
+		return nil, err
+	}
+	fw.header = &header{FileHeader: fh}
+	e.fw = fw
+	return e, nil
+}
+
+// flush writes the finished entries at the front of the queue to the
+// underlying Writer. p.mu must be held.
+func (p *ParallelWriter) flush() error {
+	for len(p.pending) > 0 && p.pending[0].done {
+		e := p.pending[0]
+		p.pending = p.pending[1:]
+		if p.err == nil && e.err == nil {
+			p.err = p.write(e)
+		}
+		if err := e.spill.Close(); err != nil && p.err == nil {
+			p.err = err
+		}
+		<-p.slots
+	}
+	return p.err
+}
+
+// write writes the compressed entry e to the underlying Writer.
+func (p *ParallelWriter) write(e *parallelEntry) error {
+	fh := e.fw.FileHeader
+	if !(fh.password != nil && fh.encryption == StandardEncryption) {
+		fh.Flags &^= 0x8 // the sizes are known, CreateRaw puts them in the local header
+	}
+	fw, err := p.w.CreateRaw(fh)
+	if err != nil {
+		return err
+	}
+	r, err := e.spill.reader()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+// AddFS adds the files of fsys to the archive as Writer.AddFS does,
+// reading and compressing up to Concurrency of them at a time.
+func (p *ParallelWriter) AddFS(fsys fs.FS, opts *AddFSOptions) error {
+	var wg sync.WaitGroup
+	err := p.w.walkFS(fsys, opts, func(e *fsEntry) error {
+		fw, err := p.CreateHeader(e.fh)
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pe := fw.(*parallelEntry)
+			if err := pe.closeWithError(e.copy(fsys, pe)); err != nil {
+				p.mu.Lock()
+				if p.err == nil {
+					p.err = err // as Writer.AddFS, stop at the first error
+				}
+				p.mu.Unlock()
+			}
+		}()
+		return nil
+	})
+	wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		err = p.err
+	}
+	return err
+}
+
+// AddDir adds the contents of the directory tree rooted at dir to the
+// archive, as AddFS does.
+func (p *ParallelWriter) AddDir(dir string, opts *AddFSOptions) error {
+	return p.AddFS(dirFS{FS: os.DirFS(dir), dir: dir}, opts)
+}
+
+// Close waits for the entries in progress to be written and closes the
+// underlying Writer, finishing the archive. Every entry must have been
+// closed.
+func (p *ParallelWriter) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.New("zip: ParallelWriter closed twice")
+	}
+	p.closed = true
+	if p.err != nil {
+		return p.err
+	}
+	if len(p.pending) > 0 {
+		return errors.New("zip: ParallelWriter closed with open entries")
+	}
+	return p.w.Close()
+}
+
+// parallelEntry is an entry of a ParallelWriter.
+type parallelEntry struct {
+	p     *ParallelWriter
+	fw    *fileWriter
+	spill *spillBuffer
+	done  bool  // compressed, guarded by p.mu
+	err   error // of compressing
+}
+
+func (e *parallelEntry) Write(b []byte) (int, error) {
+	return e.fw.Write(b)
+}
+
+func (e *parallelEntry) Close() error {
+	return e.closeWithError(nil)
+}
+
+// closeWithError finishes e, which is left out of the archive if err,
+// the error producing its contents, is not nil.
+func (e *parallelEntry) closeWithError(err error) error {
+	if e.fw.closed {
+		return errors.New("zip: file closed twice")
+	}
+	e.fw.closed = true
+	if err1 := e.fw.finish(); err == nil {
+		err = err1
+	}
+	p := e.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e.done = true
+	e.err = err
+	if err := p.flush(); err != nil {
+		return err
+	}
+	return e.err
+}
+
+// spillBuffer holds up to limit bytes in memory and the rest in a
+// temporary file.
+type spillBuffer struct {
+	buf   []byte
+	limit int
+	dir   string
+	f     *os.File
+}
+
+func (s *spillBuffer) Write(b []byte) (int, error) {
+	if s.f == nil {
+		if len(s.buf)+len(b) <= s.limit {
+			if len(s.buf)+len(b) > cap(s.buf) {
+				buf := make([]byte, len(s.buf), min(2*cap(s.buf)+len(b), s.limit))
+				copy(buf, s.buf)
+				s.buf = buf
+			}
+			s.buf = append(s.buf, b...)
+			return len(b), nil
+		}
+		f, err := os.CreateTemp(s.dir, "zip-parallel-")
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+	}
+	return s.f.Write(b)
+}
+
+// reader returns a reader for the data written to s.
+func (s *spillBuffer) reader() (io.Reader, error) {
+	if s.f == nil {
+		return bytes.NewReader(s.buf), nil
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(s.buf), s.f), nil
+}
+
+// Close releases the memory and removes the temporary file.
+func (s *spillBuffer) Close() error {
+	s.buf = nil
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	if err1 := os.Remove(s.f.Name()); err == nil {
+		err = err1
+	}
+	return err
+}
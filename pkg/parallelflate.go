@@ -0,0 +1,157 @@
+package zip
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// ParallelFlateOptions configures ParallelFlateCompressor.
+type ParallelFlateOptions struct {
+	// BlockSize is the number of input bytes deflated as one block.
+	// If zero, 1 MiB is used.
+	BlockSize int
+
+	// Concurrency is the number of blocks deflated at a time. If zero,
+	// runtime.GOMAXPROCS is used.
+	Concurrency int
+}
+
+const (
+	defaultFlateBlockSize = 1 << 20
+	flateWindowSize       = 32 << 10 // the dictionary priming each block
+)
+
+// ParallelFlateCompressor returns a Deflate Compressor that, as pigz
+// does, splits the data of an entry into blocks and deflates them
+// concurrently, each primed with the last 32 KiB of the block before
+// it. The blocks end with a flush to a byte boundary, so that they join
+// into a single deflate stream any reader can decompress; the output
+// is only slightly larger than that of the standard compressor.
+//
+// It is registered for Deflate with Writer.RegisterCompressor, or set
+// for a single large entry with FileHeader.SetCompressor. Entries of a
+// single block come out as from the standard compressor.
+func ParallelFlateCompressor(level int, opts *ParallelFlateOptions) Compressor {
+	var o ParallelFlateOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.BlockSize <= 0 {
+		o.BlockSize = defaultFlateBlockSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = runtime.GOMAXPROCS(0)
+	}
+	return func(w io.Writer) (io.WriteCloser, error) {
+		if err := checkFlateLevel(level); err != nil {
+			return nil, err
+		}
+		z := &parallelFlateWriter{
+			w:         w,
+			level:     level,
+			blockSize: o.BlockSize,
+			queue:     make(chan chan []byte, o.Concurrency),
+			done:      make(chan struct{}),
+		}
+		go z.output()
+		return z, nil
+	}
+}
+
+type parallelFlateWriter struct {
+	w         io.Writer
+	level     int
+	blockSize int
+	buf       []byte           // input of the next block
+	prev      []byte           // input of the previous block
+	queue     chan chan []byte // deflated blocks in order, one per block in progress
+	done      chan struct{}    // closed once output returns
+	closed    bool
+
+	mu  sync.Mutex // guards err
+	err error      // writing to w
+}
+
+func (z *parallelFlateWriter) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, errors.New("zip: write to closed compressor")
+	}
+	if err := z.error(); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		if z.buf == nil {
+			z.buf = make([]byte, 0, z.blockSize)
+		}
+		k := min(len(p), z.blockSize-len(z.buf))
+		z.buf = append(z.buf, p[:k]...)
+		p = p[k:]
+		if len(z.buf) == z.blockSize {
+			z.deflate(false)
+		}
+	}
+	return n, nil
+}
+
+// Close deflates the last block, marked final, and waits for all
+// blocks to be written.
+func (z *parallelFlateWriter) Close() error {
+	if z.closed {
+		return errors.New("zip: compressor closed twice")
+	}
+	z.closed = true
+	z.deflate(true)
+	close(z.queue)
+	<-z.done
+	return z.error()
+}
+
+// deflate starts deflating the buffered block. It blocks while
+// Concurrency blocks are in progress.
+func (z *parallelFlateWriter) deflate(final bool) {
+	data, dict := z.buf, z.prev
+	if len(dict) > flateWindowSize {
+		dict = dict[len(dict)-flateWindowSize:]
+	}
+	res := make(chan []byte, 1)
+	z.queue <- res
+	go func() {
+		var out bytes.Buffer
+		fw, _ := flate.NewWriterDict(&out, z.level, dict) // level was checked
+		fw.Write(data)
+		if final {
+			fw.Close()
+		} else {
+			fw.Flush() // ends on a byte boundary with a non-final empty block
+		}
+		res <- out.Bytes()
+	}()
+	z.prev, z.buf = data, nil
+}
+
+// output writes the deflated blocks to w in order.
+func (z *parallelFlateWriter) output() {
+	defer close(z.done)
+	for res := range z.queue {
+		b := <-res
+		if z.error() != nil {
+			continue
+		}
+		if _, err := z.w.Write(b); err != nil {
+			z.mu.Lock()
+			z.err = err
+			z.mu.Unlock()
+		}
+	}
+}
+
+func (z *parallelFlateWriter) error() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.err
+}
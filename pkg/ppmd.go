@@ -0,0 +1,31 @@
+package zip
+
+import (
+	"io"
+
+	"github.com/gdme1320/zip/pkg/internal/ppmd"
+)
+
+// DefaultPPMdMemory is the model memory limit of the built-in PPMd
+// decompressor, the most a PPMd stream can ask for.
+const DefaultPPMdMemory = ppmd.MaxMemory
+
+// ErrMemoryLimit is returned when reading a PPMd entry whose model needs
+// more memory than its decompressor allows.
+var ErrMemoryLimit = ppmd.ErrMemoryLimit
+
+// PPMdDecompressor returns a Decompressor for PPMd variant I revision 1
+// (method 98) that refuses entries needing more than maxMemory bytes of
+// model memory with ErrMemoryLimit. Register it on a Reader to read
+// untrusted archives with a lower limit than DefaultPPMdMemory:
+//
+//	r.RegisterDecompressor(zip.PPMd, zip.PPMdDecompressor(16<<20))
+func PPMdDecompressor(maxMemory int) Decompressor {
+	return func(r io.Reader) io.ReadCloser {
+		size := int64(-1)
+		if e, ok := r.(*entryReader); ok {
+			size = int64(e.size)
+		}
+		return ppmd.NewReader(r, size, maxMemory)
+	}
+}
@@ -6,6 +6,7 @@ package zip
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"hash/crc32"
 	"io"
 	"os"
+	"sync/atomic"
 )
 
 var (
@@ -22,29 +24,57 @@ var (
 )
 
 type Reader struct {
-	r       io.ReaderAt
-	File    []*File
-	Comment string
+	r         io.ReaderAt
+	File      []*File
+	Comment   string
+	dirOffset int64 // offset of the central directory
+
+	decompressors map[uint16]Decompressor // per-Reader overrides
 }
 
 type ReadCloser struct {
-	f *os.File
+	f      *os.File
+	mapped []byte // the file, if memory-mapped
 	Reader
 }
 
 type File struct {
 	FileHeader
+	zip          *Reader
 	zipr         io.ReaderAt
 	zipsize      int64
 	headerOffset int64
+	bodyOffset   int64      // relative to headerOffset once known, accessed atomically
+	index        *SeekIndex // see SetSeekIndex
 }
 
-func (f *File) hasDataDescriptor() bool {
-	return f.Flags&0x8 != 0
+// ReaderOptions configures OpenReaderOptions.
+type ReaderOptions struct {
+	// Mmap maps the archive into memory instead of reading it with a
+	// system call per read. It is ignored on systems other than Linux.
+	// The program crashes if the file is truncated while mapped, or if
+	// entries are read after the ReadCloser is closed.
+	Mmap bool
+
+	// BlockSize, if non-zero and the archive is not mapped, reads the
+	// archive through a CachedReaderAt with blocks of that size,
+	// keeping CacheBlocks of them.
+	BlockSize   int
+	CacheBlocks int
 }
 
 // OpenReader will open the Zip file specified by name and return a ReadCloser.
 func OpenReader(name string) (*ReadCloser, error) {
+	return OpenReaderOptions(name, nil)
+}
+
+// OpenReaderOptions opens the Zip file specified by name as OpenReader
+// does, reading it as configured by opts. A nil opts uses the zero
+// ReaderOptions.
+func OpenReaderOptions(name string, opts *ReaderOptions) (*ReadCloser, error) {
+	if opts == nil {
+		opts = &ReaderOptions{}
+	}
 	f, err := os.Open(name)
 	if err != nil {
 		return nil, err
@@ -55,8 +85,23 @@ func OpenReader(name string) (*ReadCloser, error) {
 		return nil, err
 	}
 	r := new(ReadCloser)
-	if err := r.init(f, fi.Size()); err != nil {
-		f.Close()
+	var ra io.ReaderAt = f
+	if opts.Mmap && fi.Size() > 0 {
+		r.mapped, err = mmapFile(f, fi.Size())
+		switch {
+		case err == nil:
+			ra = bytes.NewReader(r.mapped)
+		case !errors.Is(err, errors.ErrUnsupported):
+			f.Close()
+			return nil, err
+		}
+	}
+	if r.mapped == nil && opts.BlockSize > 0 {
+		ra = NewCachedReaderAt(f, fi.Size(), opts.BlockSize, opts.CacheBlocks)
+	}
+	if err := r.init(ra, fi.Size()); err != nil {
+		r.f = f
+		r.Close()
 		return nil, err
 	}
 	r.f = f
@@ -84,6 +129,7 @@ func (z *Reader) init(r io.ReaderAt, size int64) error {
 	z.r = r
 	z.File = make([]*File, 0, end.directoryRecords)
 	z.Comment = end.comment
+	z.dirOffset = int64(end.directoryOffset)
 	rs := io.NewSectionReader(r, 0, size)
 	if _, err = rs.Seek(int64(end.directoryOffset), os.SEEK_SET); err != nil {
 		return err
@@ -95,7 +141,7 @@ func (z *Reader) init(r io.ReaderAt, size int64) error {
 	// a bad one, and then only report a ErrFormat or UnexpectedEOF if
 	// the file count modulo 65536 is incorrect.
 	for {
-		f := &File{zipr: r, zipsize: size}
+		f := &File{zip: z, zipr: r, zipsize: size}
 		err = readDirectoryHeader(f, buf)
 		if err == ErrFormat || err == io.ErrUnexpectedEOF {
 			break
@@ -115,7 +161,14 @@ func (z *Reader) init(r io.ReaderAt, size int64) error {
 
 // Close closes the Zip file, rendering it unusable for I/O.
 func (rc *ReadCloser) Close() error {
-	return rc.f.Close()
+	err := rc.f.Close()
+	if rc.mapped != nil {
+		if err1 := munmapFile(rc.mapped); err == nil {
+			err = err1
+		}
+		rc.mapped = nil
+	}
+	return err
 }
 
 // DataOffset returns the offset of the file's possibly-compressed
@@ -131,6 +184,35 @@ func (f *File) DataOffset() (offset int64, err error) {
 	return f.headerOffset + bodyOffset, nil
 }
 
+// DataAligned returns the offset of the file's data, like DataOffset,
+// and reports whether the file can be used in place at that offset,
+// such as by memory-mapping it: its data is neither compressed nor
+// encrypted and starts at a multiple of align bytes. See
+// Writer.SetAlignment.
+func (f *File) DataAligned(align int64) (offset int64, ok bool, err error) {
+	if align <= 0 {
+		return 0, false, fmt.Errorf("zip: invalid alignment %d", align)
+	}
+	offset, err = f.DataOffset()
+	if err != nil {
+		return 0, false, err
+	}
+	ok = f.Method == Store && !f.IsEncrypted() && offset%align == 0
+	return offset, ok, nil
+}
+
+// OpenRaw returns a Reader that provides access to the File's contents
+// as stored, without decompression or decryption. For encrypted files
+// this includes the encryption header and, for AES, the salt, password
+// verifier and authentication code.
+func (f *File) OpenRaw() (io.Reader, error) {
+	bodyOffset, err := f.findBodyOffset()
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(f.zipr, f.headerOffset+bodyOffset, int64(f.CompressedSize64)), nil
+}
+
 // Open returns a ReadCloser that provides access to the File's contents.
 // Multiple files may be read concurrently.
 func (f *File) Open() (rc io.ReadCloser, err error) {
@@ -138,29 +220,19 @@ func (f *File) Open() (rc io.ReadCloser, err error) {
 	if err != nil {
 		return
 	}
-	// If f is encrypted, CompressedSize64 includes salt, pwvv, encrypted data,
-	// and auth code lengths
 	size := int64(f.CompressedSize64)
-	var r io.Reader
-	rr := io.NewSectionReader(f.zipr, f.headerOffset+bodyOffset, size)
-	// check for encryption
-	if f.IsEncrypted() {
-
-		if f.ae == 0 {
-			if r, err = ZipCryptoDecryptor(rr, f.password()); err != nil {
-				return
-			}
-		} else if r, err = newDecryptionReader(rr, f); err != nil {
-			return
-		}
-	} else {
-		r = rr
+	r, err := f.openDecrypted(bodyOffset)
+	if err != nil {
+		return
 	}
-	dcomp := decompressor(f.Method)
+	dcomp := f.zip.decompressor(f.Method)
 	if dcomp == nil {
 		err = ErrAlgorithm
 		return
 	}
+	if needsEntry(f.Method) {
+		r = &entryReader{Reader: r, method: f.Method, flags: f.Flags, size: f.UncompressedSize64}
+	}
 	rc = dcomp(r)
 	// If AE-2, skip CRC and possible dataDescriptor
 	if f.isAE2() {
@@ -179,6 +251,55 @@ func (f *File) Open() (rc io.ReadCloser, err error) {
 	return
 }
 
+// entryReader is the compressed data of an entry, as passed by File.Open
+// to the decompressors of methods that need more than the data itself.
+type entryReader struct {
+	io.Reader
+	method uint16
+	flags  uint16
+	size   uint64 // uncompressed size
+}
+
+func needsEntry(method uint16) bool {
+	return method >= Shrink && method <= Implode || method == LZMA || method == PPMd
+}
+
+// RegisterDecompressor registers or overrides a custom decompressor for
+// a specific method ID. If a decompressor for a given method is not
+// found, Reader will default to looking up the decompressor at the
+// package level.
+func (z *Reader) RegisterDecompressor(method uint16, dcomp Decompressor) {
+	if z.decompressors == nil {
+		z.decompressors = make(map[uint16]Decompressor)
+	}
+	z.decompressors[method] = dcomp
+}
+
+func (z *Reader) decompressor(method uint16) Decompressor {
+	if dcomp := z.decompressors[method]; dcomp != nil {
+		return dcomp
+	}
+	return decompressor(method)
+}
+
+// openDecrypted returns the still compressed data of f, decrypted if f
+// is encrypted.
+func (f *File) openDecrypted(bodyOffset int64) (io.Reader, error) {
+	// If f is encrypted, CompressedSize64 includes salt, pwvv, encrypted data,
+	// and auth code lengths
+	rr := io.NewSectionReader(f.zipr, f.headerOffset+bodyOffset, int64(f.CompressedSize64))
+	if !f.IsEncrypted() {
+		return rr, nil
+	}
+	if f.password == nil {
+		return nil, ErrPassword
+	}
+	if f.ae == 0 {
+		return zipCryptoDecrypt(rr, f)
+	}
+	return newDecryptionReader(rr, f)
+}
+
 type checksumReader struct {
 	rc    io.ReadCloser
 	hash  hash.Hash32
@@ -229,7 +350,12 @@ func (r *checksumReader) Close() error { return r.rc.Close() }
 
 // findBodyOffset does the minimum work to verify the file has a header
 // and returns the file body offset.
+// The offset is cached, so that opening the file again does not read
+// the header again.
 func (f *File) findBodyOffset() (int64, error) {
+	if off := atomic.LoadInt64(&f.bodyOffset); off != 0 {
+		return off, nil
+	}
 	var buf [fileHeaderLen]byte
 	if _, err := f.zipr.ReadAt(buf[:], f.headerOffset); err != nil {
 		return 0, err
@@ -241,7 +367,173 @@ func (f *File) findBodyOffset() (int64, error) {
 	b = b[22:] // skip over most of the header
 	filenameLen := int(b.uint16())
 	extraLen := int(b.uint16())
-	return int64(fileHeaderLen + filenameLen + extraLen), nil
+	off := int64(fileHeaderLen + filenameLen + extraLen)
+	atomic.StoreInt64(&f.bodyOffset, off)
+	return off, nil
+}
+
+// A HeaderMismatch describes a field whose value in the local file
+// header or data descriptor disagrees with the central directory.
+type HeaderMismatch struct {
+	Field   string
+	Local   uint64
+	Central uint64
+}
+
+// HeaderError is returned by CheckHeaders and lists every field that
+// differs between the local and central records of a file.
+type HeaderError struct {
+	Name       string
+	Mismatches []HeaderMismatch
+}
+
+func (e *HeaderError) Error() string {
+	s := "zip: " + e.Name + ": local header mismatch:"
+	for i, m := range e.Mismatches {
+		if i > 0 {
+			s += ";"
+		}
+		if m.Field == "name" {
+			s += " name"
+			continue
+		}
+		s += fmt.Sprintf(" %s (local %#x, central %#x)", m.Field, m.Local, m.Central)
+	}
+	return s
+}
+
+// CheckHeaders compares the local file header, and the data descriptor
+// if the file has one, with the central directory entry read into f.
+// It returns a *HeaderError describing all mismatching fields, or
+// ErrFormat if the local records can't be parsed.
+//
+// A local header written for streaming may leave CRC-32 and sizes
+// zero; those fields are then only checked against the data descriptor.
+func (f *File) CheckHeaders() error {
+	var buf [fileHeaderLen]byte
+	if _, err := f.zipr.ReadAt(buf[:], f.headerOffset); err != nil {
+		return err
+	}
+	b := readBuf(buf[:])
+	if sig := b.uint32(); sig != fileHeaderSignature {
+		return ErrFormat
+	}
+	b = b[2:] // skip version needed to extract
+	flags := b.uint16()
+	method := b.uint16()
+	modTime := b.uint16()
+	modDate := b.uint16()
+	crc := b.uint32()
+	csize := uint64(b.uint32())
+	usize := uint64(b.uint32())
+	filenameLen := int(b.uint16())
+	extraLen := int(b.uint16())
+	d := make([]byte, filenameLen+extraLen)
+	if _, err := f.zipr.ReadAt(d, f.headerOffset+fileHeaderLen); err != nil {
+		return err
+	}
+	name := string(d[:filenameLen])
+
+	// resolve zip64 sizes and the real method behind AES encryption
+	eb := readBuf(d[filenameLen:])
+	for len(eb) >= 4 {
+		tag := eb.uint16()
+		size := int(eb.uint16())
+		if size > len(eb) {
+			return ErrFormat
+		}
+		fb := readBuf(eb[:size])
+		switch tag {
+		case zip64ExtraId:
+			if usize == uint32max && len(fb) >= 8 {
+				usize = fb.uint64()
+			}
+			if csize == uint32max && len(fb) >= 8 {
+				csize = fb.uint64()
+			}
+		case winzipAesExtraId:
+			if len(fb) >= 7 {
+				fb = fb[5:] // skip AE version, vendor ID and strength
+				method = fb.uint16()
+			}
+		}
+		eb = eb[size:]
+	}
+
+	herr := &HeaderError{Name: f.Name}
+	check := func(field string, local, central uint64) {
+		if local != central {
+			herr.Mismatches = append(herr.Mismatches, HeaderMismatch{field, local, central})
+		}
+	}
+	if name != f.Name {
+		herr.Mismatches = append(herr.Mismatches, HeaderMismatch{Field: "name"})
+	}
+	check("flags", uint64(flags), uint64(f.Flags))
+	check("method", uint64(method), uint64(f.Method))
+	check("modified time", uint64(modTime), uint64(f.ModifiedTime))
+	check("modified date", uint64(modDate), uint64(f.ModifiedDate))
+	streamed := flags&0x8 != 0
+	if !streamed || crc != 0 {
+		check("crc32", uint64(crc), uint64(f.CRC32))
+	}
+	if !streamed || csize != 0 || usize != 0 {
+		check("compressed size", csize, f.CompressedSize64)
+		check("uncompressed size", usize, f.UncompressedSize64)
+	}
+
+	if f.hasDataDescriptor() {
+		off := f.headerOffset + fileHeaderLen + int64(filenameLen+extraLen) + int64(f.CompressedSize64)
+		var dd [dataDescriptor64Len]byte
+		n, err := f.zipr.ReadAt(dd[:], off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		db := readBuf(dd[:n])
+		if len(db) >= 4 && binary.LittleEndian.Uint32(db) == dataDescriptorSignature {
+			db = db[4:]
+		}
+		// The writer uses 8 byte sizes exactly when the entry needs zip64,
+		// but other writers differ: either width is accepted if its
+		// values agree with the central directory, and the mismatches of
+		// the expected one are reported otherwise.
+		widths := []int{4, 8}
+		if f.isZip64() {
+			widths = []int{8, 4}
+		}
+		var fields [3]uint64 // crc32, compressed size, uncompressed size
+		found := false
+		for _, sizeLen := range widths {
+			if len(db) < 4+2*sizeLen {
+				continue
+			}
+			b := db
+			v := [3]uint64{uint64(b.uint32())}
+			if sizeLen == 8 {
+				v[1], v[2] = b.uint64(), b.uint64()
+			} else {
+				v[1], v[2] = uint64(b.uint32()), uint64(b.uint32())
+			}
+			if !found {
+				fields, found = v, true
+			}
+			if v == [3]uint64{uint64(f.CRC32), f.CompressedSize64, f.UncompressedSize64} {
+				fields = v
+				break
+			}
+		}
+		if !found {
+			return ErrFormat
+		}
+		check("data descriptor crc32", fields[0], uint64(f.CRC32))
+		check("data descriptor compressed size", fields[1], f.CompressedSize64)
+		check("data descriptor uncompressed size", fields[2], f.UncompressedSize64)
+	}
+
+	if len(herr.Mismatches) > 0 {
+		return herr
+	}
+	return nil
 }
 
 // readDirectoryHeader attempts to read a directory header from r.
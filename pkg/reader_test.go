@@ -8,14 +8,26 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/gdme1320/zip/pkg/internal/deflate64"
+	"github.com/ulikunitz/xz/lzma"
 )
 
 type ZipTest struct {
@@ -605,3 +617,731 @@ func TestIssue11146(t *testing.T) {
 	}
 	r.Close()
 }
+
+func TestCheckHeaders(t *testing.T) {
+	for _, name := range []string{"test.zip", "dd.zip", "go-with-datadesc-sig.zip", "go-no-datadesc-sig.zip", "crc32-not-streamed.zip", "zip64.zip", "zip64-2.zip", "hello-aes.zip", "winxp.zip"} {
+		r, err := OpenReader(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range r.File {
+			if err := f.CheckHeaders(); err != nil {
+				t.Errorf("%s: %s: %v", name, f.Name, err)
+			}
+		}
+		r.Close()
+	}
+
+	// Only the local header crc32 of foo.txt is corrupted; the
+	// TOC value is intact.
+	zr, size := messWith("crc32-not-streamed.zip", func(b []byte) { b[0x11]++ })
+	r, err := NewReader(zr, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.File[0].CheckHeaders()
+	herr, ok := err.(*HeaderError)
+	if !ok || len(herr.Mismatches) != 1 || herr.Mismatches[0].Field != "crc32" {
+		t.Fatalf("local crc32 corruption: got %v", err)
+	}
+	if err := r.File[1].CheckHeaders(); err != nil {
+		t.Errorf("bar.txt: %v", err)
+	}
+
+	// Corrupt the crc32 stored in the data descriptor.
+	zr, size = returnCorruptCRC32Zip()
+	r, err = NewReader(zr, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.File[0].CheckHeaders()
+	if herr, ok := err.(*HeaderError); !ok || herr.Mismatches[0].Field != "data descriptor crc32" {
+		t.Errorf("data descriptor corruption: got %v", err)
+	}
+}
+
+func TestCheckHeadersDataDescriptor64(t *testing.T) {
+	// Some writers use 8 byte sizes in the data descriptor of entries
+	// that do not need zip64.
+	data := []byte("hello")
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	fw, err := w.CreateHeader(&FileHeader{Name: "hello.txt", Method: Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	off := fileHeaderLen + len("hello.txt") + len(data)
+	if binary.LittleEndian.Uint32(b[off:]) != dataDescriptorSignature {
+		t.Fatal("no data descriptor")
+	}
+	dd := make([]byte, dataDescriptor64Len)
+	wb := writeBuf(dd)
+	wb.uint32(dataDescriptorSignature)
+	wb.uint32(crc32.ChecksumIEEE(data))
+	wb.uint64(uint64(len(data)))
+	wb.uint64(uint64(len(data)))
+	b = append(append(append([]byte(nil), b[:off]...), dd...), b[off+dataDescriptorLen:]...)
+	eocd := b[len(b)-directoryEndLen:]
+	binary.LittleEndian.PutUint32(eocd[16:], binary.LittleEndian.Uint32(eocd[16:])+dataDescriptor64Len-dataDescriptorLen)
+
+	r, err := NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.File[0].CheckHeaders(); err != nil {
+		t.Error(err)
+	}
+	if got := readAll(t, r.File[0]); !bytes.Equal(got, data) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCheckHeadersWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	for _, wt := range writeTests {
+		f, err := w.Create(wt.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(wt.Data)
+	}
+	ew, err := w.Encrypt("secret", password, AES256Encryption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ew.Write([]byte("secret data"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File {
+		if err := f.CheckHeaders(); err != nil {
+			t.Errorf("%s: %v", f.Name, err)
+		}
+	}
+}
+
+// testdata/deflate64.zip was generated offline by a small Deflate64
+// encoder and checked with Info-ZIP unzip. Its single entry consists of
+// a stored block, a dynamic block using all 32 distance codes and a
+// fixed block:
+//
+//	[0, 50000)       random bytes
+//	[50000, 55000)   copy of [0, 5000), distance 50000 (code 31)
+//	[55000, 55300)   copy at distance 40000 (code 30), length 300 (code 285)
+//	[55300, 120839)  'A' repeated, 65538 of them copied at distance 1
+//	120839           'Z'
+func TestDeflate64(t *testing.T) {
+	r, err := OpenReader("testdata/deflate64.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	f := r.File[0]
+	if f.Method != Deflate64 {
+		t.Fatalf("method %d, want %d", f.Method, Deflate64)
+	}
+	b := readAll(t, f) // checks size and CRC-32
+	if len(b) != 120840 {
+		t.Fatalf("got %d bytes", len(b))
+	}
+	if !bytes.Equal(b[50000:55000], b[:5000]) {
+		t.Error("distance code 31 copy mismatch")
+	}
+	if !bytes.Equal(b[55000:55300], b[15000:15300]) {
+		t.Error("distance code 30 copy mismatch")
+	}
+	if want := append(bytes.Repeat([]byte("A"), 65539), 'Z'); !bytes.Equal(b[55300:], want) {
+		t.Error("length code 285 copy mismatch")
+	}
+
+	// a truncated stream must fail rather than return short data
+	raw, err := f.OpenRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(raw)
+	rc := decompressor(Deflate64)(bytes.NewReader(data[:len(data)/2]))
+	if _, err := ioutil.ReadAll(rc); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated stream: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestBzip2(t *testing.T) {
+	r, err := OpenReader("testdata/bzip2.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	f := r.File[0]
+	if f.Method != Bzip2 {
+		t.Fatalf("method %d, want %d", f.Method, Bzip2)
+	}
+	b := readAll(t, f) // checks size and CRC-32
+	if !bytes.HasPrefix(b, []byte("0 bottles of beer on the wall\n")) || len(b) != 64890 {
+		t.Errorf("got %d bytes starting with %q", len(b), b[:min(len(b), 30)])
+	}
+}
+
+func TestLZMAKnownSize(t *testing.T) {
+	// an LZMA stream without an end of stream marker, as written by
+	// tools that know the size in advance, so without flag bit 1
+	data := bytes.Repeat([]byte("Rabbits, guinea pigs, gophers, marsupial rats, and quolls. "), 100)
+	var comp bytes.Buffer
+	lw, err := lzma.WriterConfig{Size: int64(len(data))}.NewWriter(&comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lw.Write(data)
+	if err := lw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	classic := comp.Bytes()
+	raw := append([]byte{9, 20, 5, 0}, classic[:5]...)
+	raw = append(raw, classic[lzma.HeaderLen:]...)
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	fh := &FileHeader{
+		Name:               "known",
+		Method:             LZMA,
+		CRC32:              crc32.ChecksumIEEE(data),
+		CompressedSize64:   uint64(len(raw)),
+		UncompressedSize64: uint64(len(data)),
+	}
+	fw, err := w.CreateRaw(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(raw)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := r.File[0]
+	if f.Flags&lzmaEOSFlag != 0 {
+		t.Fatalf("flags %#x: EOS marker bit set", f.Flags)
+	}
+	if got := readAll(t, f); !bytes.Equal(got, data) {
+		t.Error("content mismatch")
+	}
+}
+
+func TestLegacyMethods(t *testing.T) {
+	// testdata/legacy.zip holds the same 73502 bytes shrunk, reduced
+	// with each compression factor and imploded with either window and
+	// either number of trees.
+	r, err := OpenReader("testdata/legacy.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.File) != 9 {
+		t.Fatalf("got %d files, want 9", len(r.File))
+	}
+	var want []byte
+	for _, f := range r.File {
+		b := readAll(t, f) // checks size and CRC-32
+		if want == nil {
+			want = b
+		} else if !bytes.Equal(b, want) {
+			t.Errorf("%s (method %d): content mismatch", f.Name, f.Method)
+		}
+	}
+	if len(want) != 73502 {
+		t.Errorf("got %d bytes", len(want))
+	}
+
+	// a truncated stream must fail rather than return short data
+	for _, f := range r.File {
+		raw, err := f.OpenRaw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(raw)
+		e := &entryReader{
+			Reader: bytes.NewReader(data[:len(data)/2]),
+			method: f.Method,
+			flags:  f.Flags,
+			size:   f.UncompressedSize64,
+		}
+		rc := decompressor(f.Method)(e)
+		if _, err := ioutil.ReadAll(rc); err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: truncated stream: got %v, want %v", f.Name, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestPPMd(t *testing.T) {
+	// testdata/ppmd.zip holds the text of bzip2.zip compressed with model
+	// order 6 and 16 MiB of model memory, 7-Zip's defaults. libarchive
+	// extracts it with a matching CRC-32.
+	r, err := OpenReader("testdata/ppmd.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	f := r.File[0]
+	if f.Method != PPMd {
+		t.Fatalf("method %d, want %d", f.Method, PPMd)
+	}
+	b := readAll(t, f) // checks size and CRC-32
+	if !bytes.HasPrefix(b, []byte("0 bottles of beer on the wall\n")) || len(b) != 64890 {
+		t.Errorf("got %d bytes starting with %q", len(b), b[:min(len(b), 30)])
+	}
+
+	r.RegisterDecompressor(PPMd, PPMdDecompressor(8<<20))
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(rc); !errors.Is(err, ErrMemoryLimit) {
+		t.Errorf("8 MiB limit: got %v, want %v", err, ErrMemoryLimit)
+	}
+}
+
+func TestCheckContainer(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	for _, name := range []string{"mimetype", "content.xml", "META-INF/manifest.xml"} {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("application/vnd.oasis.opendocument.text"))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.CheckContainer(ODF)
+	cerr, ok := err.(*ContainerError)
+	if !ok {
+		t.Fatalf("got %v, want a ContainerError", err)
+	}
+	want := []string{"mimetype is compressed", "mimetype has a data descriptor"}
+	if !reflect.DeepEqual(cerr.Violations, want) {
+		t.Errorf("got violations %q, want %q", cerr.Violations, want)
+	}
+
+	z, err := OpenReader("testdata/test.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	err = z.CheckContainer(EPUB)
+	if cerr, ok := err.(*ContainerError); !ok || cerr.Violations[0] != "first entry is not mimetype" {
+		t.Errorf("test.zip: got %v", err)
+	}
+}
+
+func TestOpenSeeker(t *testing.T) {
+	// words from a fixed generator, for data that deflates into many blocks
+	words := strings.Fields("the quick brown fox jumps over a lazy dog while gophers dig burrows under quiet fields")
+	var data []byte
+	x := uint32(1)
+	for len(data) < 3<<20 {
+		x = x*1664525 + 1013904223
+		data = append(data, words[x>>24%uint32(len(words))]...)
+		data = append(data, " \n"[x>>16&1])
+		if x>>8&0xff == 0 {
+			data = binary.LittleEndian.AppendUint32(data, x)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	entries := []struct {
+		name   string
+		method uint16
+		enc    EncryptionMethod
+	}{
+		{"store", Store, 0},
+		{"deflate", Deflate, 0},
+		{"aes-store", Store, AES256Encryption},
+		{"aes-deflate", Deflate, AES128Encryption},
+		{"zipcrypto", Deflate, StandardEncryption},
+	}
+	for _, e := range entries {
+		fh := &FileHeader{Name: e.name, Method: e.method}
+		if e.enc != 0 {
+			fh.SetPassword([]byte("golang"))
+			fh.SetEncryptionMethod(e.enc)
+		}
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offsets := []int64{0, 1, 900 << 10, 5, 3 << 20, 2<<20 + 12345, int64(len(data)) - 7, 1 << 20}
+	check := func(f *File) {
+		t.Helper()
+		r, err := f.OpenSeeker()
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		defer r.Close()
+		if r.Size() != int64(len(data)) {
+			t.Errorf("%s: size %d, want %d", f.Name, r.Size(), len(data))
+		}
+		p := make([]byte, 1000)
+		for _, off := range offsets {
+			n, err := r.ReadAt(p, off)
+			want := data[off:min(off+1000, int64(len(data)))]
+			if !bytes.Equal(p[:n], want) || n < len(p) && err != io.EOF {
+				t.Errorf("%s: ReadAt(%d) = %d, %v", f.Name, off, n, err)
+			}
+		}
+		if _, err := r.Seek(-100, io.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := io.ReadAll(r); err != nil || !bytes.Equal(b, data[len(data)-100:]) {
+			t.Errorf("%s: read to end: %d bytes, %v", f.Name, len(b), err)
+		}
+		if n, err := r.ReadAt(p, int64(len(data))); n != 0 || err != io.EOF {
+			t.Errorf("%s: ReadAt end = %d, %v", f.Name, n, err)
+		}
+	}
+	for _, f := range zr.File {
+		if f.IsEncrypted() {
+			f.SetPassword([]byte("golang"))
+		}
+		check(f)
+	}
+
+	// index the Deflate entry on a first pass, then reload it
+	f := zr.File[1]
+	if err := zr.File[0].SetSeekIndex(NewSeekIndex(0)); err == nil {
+		t.Error("seek index accepted for a stored entry")
+	}
+	if err := zr.File[4].SetSeekIndex(NewSeekIndex(0)); err == nil {
+		t.Error("seek index accepted for a ZipCrypto entry")
+	}
+	idx := NewSeekIndex(256 << 10)
+	if err := f.SetSeekIndex(idx); err != nil {
+		t.Fatal(err)
+	}
+	r, err := f.OpenSeeker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(r); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("first pass: %d bytes, %v", len(b), err)
+	}
+	r.Close()
+	if n := idx.Len(); n < 8 || n > 12 {
+		t.Errorf("%d checkpoints, want about 12", n)
+	}
+	saved, err := idx.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx = new(SeekIndex)
+	if err := idx.UnmarshalBinary(saved); err != nil {
+		t.Fatal(err)
+	}
+	if err := zr.File[3].SetSeekIndex(idx); err == nil {
+		t.Error("seek index accepted for another entry")
+	}
+	if err := f.SetSeekIndex(idx); err != nil {
+		t.Fatal(err)
+	}
+	check(f)
+	if err := idx.UnmarshalBinary(saved[:len(saved)-1]); err == nil {
+		t.Error("truncated index accepted")
+	}
+	for _, method := range []uint16{Deflate, Deflate64} {
+		big := &SeekIndex{span: 1, bound: true, method: method, csize: 1, usize: 1,
+			points: []*deflate64.Checkpoint{{Out: 1, Window: make([]byte, 40<<10)}}}
+		b, err := big.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := new(SeekIndex).UnmarshalBinary(b); (err == nil) != (method == Deflate64) {
+			t.Errorf("method %d: 40 KiB window: %v", method, err)
+		}
+	}
+
+	// Deflate64 from every block boundary
+	z, err := OpenReader("testdata/deflate64.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	f = z.File[0]
+	want := readAll(t, f)
+	idx = NewSeekIndex(1)
+	if err := f.SetSeekIndex(idx); err != nil {
+		t.Fatal(err)
+	}
+	r, err = f.OpenSeeker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	io.Copy(io.Discard, r)
+	if idx.Len() != 2 {
+		t.Errorf("%d checkpoints, want 2", idx.Len())
+	}
+	p := make([]byte, 10000)
+	for _, off := range []int64{110000, 50000, 55200, 0} {
+		n, _ := r.ReadAt(p, off)
+		if !bytes.Equal(p[:n], want[off:min(off+10000, int64(len(want)))]) {
+			t.Errorf("deflate64: ReadAt(%d) mismatch", off)
+		}
+	}
+}
+
+func TestHTTPReaderAt(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	var contents [][]byte
+	for i := 0; i < 20; i++ {
+		fw, err := w.CreateHeader(&FileHeader{Name: fmt.Sprintf("file%02d", i), Method: Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := bytes.Repeat([]byte{byte(i)}, 100<<10)
+		binary.LittleEndian.PutUint32(b[1000:], uint32(i))
+		fw.Write(b)
+		contents = append(contents, b)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	var requests, inFlight, maxInFlight atomic.Int64
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for m := maxInFlight.Load(); n > m && !maxInFlight.CompareAndSwap(m, n); m = maxInFlight.Load() {
+		}
+		time.Sleep(time.Millisecond)
+		w.Header().Set("ETag", etag.Load().(string))
+		http.ServeContent(w, req, "a.zip", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	opts := &HTTPOptions{BlockSize: 64 << 10, CacheBlocks: 8, ReadAhead: 16 << 10, Concurrency: 2}
+	z, err := OpenHTTPReader(srv.URL+"/a.zip", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(z.File) != 20 {
+		t.Fatalf("%d files, want 20", len(z.File))
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("opening took %d requests, want 1", n)
+	}
+	requests.Store(0)
+	if got := readAll(t, z.File[7]); !bytes.Equal(got, contents[7]) {
+		t.Error("file07: content mismatch")
+	}
+	if n := requests.Load(); n > 3 {
+		t.Errorf("reading one entry took %d requests, want one per block", n)
+	}
+
+	var wg sync.WaitGroup
+	for i, f := range z.File {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rc, err := f.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer rc.Close()
+			if got, err := io.ReadAll(rc); err != nil || !bytes.Equal(got, contents[i]) {
+				t.Errorf("%s: %d bytes, %v", f.Name, len(got), err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := maxInFlight.Load(); n > 2 {
+		t.Errorf("%d requests in flight, want at most 2", n)
+	}
+
+	// a replaced file fails rather than mixes versions
+	ra, err := NewHTTPReaderAt(srv.URL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra.Size() != int64(len(data)) {
+		t.Errorf("size %d, want %d", ra.Size(), len(data))
+	}
+	etag.Store(`"v2"`)
+	if _, err := ra.ReadAt(make([]byte, 10), 0); err == nil {
+		t.Error("read a replaced file")
+	}
+
+	noRange := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(data)
+	}))
+	defer noRange.Close()
+	if _, err := OpenHTTPReader(noRange.URL, opts); err == nil {
+		t.Error("opened an archive without range support")
+	}
+}
+
+// countingReaderAt counts the reads at each offset.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	mu    sync.Mutex
+	reads map[int64]int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	c.reads[off]++
+	c.mu.Unlock()
+	return c.r.ReadAt(p, off)
+}
+
+func TestOpenReaderOptions(t *testing.T) {
+	const name = "testdata/go-with-datadesc-sig.zip"
+	want := map[string][]byte{}
+	z, err := OpenReader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range z.File {
+		want[f.Name] = readAll(t, f)
+	}
+	z.Close()
+
+	for _, opts := range []*ReaderOptions{
+		{Mmap: true},
+		{BlockSize: 16, CacheBlocks: 2},
+		{BlockSize: 1 << 20},
+	} {
+		z, err := OpenReaderOptions(name, opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		if opts.Mmap && runtime.GOOS == "linux" && z.mapped == nil {
+			t.Error("archive not mapped")
+		}
+		if len(z.File) != len(want) {
+			t.Errorf("%+v: %d files, want %d", opts, len(z.File), len(want))
+		}
+		for _, f := range z.File {
+			if got := readAll(t, f); !bytes.Equal(got, want[f.Name]) {
+				t.Errorf("%+v: %s: content mismatch", opts, f.Name)
+			}
+		}
+		if err := z.Close(); err != nil {
+			t.Errorf("%+v: Close: %v", opts, err)
+		}
+	}
+}
+
+func TestCachedReaderAt(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &countingReaderAt{r: bytes.NewReader(data), reads: map[int64]int{}}
+	ra := NewCachedReaderAt(c, int64(len(data)), 4096, 0)
+	z, err := NewReader(ra, ra.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		for _, f := range z.File {
+			readAll(t, f)
+		}
+	}
+	for off, n := range c.reads {
+		if off%4096 != 0 || n != 1 {
+			t.Errorf("%d reads at %d, want one per block", n, off)
+		}
+	}
+	p := make([]byte, 100)
+	if n, err := ra.ReadAt(p, int64(len(data))-10); n != 10 || err != io.EOF || !bytes.Equal(p[:n], data[len(data)-10:]) {
+		t.Errorf("ReadAt past the end = %d, %v", n, err)
+	}
+
+	// local headers are read once
+	c = &countingReaderAt{r: bytes.NewReader(data), reads: map[int64]int{}}
+	z, err = NewReader(c, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := z.File[0]
+	for i := 0; i < 3; i++ {
+		readAll(t, f)
+	}
+	if n := c.reads[f.headerOffset]; n != 1 {
+		t.Errorf("local header read %d times, want 1", n)
+	}
+}
+
+func TestCachedReaderAtNested(t *testing.T) {
+	var inner bytes.Buffer
+	w := NewWriter(&inner)
+	fw, err := w.Create("inner.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, "nested archive")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var outer bytes.Buffer
+	w = NewWriter(&outer)
+	if fw, err = w.Create("inner.zip"); err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(inner.Bytes())
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := NewReader(bytes.NewReader(outer.Bytes()), int64(outer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := z.File[0].OpenSeeker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Close()
+	// sr reports EOF along with the last bytes of the entry
+	ra := NewCachedReaderAt(sr, sr.Size(), 0, 0)
+	zi, err := NewReader(ra, ra.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, zi.File[0]); string(got) != "nested archive" {
+		t.Errorf("got %q", got)
+	}
+}
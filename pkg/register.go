@@ -7,9 +7,12 @@ package zip
 import (
 	"compress/flate"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"sync"
+
+	"github.com/gdme1320/zip/pkg/internal/deflate64"
 )
 
 // A Compressor returns a compressing writer, writing to the
@@ -22,21 +25,48 @@ type Compressor func(io.Writer) (io.WriteCloser, error)
 // when they're finished reading.
 type Decompressor func(io.Reader) io.ReadCloser
 
-var flateWriterPool sync.Pool
+// defaultFlateLevel is the deflate level used unless Writer.SetLevel
+// selects another one.
+const defaultFlateLevel = 5
+
+// ErrRegistered is returned by TryRegisterCompressor and
+// TryRegisterDecompressor for a method that already has one.
+var ErrRegistered = errors.New("zip: method already registered")
+
+// flateWriterPools holds one pool per level, from flate.HuffmanOnly to
+// flate.BestCompression, as a flate.Writer cannot change its level.
+var flateWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
 
-func newFlateWriter(w io.Writer) io.WriteCloser {
-	fw, ok := flateWriterPool.Get().(*flate.Writer)
+func newFlateWriter(w io.Writer, level int) io.WriteCloser {
+	pool := &flateWriterPools[level-flate.HuffmanOnly]
+	fw, ok := pool.Get().(*flate.Writer)
 	if ok {
 		fw.Reset(w)
 	} else {
-		fw, _ = flate.NewWriter(w, 5)
+		fw, _ = flate.NewWriter(w, level)
+	}
+	return &pooledFlateWriter{fw: fw, pool: pool}
+}
+
+// flateCompressor returns a Deflate Compressor using the given level.
+func flateCompressor(level int) Compressor {
+	return func(w io.Writer) (io.WriteCloser, error) {
+		return newFlateWriter(w, level), nil
 	}
-	return &pooledFlateWriter{fw: fw}
+}
+
+// checkFlateLevel reports an error for levels flate does not support.
+func checkFlateLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("zip: invalid compression level: %d", level)
+	}
+	return nil
 }
 
 type pooledFlateWriter struct {
-	mu sync.Mutex // guards Close and Write
-	fw *flate.Writer
+	mu   sync.Mutex // guards Close and Write
+	fw   *flate.Writer
+	pool *sync.Pool
 }
 
 func (w *pooledFlateWriter) Write(p []byte) (n int, err error) {
@@ -54,7 +84,7 @@ func (w *pooledFlateWriter) Close() error {
 	var err error
 	if w.fw != nil {
 		err = w.fw.Close()
-		flateWriterPool.Put(w.fw)
+		w.pool.Put(w.fw)
 		w.fw = nil
 	}
 	return err
@@ -65,36 +95,80 @@ var (
 
 	compressors = map[uint16]Compressor{
 		Store:   func(w io.Writer) (io.WriteCloser, error) { return &nopCloser{w}, nil },
-		Deflate: func(w io.Writer) (io.WriteCloser, error) { return newFlateWriter(w), nil },
+		Deflate: flateCompressor(defaultFlateLevel),
+		Zstd:    zstdCompressor(defaultFlateLevel),
+		LZMA:    lzmaCompressor,
+		XZ:      xzCompressor,
+	}
+
+	// leveledCompressors build the built-in compressors that support
+	// compression levels.
+	leveledCompressors = map[uint16]func(level int) Compressor{
+		Deflate: flateCompressor,
+		Zstd:    zstdCompressor,
 	}
 
 	decompressors = map[uint16]Decompressor{
-		Store:   ioutil.NopCloser,
-		Deflate: flate.NewReader,
+		Store:     ioutil.NopCloser,
+		Shrink:    newShrinkReader,
+		Reduce1:   newReduceReader,
+		Reduce2:   newReduceReader,
+		Reduce3:   newReduceReader,
+		Reduce4:   newReduceReader,
+		Implode:   newImplodeReader,
+		Deflate:   flate.NewReader,
+		Deflate64: deflate64.NewReader,
+		Bzip2:     newBzip2Reader,
+		LZMA:      newLZMAReader,
+		Zstd:      newZstdReader,
+		XZ:        newXZReader,
+		PPMd:      PPMdDecompressor(DefaultPPMdMemory),
 	}
 )
 
 // RegisterDecompressor allows custom decompressors for a specified method ID.
+// It panics if the method already has a decompressor; see
+// TryRegisterDecompressor and Reader.RegisterDecompressor.
 func RegisterDecompressor(method uint16, d Decompressor) {
+	if err := TryRegisterDecompressor(method, d); err != nil {
+		panic("decompressor already registered")
+	}
+}
+
+// TryRegisterDecompressor is like RegisterDecompressor but returns
+// ErrRegistered instead of panicking.
+func TryRegisterDecompressor(method uint16, d Decompressor) error {
 	mu.Lock()
 	defer mu.Unlock()
 
 	if _, ok := decompressors[method]; ok {
-		panic("decompressor already registered")
+		return ErrRegistered
 	}
 	decompressors[method] = d
+	return nil
 }
 
 // RegisterCompressor registers custom compressors for a specified method ID.
 // The common methods Store and Deflate are built in.
+// It panics if the method already has a compressor; see
+// TryRegisterCompressor and Writer.RegisterCompressor.
 func RegisterCompressor(method uint16, comp Compressor) {
+	if err := TryRegisterCompressor(method, comp); err != nil {
+		panic("compressor already registered")
+	}
+}
+
+// TryRegisterCompressor is like RegisterCompressor but returns
+// ErrRegistered instead of panicking.
+func TryRegisterCompressor(method uint16, comp Compressor) error {
 	mu.Lock()
 	defer mu.Unlock()
 
 	if _, ok := compressors[method]; ok {
-		panic("compressor already registered")
+		return ErrRegistered
 	}
 	compressors[method] = comp
+	return nil
 }
 
 func compressor(method uint16) Compressor {
@@ -0,0 +1,106 @@
+package zip
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ReproducibleOptions configures Writer.SetReproducible.
+type ReproducibleOptions struct {
+	// ModTime is the latest modification time written: later times are
+	// clamped to it. If zero, the time in the SOURCE_DATE_EPOCH
+	// environment variable is used, and without it 1980-01-01, the
+	// earliest time the MS-DOS fields can hold.
+	ModTime time.Time
+
+	// Rand, if non-nil, supplies the salts of AES encrypted entries,
+	// making them reproducible too. It is meant for test builds: reusing
+	// salts across archives weakens the encryption. If nil, AES
+	// encryption is refused.
+	Rand io.Reader
+}
+
+// Extra fields holding host specific data, dropped in reproducible mode.
+const (
+	ntfsExtraId    = 0x000a // NTFS times
+	extTimeExtraId = 0x5455 // extended timestamp
+	unixExtraId    = 0x7875 // Info-ZIP Unix UID/GID
+)
+
+var errNotReproducible = errors.New("zip: AES encryption is not reproducible without ReproducibleOptions.Rand")
+
+// SetReproducible makes w write the same bytes for the same input on
+// any machine. Entries created after the call get their modification
+// time clamped to opts.ModTime, their mode normalized to 0644, 0755
+// for directories and executable files, or 0777 for symbolic links,
+// and a Unix creator with zip version 2.0. Extra fields holding host
+// times or user and group IDs are dropped. AddFS and AddDir add their
+// entries sorted by name; entries created directly keep the order of
+// the calls.
+//
+// Entries copied with their StandardEncryption data keep their
+// modification time, which the password check may depend on. A nil
+// opts uses the zero ReproducibleOptions.
+func (w *Writer) SetReproducible(opts *ReproducibleOptions) error {
+	if opts == nil {
+		opts = &ReproducibleOptions{}
+	}
+	t := opts.ModTime
+	if t.IsZero() {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+		if s := os.Getenv("SOURCE_DATE_EPOCH"); s != "" {
+			sec, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return fmt.Errorf("zip: invalid SOURCE_DATE_EPOCH %q", s)
+			}
+			t = time.Unix(sec, 0)
+		}
+	}
+	w.reproducible = &ReproducibleOptions{ModTime: t, Rand: opts.Rand}
+	return nil
+}
+
+// normalize rewrites the host specific fields of fh in reproducible
+// mode.
+func (w *Writer) normalize(fh *FileHeader) {
+	opts := w.reproducible
+	if opts == nil {
+		return
+	}
+	copied := fh.IsEncrypted() && fh.ae == 0 && fh.password == nil
+	if !copied && fh.ModTime().After(opts.ModTime) {
+		fh.SetModTime(opts.ModTime)
+	}
+	mode := fh.Mode()
+	switch {
+	case mode&os.ModeDir != 0:
+		mode = os.ModeDir | 0755
+	case mode&os.ModeSymlink != 0:
+		mode = os.ModeSymlink | 0777
+	case mode&0111 != 0:
+		mode = 0755
+	default:
+		mode = 0644
+	}
+	fh.SetMode(mode)
+	fh.CreatorVersion = creatorUnix<<8 | zipVersion20
+	for _, id := range []uint16{ntfsExtraId, extTimeExtraId, unixExtraId} {
+		fh.Extra = removeExtra(fh.Extra, id)
+	}
+}
+
+// saltReader returns the source of AES salts.
+func (w *Writer) saltReader() (io.Reader, error) {
+	switch {
+	case w.reproducible == nil:
+		return rand.Reader, nil
+	case w.reproducible.Rand == nil:
+		return nil, errNotReproducible
+	}
+	return w.reproducible.Rand, nil
+}
@@ -0,0 +1,235 @@
+package zip
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// RewriteFunc is called by Rewrite for each entry of an archive with a
+// copy of its header. It may change the header, for example to rename
+// the entry, and returns false to drop the entry. The compressed and
+// encrypted data of the entry cannot be changed.
+type RewriteFunc func(f *File, fh *FileHeader) (keep bool, err error)
+
+// Rewrite copies the entries of r that fn keeps to w without
+// decompressing or decrypting them. The archive comment is not copied.
+func Rewrite(w *Writer, r *Reader, fn RewriteFunc) error {
+	for _, f := range r.File {
+		fh := f.FileHeader
+		fh.Extra = append([]byte(nil), f.Extra...)
+		keep, err := fn(f, &fh)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			continue
+		}
+		data, err := f.OpenRaw()
+		if err != nil {
+			return err
+		}
+		if err := w.copyAs(&fh, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RewriteFile rewrites the named archive with Rewrite, keeping its
+// comment and permissions. The new archive is written to a temporary
+// file in the same directory, which then replaces the original, so the
+// original is left untouched if anything fails.
+func RewriteFile(name string, fn RewriteFunc) error {
+	return rewriteFile(name, func(w *Writer, r *Reader) error {
+		return Rewrite(w, r, fn)
+	})
+}
+
+// ReencryptFile replaces the encryption of every entry of the named
+// archive as Writer.Reencrypt does. oldPassword is used for the entries
+// that are encrypted. Like RewriteFile, the original is only replaced
+// once the new archive is complete.
+func ReencryptFile(name string, oldPassword, password []byte, enc EncryptionMethod) error {
+	return rewriteFile(name, func(w *Writer, r *Reader) error {
+		for _, f := range r.File {
+			if f.IsEncrypted() {
+				f.SetPassword(oldPassword)
+				// a failed authentication discards the new archive anyway
+				f.DeferAuth = true
+			}
+			if err := w.Reencrypt(f, password, enc); err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+func rewriteFile(name string, rewrite func(w *Writer, r *Reader) error) error {
+	r, err := OpenReader(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	fi, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly after the rename
+	defer tmp.Close()
+
+	w := NewWriter(tmp)
+	if err := w.SetComment(r.Comment); err != nil {
+		return err
+	}
+	if err := rewrite(w, &r.Reader); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	r.Close()
+	return os.Rename(tmp.Name(), name)
+}
+
+// Reencrypt copies f into w with its encryption replaced: the data is
+// decrypted with the password set on f and encrypted again with
+// password and enc, or stored unencrypted if password is nil. The
+// compressed data itself is kept as is. Directories are copied
+// unencrypted.
+//
+// AES entries keep their CRC-32 as AE-1 when it is known. Entries
+// smaller than 20 bytes, whose CRC-32 would reveal too much of the
+// content, and entries whose source is AE-2 become AE-2 without a
+// CRC-32. Converting an AE-2 entry to ZipCrypto or no encryption
+// requires decompressing it once to compute its CRC-32.
+func (w *Writer) Reencrypt(f *File, password []byte, enc EncryptionMethod) error {
+	if f.FileInfo().IsDir() {
+		password = nil // directories hold no data to protect
+	}
+	if password != nil && enc == 0 {
+		enc = AES256Encryption
+	}
+	fh := f.FileHeader
+	fh.Extra = removeExtra(f.Extra, winzipAesExtraId)
+	fh.Flags = fh.Flags&^0x1 | 0x8 // the data descriptor keeps the ZipCrypto check independent of the CRC
+	fh.ae, fh.aesStrength, fh.encryption, fh.password = 0, 0, 0, nil
+
+	crcKnown := f.ae != 2
+	aes := password != nil && enc != StandardEncryption
+	if aes {
+		fh.SetPassword(password)
+		fh.SetEncryptionMethod(enc)
+		fh.ae = 2
+		if crcKnown && fh.UncompressedSize64 >= 20 {
+			fh.ae = 1
+		} else {
+			fh.CRC32 = 0
+		}
+		fh.writeWinZipExtra()
+	} else {
+		if password != nil {
+			fh.SetPassword(password)
+			fh.SetEncryptionMethod(enc)
+		}
+		if !crcKnown {
+			crc, err := fileCRC(f)
+			if err != nil {
+				return err
+			}
+			fh.CRC32 = crc
+		}
+	}
+
+	bodyOffset, err := f.findBodyOffset()
+	if err != nil {
+		return err
+	}
+	data, err := f.openDecrypted(bodyOffset)
+	if err != nil {
+		return err
+	}
+	// empty ZipCrypto entries of older archives lack the header
+	size := f.CompressedSize64 - min(encryptionOverhead(&f.FileHeader), f.CompressedSize64)
+	fh.CompressedSize64 = size + encryptionOverhead(&fh)
+
+	if _, err := w.CreateRaw(&fh); err != nil {
+		return err
+	}
+	fw := w.last
+	var dst io.Writer = fw
+	switch {
+	case aes:
+		var rnd io.Reader
+		if rnd, err = w.saltReader(); err == nil {
+			dst, err = newEncryptionWriter(fw, fh.password, fw, fh.aesStrength, rnd)
+		}
+	case password != nil:
+		dst, err = ZipCryptoEncryptor(fw, fh.password, fw)
+	}
+	if err != nil {
+		return err
+	}
+	if dst != io.Writer(fw) {
+		// write the encryption header even if there is no data
+		if _, err := dst.Write(nil); err != nil {
+			return err
+		}
+	}
+	n, err := io.Copy(dst, data)
+	if err != nil {
+		return err
+	}
+	if uint64(n) != size {
+		return io.ErrUnexpectedEOF
+	}
+	if aes {
+		if _, err := fw.Write(fw.hmac.Sum(nil)[:10]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptionOverhead returns the number of bytes encryption adds to
+// the compressed data of an entry.
+func encryptionOverhead(fh *FileHeader) uint64 {
+	switch {
+	case !fh.IsEncrypted():
+		return 0
+	case fh.ae == 0:
+		return 12 // ZipCrypto encryption header
+	}
+	return uint64(aesKeyLen(fh.aesStrength)/2) + 2 + 10 // salt, password verifier, authentication code
+}
+
+// fileCRC computes the CRC-32 of the decompressed data of f.
+func fileCRC(f *File) (uint32, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, rc); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
@@ -0,0 +1,372 @@
+package zip
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/gdme1320/zip/pkg/internal/deflate64"
+)
+
+// A SeekReader reads the contents of a File from any offset. It is
+// returned by File.OpenSeeker.
+//
+// The data of stored entries, encrypted with AES or not, is read in
+// place. Deflate and Deflate64 data is decompressed from the start, or
+// from the nearest checkpoint of the File's SeekIndex, up to the offset
+// asked for; reading forward continues where the previous read ended.
+// Other entries, including those with StandardEncryption, are reopened
+// and skipped through when seeking backwards.
+//
+// Unlike Open, a SeekReader verifies neither the CRC-32 nor the AES
+// authentication code of the data.
+type SeekReader struct {
+	size  int64
+	data  *io.SectionReader // contents of stored entries
+	open  func(cp *deflate64.Checkpoint) (io.ReadCloser, error)
+	index *SeekIndex
+
+	mu  sync.Mutex // guards the fields below, and reading from rc
+	off int64      // offset of Read
+	rc  io.ReadCloser
+	pos int64 // offset of rc
+}
+
+// OpenSeeker returns a SeekReader of the File's contents. The File's
+// SeekIndex, if any, is used and extended as the data is decompressed.
+func (f *File) OpenSeeker() (*SeekReader, error) {
+	r := &SeekReader{size: int64(f.UncompressedSize64), index: f.index}
+	if f.Method != Store && f.Method != Deflate && f.Method != Deflate64 || f.IsEncrypted() && f.ae == 0 {
+		r.open = func(*deflate64.Checkpoint) (io.ReadCloser, error) {
+			return f.Open()
+		}
+		return r, nil
+	}
+	bodyOffset, err := f.findBodyOffset()
+	if err != nil {
+		return nil, err
+	}
+	data := io.NewSectionReader(f.zipr, f.headerOffset+bodyOffset, int64(f.CompressedSize64))
+	if f.IsEncrypted() {
+		if data, err = newDecryptionReaderAt(data, f); err != nil {
+			return nil, err
+		}
+	}
+	if f.Method == Store {
+		r.data = io.NewSectionReader(data, 0, r.size)
+		return r, nil
+	}
+	opts := deflate64.Options{Deflate: f.Method == Deflate}
+	if x := r.index; x != nil {
+		opts.Span = x.span
+		opts.Checkpoint = x.add
+	}
+	r.open = func(cp *deflate64.Checkpoint) (io.ReadCloser, error) {
+		o := opts
+		o.Start = cp
+		var in int64
+		if cp != nil {
+			in = cp.In
+		}
+		return deflate64.NewReaderOptions(io.NewSectionReader(data, in, data.Size()-in), &o), nil
+	}
+	return r, nil
+}
+
+// Size returns the size of the File's contents.
+func (r *SeekReader) Size() int64 { return r.size }
+
+func (r *SeekReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, err := r.readAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *SeekReader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("zip: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("zip: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// ReadAt reads len(p) bytes at offset off. It does not affect the
+// offset of Read. Calls on compressed entries are serialized.
+func (r *SeekReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("zip: negative offset")
+	}
+	if r.data != nil {
+		return r.data.ReadAt(p, off)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.readAt(p, off)
+}
+
+// readAt reads from the decompressed data. r.mu must be held.
+func (r *SeekReader) readAt(p []byte, off int64) (int, error) {
+	if r.data != nil {
+		return r.data.ReadAt(p, off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if err := r.seek(off); err != nil {
+		r.reset()
+		return 0, err
+	}
+	if rest := r.size - off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := io.ReadFull(r.rc, p)
+	r.pos += int64(n)
+	switch {
+	case err == io.EOF:
+		err = io.ErrUnexpectedEOF
+	case err == nil && r.pos == r.size:
+		err = io.EOF
+	}
+	if err != nil && err != io.EOF {
+		r.reset()
+	}
+	return n, err
+}
+
+// seek positions r.rc at off, reopening the data at the nearest
+// checkpoint unless off lies ahead of r.rc with none in between.
+func (r *SeekReader) seek(off int64) error {
+	cp := r.index.point(off)
+	if r.rc == nil || off < r.pos || cp != nil && cp.Out > r.pos {
+		r.reset()
+		rc, err := r.open(cp)
+		if err != nil {
+			return err
+		}
+		r.rc, r.pos = rc, 0
+		if cp != nil {
+			r.pos = cp.Out
+		}
+	}
+	n, err := io.CopyN(io.Discard, r.rc, off-r.pos)
+	r.pos += n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// reset drops the decompressor, to be reopened on the next read.
+func (r *SeekReader) reset() {
+	if r.rc != nil {
+		r.rc.Close()
+		r.rc = nil
+	}
+}
+
+// Close releases the decompressor of r.
+func (r *SeekReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reset()
+	return nil
+}
+
+// A SeekIndex lists checkpoints in the Deflate or Deflate64 data of a
+// File, from which a SeekReader resumes decompressing instead of
+// starting over. It is built as the data is read, so a first pass
+// through the whole File, or through the parts of interest, makes later
+// seeks fast. Each checkpoint holds up to a window of data, 32 KiB for
+// Deflate and 64 KiB for Deflate64. An index may be saved with
+// MarshalBinary and reloaded with UnmarshalBinary, and is safe for
+// concurrent use.
+type SeekIndex struct {
+	span int64
+
+	mu     sync.Mutex
+	bound  bool // to the entry described by the fields below
+	method uint16
+	crc32  uint32
+	csize  uint64
+	usize  uint64
+	points []*deflate64.Checkpoint // in order of Out
+}
+
+const defaultSeekSpan = 1 << 20
+
+// NewSeekIndex returns an empty SeekIndex with checkpoints about span
+// bytes of decompressed data apart. If span is zero, 1 MiB is used.
+func NewSeekIndex(span int64) *SeekIndex {
+	if span <= 0 {
+		span = defaultSeekSpan
+	}
+	return &SeekIndex{span: span}
+}
+
+// Len returns the number of checkpoints in x.
+func (x *SeekIndex) Len() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return len(x.points)
+}
+
+// SetSeekIndex makes OpenSeeker use and extend x, which is bound to the
+// File the first time it is set. It returns an error if x was built for
+// a different entry, or if the File's data is not Deflate or Deflate64
+// readable at random, as with StandardEncryption.
+func (f *File) SetSeekIndex(x *SeekIndex) error {
+	if f.Method != Deflate && f.Method != Deflate64 || f.IsEncrypted() && f.ae == 0 {
+		return errors.New("zip: " + f.Name + ": no seek index for this entry")
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.bound {
+		x.bound = true
+		x.method, x.crc32 = f.Method, f.CRC32
+		x.csize, x.usize = f.CompressedSize64, f.UncompressedSize64
+	} else if x.method != f.Method || x.crc32 != f.CRC32 || x.csize != f.CompressedSize64 || x.usize != f.UncompressedSize64 {
+		return errors.New("zip: " + f.Name + ": seek index built for a different entry")
+	}
+	f.index = x
+	return nil
+}
+
+// add records cp if it lies at least span bytes past the last checkpoint.
+func (x *SeekIndex) add(cp *deflate64.Checkpoint) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	last := int64(0)
+	if n := len(x.points); n > 0 {
+		last = x.points[n-1].Out
+	}
+	if cp.Out-last >= x.span {
+		x.points = append(x.points, cp)
+	}
+}
+
+// point returns the last checkpoint at or before off, nil if there is
+// none. x may be nil.
+func (x *SeekIndex) point(off int64) *deflate64.Checkpoint {
+	if x == nil {
+		return nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	i := sort.Search(len(x.points), func(i int) bool { return x.points[i].Out > off })
+	if i == 0 {
+		return nil
+	}
+	return x.points[i-1]
+}
+
+const (
+	seekIndexMagic = "ZSX1"
+	seekIndexLen   = 4 + 8 + 2 + 4 + 8 + 8 + 4
+	seekPointLen   = 8 + 1 + 8 + 4
+)
+
+// seekWindow returns the size of the sliding window of method, the
+// most data a checkpoint holds.
+func seekWindow(method uint16) uint32 {
+	if method == Deflate64 {
+		return 64 << 10
+	}
+	return 32 << 10
+}
+
+var errSeekIndex = errors.New("zip: invalid seek index")
+
+// MarshalBinary encodes x, together with the entry it is bound to.
+func (x *SeekIndex) MarshalBinary() ([]byte, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	n := seekIndexLen
+	for _, cp := range x.points {
+		n += seekPointLen + len(cp.Window)
+	}
+	out := make([]byte, n)
+	copy(out, seekIndexMagic)
+	b := writeBuf(out[4:])
+	b.uint64(uint64(x.span))
+	b.uint16(x.method)
+	b.uint32(x.crc32)
+	b.uint64(x.csize)
+	b.uint64(x.usize)
+	b.uint32(uint32(len(x.points)))
+	for _, cp := range x.points {
+		b.uint64(uint64(cp.In))
+		b.uint8(cp.Bit)
+		b.uint64(uint64(cp.Out))
+		b.uint32(uint32(len(cp.Window)))
+		n := copy(b, cp.Window)
+		b = b[n:]
+	}
+	return out, nil
+}
+
+// UnmarshalBinary decodes an index encoded by MarshalBinary into x,
+// replacing its contents.
+func (x *SeekIndex) UnmarshalBinary(data []byte) error {
+	if len(data) < seekIndexLen || string(data[:4]) != seekIndexMagic {
+		return errSeekIndex
+	}
+	b := readBuf(data[4:])
+	y := SeekIndex{bound: true}
+	y.span = int64(b.uint64())
+	y.method = b.uint16()
+	y.crc32 = b.uint32()
+	y.csize = b.uint64()
+	y.usize = b.uint64()
+	count := b.uint32()
+	if y.span <= 0 || y.method != Deflate && y.method != Deflate64 {
+		return errSeekIndex
+	}
+	for i := uint32(0); i < count; i++ {
+		if len(b) < seekPointLen {
+			return errSeekIndex
+		}
+		cp := &deflate64.Checkpoint{
+			In:  int64(b.uint64()),
+			Bit: b.uint8(),
+			Out: int64(b.uint64()),
+		}
+		n := b.uint32()
+		prev := int64(0)
+		if len(y.points) > 0 {
+			prev = y.points[len(y.points)-1].Out
+		}
+		if cp.Bit > 7 || n > seekWindow(y.method) || uint64(n) > uint64(len(b)) ||
+			cp.In < 0 || uint64(cp.In) > y.csize || cp.Out <= prev || uint64(cp.Out) > y.usize {
+			return errSeekIndex
+		}
+		cp.Window = append([]byte(nil), b[:n]...)
+		b = b[n:]
+		y.points = append(y.points, cp)
+	}
+	if len(b) != 0 {
+		return errSeekIndex
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.span, x.bound = y.span, y.bound
+	x.method, x.crc32, x.csize, x.usize = y.method, y.crc32, y.csize, y.usize
+	x.points = y.points
+	return nil
+}
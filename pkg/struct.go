@@ -23,6 +23,7 @@ See: http://www.winzip.com/aes_info.htm
 package zip
 
 import (
+	"hash/crc32"
 	"os"
 	"path"
 	"time"
@@ -30,8 +31,20 @@ import (
 
 // Compression methods.
 const (
-	Store   uint16 = 0
-	Deflate uint16 = 8
+	Store     uint16 = 0
+	Shrink    uint16 = 1 // decompression only
+	Reduce1   uint16 = 2 // decompression only, as are Reduce2 to Reduce4
+	Reduce2   uint16 = 3
+	Reduce3   uint16 = 4
+	Reduce4   uint16 = 5
+	Implode   uint16 = 6 // decompression only
+	Deflate   uint16 = 8
+	Deflate64 uint16 = 9  // decompression only
+	Bzip2     uint16 = 12 // decompression only
+	LZMA      uint16 = 14
+	Zstd      uint16 = 93
+	XZ        uint16 = 95
+	PPMd      uint16 = 98 // decompression only
 )
 
 const (
@@ -59,6 +72,7 @@ const (
 	// version numbers
 	zipVersion20 = 20 // 2.0
 	zipVersion45 = 45 // 4.5 (reads and writes zip64 archives)
+	zipVersion63 = 63 // 6.3 (LZMA and XZ)
 
 	// limits for non zip64 files
 	uint16max = (1 << 16) - 1
@@ -68,6 +82,7 @@ const (
 	zip64ExtraId       = 0x0001 // zip64 Extended Information Extra Field
 	winzipAesExtraId   = 0x9901 // winzip AES Extra Field
 	unicodePathExtraId = 0x7075 // Info-ZIP Unicode Path Extra Field
+	alignExtraId       = 0xd935 // Android zipalign padding Extra Field
 )
 
 // Extra info: Unicode path
@@ -77,6 +92,78 @@ type UnicodePath struct {
 	Name    string
 }
 
+// SetLevel sets the compression level Writer.CreateHeader uses for
+// this entry, overriding Writer.SetLevel. It is only a hint: methods
+// without levels, and compressors registered with RegisterCompressor,
+// ignore it.
+func (h *FileHeader) SetLevel(level int) {
+	h.level = level
+	h.levelSet = true
+}
+
+// SetCompressor sets the compressor Writer.CreateHeader uses for the
+// data of this entry, overriding those registered for h.Method with
+// Writer.RegisterCompressor and RegisterCompressor. Like them, it
+// ignores the compression level. It is not used if Writer.SetAdaptive
+// stores the entry instead; a nil comp removes it.
+func (h *FileHeader) SetCompressor(comp Compressor) {
+	h.comp = comp
+}
+
+// SetAlignment sets the alignment Writer.CreateHeader and
+// Writer.CreateRaw use for the data of this entry, overriding
+// Writer.SetAlignment; 0 or 1 disables it. Like the Writer setting, it
+// only applies to unencrypted Store entries.
+func (h *FileHeader) SetAlignment(n int) {
+	h.align = n
+	h.alignSet = true
+}
+
+// SetUnicodePath records name as the UTF-8 form of h.Name in an
+// Info-ZIP Unicode Path extra field, replacing any existing one.
+// It should be called after h.Name has been set to the name in its
+// archive encoding, since the field stores a CRC-32 of that name.
+// An empty name removes the field.
+func (h *FileHeader) SetUnicodePath(name string) {
+	h.Extra = removeExtra(h.Extra, unicodePathExtraId)
+	if name == "" {
+		h.UnicodePath = nil
+		return
+	}
+	h.UnicodePath = &UnicodePath{
+		Version: 1,
+		NameCrc: crc32.ChecksumIEEE([]byte(h.Name)),
+		Name:    name,
+	}
+	buf := make([]byte, 9+len(name))
+	eb := writeBuf(buf)
+	eb.uint16(unicodePathExtraId)
+	eb.uint16(uint16(5 + len(name)))
+	eb.uint8(h.UnicodePath.Version)
+	eb.uint32(h.UnicodePath.NameCrc)
+	copy(eb, name)
+	h.Extra = append(h.Extra, buf...)
+}
+
+// removeExtra returns extra without the fields tagged id.
+func removeExtra(extra []byte, id uint16) []byte {
+	var out []byte
+	b := readBuf(extra)
+	for len(b) >= 4 {
+		field := b
+		tag := b.uint16()
+		size := int(b.uint16())
+		if size > len(b) {
+			break
+		}
+		if tag != id {
+			out = append(out, field[:4+size]...)
+		}
+		b = b[size:]
+	}
+	return out
+}
+
 // FileHeader describes a file within a zip file.
 // See the zip spec for details.
 type FileHeader struct {
@@ -113,6 +200,11 @@ type FileHeader struct {
 	password    passwordFn // Returns the password to use when reading/writing
 	ae          uint16
 	aesStrength byte
+	level       int        // compression level hint, see SetLevel
+	levelSet    bool       // level was set
+	align       int        // data alignment, see SetAlignment
+	alignSet    bool       // align was set
+	comp        Compressor // see SetCompressor
 
 	UnicodePath *UnicodePath
 }
@@ -260,11 +352,22 @@ func (h *FileHeader) SetMode(mode os.FileMode) {
 	}
 }
 
+func (h *FileHeader) hasDataDescriptor() bool {
+	return h.Flags&0x8 != 0
+}
+
 // isZip64 reports whether the file size exceeds the 32 bit limit
 func (fh *FileHeader) isZip64() bool {
 	return fh.CompressedSize64 > uint32max || fh.UncompressedSize64 > uint32max
 }
 
+// IsZip64 reports whether the file is stored using ZIP64 extensions,
+// either because its sizes need them or because the 32 bit size fields
+// were marked as superseded by a zip64 extra field.
+func (fh *FileHeader) IsZip64() bool {
+	return fh.isZip64() || fh.CompressedSize == uint32max || fh.UncompressedSize == uint32max
+}
+
 func msdosModeToFileMode(m uint32) (mode os.FileMode) {
 	if m&msdosDir != 0 {
 		mode = os.ModeDir | 0777
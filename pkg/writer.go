@@ -8,30 +8,70 @@ import (
 	"bufio"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash"
 	"hash/crc32"
 	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
 )
 
-// TODO(adg): support zip file comments
-// TODO(adg): support specifying deflate level
-
 // Writer implements a zip file writer.
 type Writer struct {
-	cw     *countWriter
-	dir    []*header
-	last   *fileWriter
-	closed bool
+	cw      *countWriter
+	dir     []*header
+	last    *fileWriter
+	closed  bool
+	comment string
+	level   int // deflate level, defaultFlateLevel unless set
+	align   int // data alignment of stored entries, see SetAlignment
+
+	compressors map[uint16]Compressor // per-Writer overrides
+
+	ws       io.WriteSeeker // set by NewSeekableWriter
+	seekBase int64          // position in ws of offset 0
+
+	container Container        // set by SetContainer
+	adaptive  *AdaptiveOptions // set by SetAdaptive
+
+	reproducible *ReproducibleOptions // set by SetReproducible
 }
 
 type header struct {
 	*FileHeader
-	offset uint64
+	offset    uint64
+	raw       bool // written by CreateRaw
+	reserve64 bool // the local header has room for a zip64 extra
+	align     int  // pad the local header so the data starts at a multiple
+	pad       int  // pad the local header by this many bytes, see storeFallback
 }
 
 // NewWriter returns a new Writer writing a zip file to w.
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{cw: &countWriter{w: bufio.NewWriter(w)}}
+	return &Writer{cw: &countWriter{w: bufio.NewWriter(w)}, level: defaultFlateLevel}
+}
+
+// NewSeekableWriter returns a new Writer writing a zip file to ws,
+// starting at its current position. Instead of following each entry
+// with a data descriptor, it seeks back to write the CRC-32 and sizes
+// into the local header, as some readers require.
+//
+// Entries encrypted with StandardEncryption still get a data
+// descriptor, as their password check byte has to be written before
+// the CRC-32 is known. An entry that turns out to need zip64 gets a
+// zip64 extra in its local header only if fh.UncompressedSize64 was set
+// to at least 4 GiB before CreateHeader, and a data descriptor
+// otherwise. If ws cannot seek, the Writer works like one returned by
+// NewWriter.
+func NewSeekableWriter(ws io.WriteSeeker) *Writer {
+	w := NewWriter(ws)
+	if pos, err := ws.Seek(0, io.SeekCurrent); err == nil {
+		w.ws = ws
+		w.seekBase = pos
+	}
+	return w
 }
 
 // SetOffset sets the offset of the beginning of the zip data within the
@@ -43,6 +83,95 @@ func (w *Writer) SetOffset(n int64) {
 		panic("zip: SetOffset called after data was written")
 	}
 	w.cw.count = n
+	w.seekBase -= n
+}
+
+// SetComment sets the end-of-central-directory comment field.
+// It can only be called before Close.
+func (w *Writer) SetComment(comment string) error {
+	if len(comment) > uint16max {
+		return errors.New("zip: Writer.Comment too long")
+	}
+	w.comment = comment
+	return nil
+}
+
+// SetLevel sets the compression level used for Deflate entries created
+// after the call, from flate.HuffmanOnly (-2) to flate.BestCompression (9).
+// flate.DefaultCompression (-1) selects the flate package default.
+// FileHeader.SetLevel overrides it for a single entry.
+func (w *Writer) SetLevel(level int) error {
+	if err := checkFlateLevel(level); err != nil {
+		return err
+	}
+	w.level = level
+	return nil
+}
+
+// maxAlign is the largest data alignment, keeping the padding within
+// the limit of the extra field length.
+const maxAlign = 1 << 15
+
+// SetAlignment makes the data of unencrypted Store entries created
+// after the call start at a multiple of n bytes from the beginning of
+// the underlying writer, offset set by SetOffset included, so that it
+// can be memory-mapped in place; typically 4, or 4096 for shared
+// libraries. As Android's zipalign does, the local header is padded with
+// an extra field of ID 0xD935 holding n. The central directory is left
+// alone. n must be a power of two no larger than 32768; 0 or 1 disables
+// alignment. FileHeader.SetAlignment overrides it for a single entry.
+func (w *Writer) SetAlignment(n int) error {
+	if err := checkAlignment(n); err != nil {
+		return err
+	}
+	w.align = n
+	return nil
+}
+
+func checkAlignment(n int) error {
+	if n < 0 || n > maxAlign || n&(n-1) != 0 {
+		return fmt.Errorf("zip: invalid alignment %d", n)
+	}
+	return nil
+}
+
+// alignment returns the data alignment for the entry fh, or 0 if its
+// data is not to be aligned.
+func (w *Writer) alignment(fh *FileHeader) (int, error) {
+	n := w.align
+	if fh.alignSet {
+		if err := checkAlignment(fh.align); err != nil {
+			return 0, err
+		}
+		n = fh.align
+	}
+	if n <= 1 || fh.Method != Store || fh.IsEncrypted() || fh.password != nil {
+		return 0, nil
+	}
+	return n, nil
+}
+
+// RegisterCompressor registers or overrides a custom compressor for a
+// specific method ID. If a compressor for a given method is not found,
+// Writer will default to looking up the compressor at the package level.
+// Compressors registered here ignore the compression level. A nil comp
+// removes the override.
+func (w *Writer) RegisterCompressor(method uint16, comp Compressor) {
+	if w.compressors == nil {
+		w.compressors = make(map[uint16]Compressor)
+	}
+	w.compressors[method] = comp
+}
+
+// compressor returns the compressor for method at the given level.
+func (w *Writer) compressor(method uint16, level int) Compressor {
+	if comp := w.compressors[method]; comp != nil {
+		return comp
+	}
+	if lc := leveledCompressors[method]; lc != nil {
+		return lc(level)
+	}
+	return compressor(method)
 }
 
 // Flush flushes any buffered data to the underlying writer.
@@ -63,6 +192,9 @@ func (w *Writer) Close() error {
 	if w.closed {
 		return errors.New("zip: writer closed twice")
 	}
+	if err := w.checkContainer(); err != nil {
+		return err
+	}
 	w.closed = true
 
 	// write central directory
@@ -78,7 +210,7 @@ func (w *Writer) Close() error {
 		b.uint16(h.ModifiedTime)
 		b.uint16(h.ModifiedDate)
 		b.uint32(h.CRC32)
-		if h.isZip64() || h.offset > uint32max {
+		if h.isZip64() || h.offset > uint32max || h.reserve64 {
 			// the file needs a zip64 header. store maxint in both
 			// 32 bit size fields (and offset later) to signal that the
 			// zip64 extra header should be used.
@@ -169,10 +301,13 @@ func (w *Writer) Close() error {
 	b.uint16(uint16(records)) // number of entries total
 	b.uint32(uint32(size))    // size of directory
 	b.uint32(uint32(offset))  // start of directory
-	// skipped size of comment (always zero)
+	b.uint16(uint16(len(w.comment)))
 	if _, err := w.cw.Write(buf[:]); err != nil {
 		return err
 	}
+	if _, err := io.WriteString(w.cw, w.comment); err != nil {
+		return err
+	}
 
 	return w.cw.w.(*bufio.Writer).Flush()
 }
@@ -209,22 +344,98 @@ func (w *Writer) CreateHeader(fh *FileHeader) (io.Writer, error) {
 		// See https://golang.org/issue/11144 confusion.
 		return nil, errors.New("archive/zip: invalid duplicate FileHeader")
 	}
+	if err := w.checkEntry(fh); err != nil {
+		return nil, err
+	}
+	if _, err := w.alignment(fh); err != nil {
+		return nil, err
+	}
 
-	fh.Flags |= 0x8 // we will write a data descriptor
+	fw := &fileWriter{}
+	if w.adaptive != nil && fh.Method != Store {
+		if w.adaptive.storeByName(fh.Name) {
+			fh.Method = Store
+		} else {
+			// the method is chosen once a sample of the data is known
+			fw.sample = make([]byte, 0, w.adaptive.SampleSize)
+			fw.decide = func() error { return w.decide(fw, fh) }
+			w.last = fw
+			return fw, nil
+		}
+	}
+	if err := w.startEntry(fw, fh); err != nil {
+		return nil, err
+	}
+	w.last = fw
+	return fw, nil
+}
+
+// startEntry writes the local header of fh and sets up fw to write its
+// data.
+func (w *Writer) startEntry(fw *fileWriter, fh *FileHeader) error {
+	align, err := w.alignment(fh)
+	if err != nil {
+		return err
+	}
+	if align > 0 {
+		fh.Extra = removeExtra(fh.Extra, alignExtraId)
+	}
+
+	reserve64 := false
+	if w.ws != nil && !(fh.password != nil && fh.encryption == StandardEncryption) {
+		fh.Flags &^= 0x8 // we will patch the local header
+		reserve64 = fh.UncompressedSize64 >= uint32max
+	} else {
+		fh.Flags |= 0x8 // we will write a data descriptor
+	}
+	if err := w.initFileWriter(fw, fh, w.cw); err != nil {
+		return err
+	}
+
+	h := &header{
+		FileHeader: fh,
+		offset:     uint64(w.cw.count),
+		reserve64:  reserve64,
+		align:      align,
+	}
+	if reserve64 && fh.ReaderVersion < zipVersion45 {
+		fh.ReaderVersion = zipVersion45
+	}
+	w.dir = append(w.dir, h)
+	fw.header = h
+	if w.ws != nil {
+		fw.patchHeader = w.patchHeader
+		if _, ok := w.ws.(io.ReaderAt); ok && w.adaptive != nil && fh.Method != Store && fh.password == nil {
+			fw.storeFallback = w.storeFallback
+		}
+	}
+	return writeHeader(w.cw, h)
+}
+
+// initFileWriter sets the versions of fh and sets up fw to compress,
+// and encrypt if fh has a password, into dst. The header of fw is left
+// to the caller.
+func (w *Writer) initFileWriter(fw *fileWriter, fh *FileHeader, dst io.Writer) error {
 	// TODO(alex): Look at spec and see if these need to be changed
 	// when using encryption.
 	fh.CreatorVersion = fh.CreatorVersion&0xff00 | zipVersion20 // preserve compatibility byte
 	fh.ReaderVersion = zipVersion20
-
-	fw := &fileWriter{
-		zipw:      w.cw,
-		compCount: &countWriter{w: w.cw},
-		crc32:     crc32.NewIEEE(),
+	w.normalize(fh)
+	switch fh.Method {
+	case LZMA:
+		fh.Flags |= lzmaEOSFlag // lzmaCompressor writes an end of stream marker
+		fh.ReaderVersion = zipVersion63
+	case XZ:
+		fh.ReaderVersion = zipVersion63
 	}
+
+	fw.zipw = dst
+	fw.compCount = &countWriter{w: dst}
+	fw.crc32 = crc32.NewIEEE()
 	// Get the compressor before possibly changing Method to 99 due to password
-	comp := compressor(fh.Method)
-	if comp == nil {
-		return nil, ErrAlgorithm
+	comp, err := w.entryCompressor(fh)
+	if err != nil {
+		return err
 	}
 	// check for password
 	var sw io.Writer = fw.compCount
@@ -232,43 +443,322 @@ func (w *Writer) CreateHeader(fh *FileHeader) (io.Writer, error) {
 		if fh.encryption == StandardEncryption {
 			ew, err := ZipCryptoEncryptor(sw, fh.password, fw)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			sw = ew
+			fw.encw = ew
 		} else {
 			// we have a password and need to encrypt.
+			rnd, err := w.saltReader()
+			if err != nil {
+				return err
+			}
 			fh.writeWinZipExtra()
 			fh.Method = 99 // ok to change, we've gotten the comp and wrote extra
-			ew, err := newEncryptionWriter(sw, fh.password, fw, fh.aesStrength)
+			ew, err := newEncryptionWriter(sw, fh.password, fw, fh.aesStrength, rnd)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			sw = ew
+			fw.encw = ew
 		}
 	}
-	var err error
 	fw.comp, err = comp(sw)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	fw.rawCount = &countWriter{w: fw.comp}
+	return nil
+}
+
+// entryCompressor returns the compressor of fh: the one set with
+// SetCompressor, or else the one registered for its method.
+func (w *Writer) entryCompressor(fh *FileHeader) (Compressor, error) {
+	if fh.comp != nil {
+		return fh.comp, nil
+	}
+	level, err := w.entryLevel(fh)
+	if err != nil {
+		return nil, err
+	}
+	comp := w.compressor(fh.Method, level)
+	if comp == nil {
+		return nil, ErrAlgorithm
+	}
+	return comp, nil
+}
+
+// entryLevel returns the compression level of fh.
+func (w *Writer) entryLevel(fh *FileHeader) (int, error) {
+	if !fh.levelSet {
+		return w.level, nil
+	}
+	if err := checkFlateLevel(fh.level); err != nil {
+		return 0, err
+	}
+	return fh.level, nil
+}
+
+// CreateRaw adds a file to the zip archive using the provided FileHeader
+// and returns a Writer to which the file contents should be written.
+// The contents are written exactly as given: they must already be
+// compressed with fh.Method, and encrypted if fh is, and CRC32,
+// CompressedSize64 and UncompressedSize64 must be set.
+//
+// The data descriptor flag of fh is honored: without it the CRC-32 and
+// sizes go into the local header, with it they follow the data. A zip64
+// extra field is regenerated as needed, and entries carrying a WinZip
+// AES extra field are stored with method 99.
+//
+// The file's contents must be written to the io.Writer before the next
+// call to Create, CreateHeader, CreateRaw, or Close.
+func (w *Writer) CreateRaw(fh *FileHeader) (io.Writer, error) {
+	if w.last != nil && !w.last.closed {
+		if err := w.last.close(); err != nil {
+			return nil, err
+		}
+	}
+	if len(w.dir) > 0 && w.dir[len(w.dir)-1].FileHeader == fh {
+		return nil, errors.New("archive/zip: invalid duplicate FileHeader")
+	}
+	if err := w.checkEntry(fh); err != nil {
+		return nil, err
+	}
+
+	align, err := w.alignment(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	// the writer adds its own zip64 extra in the local and central
+	// headers, and its own alignment padding in the local one
+	fh.Extra = removeExtra(removeExtra(fh.Extra, zip64ExtraId), alignExtraId)
+	if fh.ae != 0 {
+		fh.Method = 99
+	}
+	w.normalize(fh)
+	if w.ws != nil && !(fh.IsEncrypted() && fh.ae == 0) {
+		// the sizes are known, so a seekable writer never needs a data
+		// descriptor, except for the check byte of StandardEncryption
+		fh.Flags &^= 0x8
+	}
+	if fh.ReaderVersion == 0 {
+		fh.ReaderVersion = zipVersion20
+	}
+	if fh.isZip64() {
+		fh.CompressedSize = uint32max
+		fh.UncompressedSize = uint32max
+		if fh.ReaderVersion < zipVersion45 {
+			fh.ReaderVersion = zipVersion45
+		}
+	} else {
+		fh.CompressedSize = uint32(fh.CompressedSize64)
+		fh.UncompressedSize = uint32(fh.UncompressedSize64)
+	}
 
 	h := &header{
 		FileHeader: fh,
 		offset:     uint64(w.cw.count),
+		raw:        true,
+		align:      align,
 	}
 	w.dir = append(w.dir, h)
-	fw.header = h
-
-	if err := writeHeader(w.cw, fh); err != nil {
+	if err := writeHeader(w.cw, h); err != nil {
 		return nil, err
 	}
-
+	fw := &fileWriter{
+		header:    h,
+		zipw:      w.cw,
+		compCount: &countWriter{w: w.cw},
+	}
 	w.last = fw
 	return fw, nil
 }
 
-func writeHeader(w io.Writer, h *FileHeader) error {
+// Copy copies the file f, typically from another archive, into w
+// without decompressing or decrypting it. The header, including
+// encryption extras and the data descriptor flag, is preserved.
+func (w *Writer) Copy(f *File) error {
+	r, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	fh := f.FileHeader
+	fh.Extra = append([]byte(nil), f.Extra...)
+	return w.copyAs(&fh, r)
+}
+
+// copyAs writes the raw data r of an entry under the header fh.
+func (w *Writer) copyAs(fh *FileHeader, r io.Reader) error {
+	fw, err := w.CreateRaw(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+// AddFSOptions controls how AddFS and AddDir add files.
+// A nil *AddFSOptions adds every file under its slash-separated path.
+type AddFSOptions struct {
+	// Prefix is prepended to the path of every entry, e.g. "dir/".
+	Prefix string
+
+	// Filter, if non-nil, is called for every file and directory.
+	// Returning false skips the file, or the whole tree of a directory.
+	Filter func(path string, d fs.DirEntry) bool
+
+	// Header, if non-nil, is called with the header of each entry
+	// before it is written. It may change the name, method, password
+	// and encryption method, or any other field.
+	// By default regular files use Deflate and other entries Store.
+	Header func(fh *FileHeader, path string, info fs.FileInfo) error
+}
+
+// readLinkFS is implemented by file systems that can read symbolic
+// links, like fs.ReadLinkFS in newer Go releases.
+type readLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+}
+
+// AddFS adds the files, directories and symbolic links of fsys to the
+// archive, walking it in lexical order so the result is deterministic.
+// Modes and modification times are taken from the file system.
+// Symbolic links are stored with their target as content when fsys
+// can read links, and skipped otherwise. In reproducible mode the
+// entries are written sorted by their final name, once the whole tree
+// has been walked.
+func (w *Writer) AddFS(fsys fs.FS, opts *AddFSOptions) error {
+	return w.walkFS(fsys, opts, func(e *fsEntry) error {
+		fw, err := w.CreateHeader(e.fh)
+		if err != nil {
+			return err
+		}
+		return e.copy(fsys, fw)
+	})
+}
+
+// walkFS calls add with the entries AddFS adds from fsys, sorted by
+// name in reproducible mode.
+func (w *Writer) walkFS(fsys fs.FS, opts *AddFSOptions, add func(e *fsEntry) error) error {
+	if opts == nil {
+		opts = &AddFSOptions{}
+	}
+	var sorted []*fsEntry
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		if opts.Filter != nil && !opts.Filter(name, d) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var target string
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			lfs, ok := fsys.(readLinkFS)
+			if !ok {
+				return nil
+			}
+			if target, err = lfs.ReadLink(name); err != nil {
+				return err
+			}
+		case !info.IsDir() && !info.Mode().IsRegular():
+			return nil // devices, pipes and sockets have no content to store
+		}
+
+		fh, err := FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		fh.Name = opts.Prefix + name
+		fh.Method = Store
+		if info.IsDir() {
+			fh.Name += "/"
+		} else if info.Mode().IsRegular() {
+			fh.Method = Deflate
+		}
+		if opts.Header != nil {
+			if err := opts.Header(fh, name, info); err != nil {
+				return err
+			}
+		}
+		e := &fsEntry{fh: fh, name: name, info: info, target: target}
+		if w.reproducible != nil {
+			sorted = append(sorted, e)
+			return nil
+		}
+		return add(e)
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].fh.Name < sorted[j].fh.Name })
+	for _, e := range sorted {
+		if err := add(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsEntry is an entry of a file system walked by AddFS.
+type fsEntry struct {
+	fh     *FileHeader
+	name   string // path in the file system
+	info   fs.FileInfo
+	target string // of a symbolic link
+}
+
+// copy writes the contents of e, read from fsys, to fw.
+func (e *fsEntry) copy(fsys fs.FS, fw io.Writer) error {
+	switch {
+	case e.info.IsDir():
+		return nil
+	case e.info.Mode()&fs.ModeSymlink != 0:
+		_, err := io.WriteString(fw, e.target)
+		return err
+	}
+	f, err := fsys.Open(e.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(fw, f)
+	return err
+}
+
+// AddDir adds the contents of the directory tree rooted at dir to the
+// archive, as AddFS does. Entry names are relative to dir.
+func (w *Writer) AddDir(dir string, opts *AddFSOptions) error {
+	return w.AddFS(dirFS{FS: os.DirFS(dir), dir: dir}, opts)
+}
+
+// dirFS adds symbolic link support to os.DirFS.
+type dirFS struct {
+	fs.FS
+	dir string
+}
+
+func (d dirFS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Readlink(filepath.Join(d.dir, filepath.FromSlash(name)))
+}
+
+func writeHeader(w io.Writer, h *header) error {
+	extra := h.Extra
 	var buf [fileHeaderLen]byte
 	b := writeBuf(buf[:])
 	b.uint32(uint32(fileHeaderSignature))
@@ -277,21 +767,77 @@ func writeHeader(w io.Writer, h *FileHeader) error {
 	b.uint16(h.Method)
 	b.uint16(h.ModifiedTime)
 	b.uint16(h.ModifiedDate)
-	b.uint32(0) // since we are writing a data descriptor crc32,
-	b.uint32(0) // compressed size,
-	b.uint32(0) // and uncompressed size should be zero
+	if h.raw && !h.hasDataDescriptor() {
+		// sizes are known up front, so they go into the local header
+		b.uint32(h.CRC32)
+		b.uint32(h.CompressedSize)
+		b.uint32(h.UncompressedSize)
+		if h.isZip64() {
+			var zbuf [20]byte // 2x uint16 + 2x uint64
+			eb := writeBuf(zbuf[:])
+			eb.uint16(zip64ExtraId)
+			eb.uint16(16) // size = 2x uint64
+			eb.uint64(h.UncompressedSize64)
+			eb.uint64(h.CompressedSize64)
+			extra = append(zbuf[:], extra...)
+		}
+	} else {
+		b.uint32(0) // since we are writing a data descriptor crc32,
+		b.uint32(0) // compressed size,
+		b.uint32(0) // and uncompressed size should be zero
+		if h.reserve64 {
+			// filled in by Writer.patchHeader
+			var zbuf [20]byte // 2x uint16 + 2x uint64
+			eb := writeBuf(zbuf[:])
+			eb.uint16(zip64ExtraId)
+			eb.uint16(16) // size = 2x uint64
+			extra = append(zbuf[:], extra...)
+		}
+	}
+	switch {
+	case h.align > 0:
+		extra = alignExtra(extra, h.offset+fileHeaderLen+uint64(len(h.Name)), h.align)
+	case h.pad > 0:
+		extra = padExtra(extra, 1, h.pad)
+	}
+	if len(extra) > uint16max {
+		return errors.New("zip: FileHeader.Extra too long")
+	}
 	b.uint16(uint16(len(h.Name)))
-	b.uint16(uint16(len(h.Extra)))
+	b.uint16(uint16(len(extra)))
 	if _, err := w.Write(buf[:]); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, h.Name); err != nil {
 		return err
 	}
-	_, err := w.Write(h.Extra)
+	_, err := w.Write(extra)
 	return err
 }
 
+// alignExtra appends to extra, which starts at offset off, an alignment
+// extra field padding it so that the data following it starts at a
+// multiple of align: the alignment as uint16, then zeros.
+func alignExtra(extra []byte, off uint64, align int) []byte {
+	end := off + uint64(len(extra)) + minPadLen
+	pad := (uint64(align) - end%uint64(align)) % uint64(align)
+	return padExtra(extra, align, minPadLen+int(pad))
+}
+
+// minPadLen is the length of the shortest alignment extra field:
+// 2x uint16 + uint16.
+const minPadLen = 6
+
+// padExtra appends to extra an alignment extra field of n bytes.
+func padExtra(extra []byte, align, n int) []byte {
+	field := make([]byte, n)
+	b := writeBuf(field)
+	b.uint16(alignExtraId)
+	b.uint16(uint16(n - 4))
+	b.uint16(uint16(align))
+	return append(extra[:len(extra):len(extra)], field...)
+}
+
 type fileWriter struct {
 	*header
 	zipw      io.Writer
@@ -301,13 +847,43 @@ type fileWriter struct {
 	crc32     hash.Hash32
 	closed    bool
 
+	// patchHeader, if set, writes the CRC-32 and sizes into the local
+	// header instead of a data descriptor.
+	patchHeader func(h *header) error
+
+	// decide, if set, chooses the method of an entry of an adaptive
+	// Writer and writes its header, once sample is full or the entry
+	// is closed.
+	decide func() error
+	sample []byte
+
+	// storeFallback, if set, rewrites an entry whose data grew as
+	// stored, reporting whether it could.
+	storeFallback func(h *header) (bool, error)
+
 	hmac hash.Hash // possible hmac used for authentication when encrypting
+	encw io.Writer // the encryption writer, if encrypting
 }
 
 func (w *fileWriter) Write(p []byte) (int, error) {
 	if w.closed {
 		return 0, errors.New("zip: write to closed file")
 	}
+	if w.decide != nil {
+		n := min(len(p), cap(w.sample)-len(w.sample))
+		w.sample = append(w.sample, p[:n]...)
+		if len(w.sample) < cap(w.sample) {
+			return n, nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+		m, err := w.Write(p[n:])
+		return n + m, err
+	}
+	if w.raw {
+		return w.compCount.Write(p)
+	}
 	w.crc32.Write(p)
 	return w.rawCount.Write(p)
 }
@@ -316,10 +892,48 @@ func (w *fileWriter) close() error {
 	if w.closed {
 		return errors.New("zip: file closed twice")
 	}
+	if w.decide != nil {
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
 	w.closed = true
+	if w.raw {
+		if uint64(w.compCount.count) != w.CompressedSize64 {
+			return fmt.Errorf("zip: wrote %d raw bytes for %s, header says %d", w.compCount.count, w.Name, w.CompressedSize64)
+		}
+		if !w.hasDataDescriptor() {
+			return nil
+		}
+		return w.writeDataDescriptor()
+	}
+	if err := w.finish(); err != nil {
+		return err
+	}
+	if w.storeFallback != nil && w.CompressedSize64 > w.UncompressedSize64 {
+		if ok, err := w.storeFallback(w.header); ok || err != nil {
+			return err
+		}
+	}
+	if !w.hasDataDescriptor() {
+		return w.patchHeader(w.header)
+	}
+	return w.writeDataDescriptor()
+}
+
+// finish flushes the compressor, writes the authentication code of AES
+// entries and records the CRC-32 and sizes in the header.
+func (w *fileWriter) finish() error {
 	if err := w.comp.Close(); err != nil {
 		return err
 	}
+	// The encryption header goes out with the first write, which
+	// entries without data, such as stored empty files, never make.
+	if w.encw != nil {
+		if _, err := w.encw.Write(nil); err != nil {
+			return err
+		}
+	}
 	// if encrypted grab the hmac and write it out
 	if w.header.IsEncrypted() && w.header.encryption != StandardEncryption {
 		authCode := w.hmac.Sum(nil)
@@ -341,12 +955,18 @@ func (w *fileWriter) close() error {
 	if fh.isZip64() {
 		fh.CompressedSize = uint32max
 		fh.UncompressedSize = uint32max
-		fh.ReaderVersion = zipVersion45 // requires 4.5 - File uses ZIP64 format extensions
+		if fh.ReaderVersion < zipVersion45 {
+			fh.ReaderVersion = zipVersion45 // requires 4.5 - File uses ZIP64 format extensions
+		}
 	} else {
 		fh.CompressedSize = uint32(fh.CompressedSize64)
 		fh.UncompressedSize = uint32(fh.UncompressedSize64)
 	}
+	return nil
+}
 
+func (w *fileWriter) writeDataDescriptor() error {
+	fh := w.header.FileHeader
 	// Write data descriptor. This is more complicated than one would
 	// think, see e.g. comments in zipfile.c:putextended() and
 	// http://bugs.sun.com/bugdatabase/view_bug.do?bug_id=7073588.
@@ -372,6 +992,64 @@ func (w *fileWriter) close() error {
 	return err
 }
 
+// patchHeader seeks back to the local header of h to write its CRC-32
+// and sizes. A zip64 entry without room for a zip64 extra gets the data
+// descriptor flag and a data descriptor instead.
+func (w *Writer) patchHeader(h *header) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	pos := w.seekBase + int64(h.offset)
+	var buf [16]byte
+	b := writeBuf(buf[:])
+	switch {
+	case h.reserve64:
+		b.uint32(h.CRC32)
+		b.uint32(uint32max)
+		b.uint32(uint32max)
+		if err := w.writeAt(buf[:12], pos+14); err != nil {
+			return err
+		}
+		b = writeBuf(buf[:])
+		b.uint64(h.UncompressedSize64)
+		b.uint64(h.CompressedSize64)
+		// the zip64 extra comes first, after its ID and size
+		if err := w.writeAt(buf[:], pos+fileHeaderLen+int64(len(h.Name))+4); err != nil {
+			return err
+		}
+	case h.isZip64():
+		h.Flags |= 0x8
+		b.uint16(h.Flags)
+		if err := w.writeAt(buf[:2], pos+6); err != nil {
+			return err
+		}
+	default:
+		b.uint32(h.CRC32)
+		b.uint32(h.CompressedSize)
+		b.uint32(h.UncompressedSize)
+		if err := w.writeAt(buf[:12], pos+14); err != nil {
+			return err
+		}
+	}
+	if _, err := w.ws.Seek(w.seekBase+w.cw.count, io.SeekStart); err != nil {
+		return err
+	}
+	if h.hasDataDescriptor() {
+		fw := &fileWriter{header: h, zipw: w.cw}
+		return fw.writeDataDescriptor()
+	}
+	return nil
+}
+
+// writeAt writes p at position off of the seekable output.
+func (w *Writer) writeAt(p []byte, off int64) error {
+	if _, err := w.ws.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := w.ws.Write(p)
+	return err
+}
+
 type countWriter struct {
 	w     io.Writer
 	count int64
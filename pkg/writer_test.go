@@ -5,12 +5,23 @@
 package zip
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 // TODO(adg): a more sophisticated test suite
@@ -197,3 +208,1626 @@ func BenchmarkCompressedZipGarbage(b *testing.B) {
 		zw.Close()
 	}
 }
+
+func TestWriterComment(t *testing.T) {
+	const comment = "archive comment"
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	if err := w.SetComment(comment); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetComment(string(make([]byte, uint16max+1))); err == nil {
+		t.Error("expected error for a too long comment")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Comment != comment {
+		t.Errorf("comment: got %q, want %q", r.Comment, comment)
+	}
+}
+
+func TestWriterLevel(t *testing.T) {
+	data := bytes.Repeat([]byte("Rabbits, guinea pigs, gophers, marsupial rats, and quolls. "), 1000)
+	sizes := map[int]int{}
+	for _, level := range []int{0, 1, 9} {
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf)
+		if err := w.SetLevel(level); err != nil {
+			t.Fatal(err)
+		}
+		testCreate(t, w, &WriteTest{Name: "data", Data: data, Method: Deflate, Mode: 0644})
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testReadFile(t, r.File[0], &WriteTest{Name: "data", Data: data, Method: Deflate, Mode: 0644})
+		sizes[level] = int(r.File[0].CompressedSize64)
+	}
+	if sizes[0] <= sizes[9] {
+		t.Errorf("level 0 should not compress better than level 9: %v", sizes)
+	}
+	if err := NewWriter(ioutil.Discard).SetLevel(10); err == nil {
+		t.Error("expected error for level 10")
+	}
+}
+
+func TestFileHeaderLevel(t *testing.T) {
+	data := bytes.Repeat([]byte("Rabbits, guinea pigs, gophers, marsupial rats, and quolls. "), 1000)
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	w.SetLevel(9)
+	for i, hint := range []bool{true, false} {
+		fh := &FileHeader{Name: fmt.Sprint(i), Method: Deflate}
+		if hint {
+			fh.SetLevel(flate.NoCompression)
+		}
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+	}
+	fh := &FileHeader{Name: "invalid", Method: Deflate}
+	fh.SetLevel(10)
+	if _, err := w.CreateHeader(fh); err == nil {
+		t.Error("expected error for level 10")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, compressed := r.File[0].CompressedSize64, r.File[1].CompressedSize64; stored < uint64(len(data)) || compressed >= stored {
+		t.Errorf("level hint not applied: %d vs %d bytes", stored, compressed)
+	}
+}
+
+func TestWriterRegisterCompressor(t *testing.T) {
+	var compressed, decompressed int
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	w.RegisterCompressor(Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		compressed++
+		return flate.NewWriter(out, flate.BestSpeed)
+	})
+	testCreate(t, w, &WriteTest{Name: "data", Data: []byte("hello"), Method: Deflate, Mode: 0644})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// other writers keep the package level compressor
+	testCreate(t, NewWriter(ioutil.Discard), &WriteTest{Name: "data", Data: []byte("hello"), Method: Deflate, Mode: 0644})
+	if compressed != 1 {
+		t.Errorf("compressor called %d times, want 1", compressed)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RegisterDecompressor(Deflate, func(in io.Reader) io.ReadCloser {
+		decompressed++
+		return flate.NewReader(in)
+	})
+	testReadFile(t, r.File[0], &WriteTest{Name: "data", Data: []byte("hello"), Method: Deflate, Mode: 0644})
+	if decompressed != 1 {
+		t.Errorf("decompressor called %d times, want 1", decompressed)
+	}
+}
+
+func TestTryRegister(t *testing.T) {
+	if err := TryRegisterCompressor(Deflate, nil); err != ErrRegistered {
+		t.Errorf("TryRegisterCompressor(Deflate): got %v", err)
+	}
+	if err := TryRegisterDecompressor(Store, nil); err != ErrRegistered {
+		t.Errorf("TryRegisterDecompressor(Store): got %v", err)
+	}
+	const method = 0xfffe
+	if err := TryRegisterDecompressor(method, flate.NewReader); err != nil {
+		t.Fatal(err)
+	}
+	if err := TryRegisterDecompressor(method, flate.NewReader); err != ErrRegistered {
+		t.Errorf("second TryRegisterDecompressor: got %v", err)
+	}
+}
+
+func TestWriterZstd(t *testing.T) {
+	data := bytes.Repeat([]byte("Rabbits, guinea pigs, gophers, marsupial rats, and quolls. "), 1000)
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	for i, level := range []int{1, 9} {
+		fh := &FileHeader{Name: fmt.Sprint("level", level), Method: Zstd}
+		fh.SetLevel(level)
+		if i == 1 {
+			fh.SetPassword([]byte("golang"))
+			fh.SetEncryptionMethod(AES256Encryption)
+		}
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File {
+		if f.Method != Zstd {
+			t.Errorf("%s: method %d, want %d", f.Name, f.Method, Zstd)
+		}
+		if f.CompressedSize64 >= uint64(len(data))/10 {
+			t.Errorf("%s: poorly compressed: %d bytes", f.Name, f.CompressedSize64)
+		}
+		if f.IsEncrypted() {
+			f.SetPassword([]byte("golang"))
+		}
+		if got := readAll(t, f); !bytes.Equal(got, data) {
+			t.Errorf("%s: content mismatch", f.Name)
+		}
+	}
+}
+
+func TestWriterLZMAXZ(t *testing.T) {
+	data := bytes.Repeat([]byte("Rabbits, guinea pigs, gophers, marsupial rats, and quolls. "), 1000)
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	for _, method := range []uint16{LZMA, XZ} {
+		for _, encrypt := range []bool{false, true} {
+			fh := &FileHeader{Name: fmt.Sprint(method, encrypt), Method: method}
+			if encrypt {
+				fh.SetPassword([]byte("golang"))
+				fh.SetEncryptionMethod(AES256Encryption)
+			}
+			fw, err := w.CreateHeader(fh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write(data)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != 4 {
+		t.Fatalf("got %d files, want 4", len(r.File))
+	}
+	for i, f := range r.File {
+		want := []uint16{LZMA, XZ}[i/2]
+		if f.Method != want {
+			t.Errorf("%s: method %d, want %d", f.Name, f.Method, want)
+		}
+		if f.ReaderVersion != zipVersion63 {
+			t.Errorf("%s: reader version %d, want %d", f.Name, f.ReaderVersion, zipVersion63)
+		}
+		if want == LZMA && f.Flags&lzmaEOSFlag == 0 {
+			t.Errorf("%s: flags %#x: EOS marker bit not set", f.Name, f.Flags)
+		}
+		if f.CompressedSize64 >= uint64(len(data))/10 {
+			t.Errorf("%s: poorly compressed: %d bytes", f.Name, f.CompressedSize64)
+		}
+		if f.IsEncrypted() {
+			f.SetPassword([]byte("golang"))
+		}
+		if got := readAll(t, f); !bytes.Equal(got, data) {
+			t.Errorf("%s: content mismatch", f.Name)
+		}
+	}
+}
+
+func TestWriterUnicodePath(t *testing.T) {
+	gbkName := string([]byte{0xb2, 0xe2, 0xca, 0xd4}) // "测试" in GBK
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	fh := &FileHeader{Name: gbkName, Method: Store}
+	fh.SetUnicodePath("old")
+	fh.SetUnicodePath("测试")
+	if _, err := w.CreateHeader(fh); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := r.File[0].UnicodePath
+	if up == nil || up.Name != "测试" || up.NameCrc != crc32.ChecksumIEEE([]byte(gbkName)) {
+		t.Errorf("unexpected unicode path: %+v", up)
+	}
+}
+
+func TestWriterAddFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"b.txt":        {Data: []byte("bbb"), Mode: 0644},
+		"a/c.txt":      {Data: []byte("ccc"), Mode: 0600},
+		"a/skip/d.txt": {Data: []byte("ddd"), Mode: 0644},
+		"secret.txt":   {Data: []byte("secret"), Mode: 0644},
+	}
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	err := w.AddFS(fsys, &AddFSOptions{
+		Prefix: "root/",
+		Filter: func(path string, d fs.DirEntry) bool { return path != "a/skip" },
+		Header: func(fh *FileHeader, path string, info fs.FileInfo) error {
+			switch path {
+			case "b.txt":
+				fh.Method = Store
+			case "secret.txt":
+				fh.SetPassword(password)
+				fh.SetEncryptionMethod(AES256Encryption)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []WriteTest{
+		{Name: "root/a/", Method: Store, Mode: os.ModeDir | 0555},
+		{Name: "root/a/c.txt", Data: []byte("ccc"), Method: Deflate, Mode: 0600},
+		{Name: "root/b.txt", Data: []byte("bbb"), Method: Store, Mode: 0644},
+		{Name: "root/secret.txt", Data: []byte("secret"), Method: Deflate, Mode: 0644},
+	}
+	if len(r.File) != len(want) {
+		t.Fatalf("got %d files, want %d", len(r.File), len(want))
+	}
+	for i, wt := range want {
+		f := r.File[i]
+		if f.Name != wt.Name || f.Method != wt.Method || f.Mode() != wt.Mode {
+			t.Errorf("file %d: got %s %d %v, want %s %d %v", i, f.Name, f.Method, f.Mode(), wt.Name, wt.Method, wt.Mode)
+			continue
+		}
+		if f.IsEncrypted() {
+			f.SetPassword(password)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(b, wt.Data) {
+			t.Errorf("%s: got %q, %v", f.Name, b, err)
+		}
+	}
+}
+
+func TestWriterAddDirSymlink(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(dir, "link")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	if err := w.AddDir(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != 2 || r.File[1].Name != "link" || r.File[1].Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("unexpected files: %v", r.File)
+	}
+	rc, _ := r.File[1].Open()
+	target, _ := ioutil.ReadAll(rc)
+	if string(target) != "file" {
+		t.Errorf("link target: got %q", target)
+	}
+}
+
+func TestWriterCopy(t *testing.T) {
+	for _, name := range []string{"test.zip", "dd.zip", "go-with-datadesc-sig.zip", "crc32-not-streamed.zip", "zip64.zip", "world-aes.zip", "symlink.zip", "winxp.zip"} {
+		src, err := OpenReader(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf)
+		for _, f := range src.File {
+			if err := w.Copy(f); err != nil {
+				t.Fatalf("%s: copy %s: %v", name, f.Name, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		dst, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(dst.File) != len(src.File) {
+			t.Fatalf("%s: got %d files, want %d", name, len(dst.File), len(src.File))
+		}
+		for i, f := range dst.File {
+			sf := src.File[i]
+			if f.Name != sf.Name || f.Method != sf.Method || f.Flags != sf.Flags || f.CRC32 != sf.CRC32 || f.Mode() != sf.Mode() {
+				t.Errorf("%s: %s: header mismatch", name, f.Name)
+			}
+			if err := f.CheckHeaders(); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			if f.IsEncrypted() {
+				f.SetPassword([]byte("golang"))
+				sf.SetPassword([]byte("golang"))
+			}
+			want := readAll(t, sf)
+			if got := readAll(t, f); !bytes.Equal(got, want) {
+				t.Errorf("%s: %s: content mismatch", name, f.Name)
+			}
+		}
+		src.Close()
+	}
+}
+
+func TestWriterCreateRaw(t *testing.T) {
+	data := bytes.Repeat([]byte("raw data "), 100)
+	var comp bytes.Buffer
+	fw, _ := flate.NewWriter(&comp, 5)
+	fw.Write(data)
+	fw.Close()
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	fh := &FileHeader{
+		Name:               "raw.txt",
+		Method:             Deflate,
+		CRC32:              crc32.ChecksumIEEE(data),
+		CompressedSize64:   uint64(comp.Len()),
+		UncompressedSize64: uint64(len(data)),
+	}
+	rw, err := w.CreateRaw(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rw.Write(comp.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := r.File[0]
+	if f.hasDataDescriptor() {
+		t.Error("raw entry should not have a data descriptor")
+	}
+	if err := f.CheckHeaders(); err != nil {
+		t.Error(err)
+	}
+	if got := readAll(t, f); !bytes.Equal(got, data) {
+		t.Error("content mismatch")
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(raw); !bytes.Equal(b, comp.Bytes()) {
+		t.Error("OpenRaw returned different bytes")
+	}
+
+	w = NewWriter(ioutil.Discard)
+	short := &FileHeader{Name: "short", Method: Store, CompressedSize64: 10, UncompressedSize64: 10}
+	if rw, err = w.CreateRaw(short); err != nil {
+		t.Fatal(err)
+	}
+	rw.Write([]byte("12345"))
+	if err := w.Close(); err == nil {
+		t.Error("expected error for short raw data")
+	}
+}
+
+func TestWriterAppend(t *testing.T) {
+	for _, name := range []string{"test.zip", "dd.zip", "zip64.zip", "world-aes.zip", "winxp.zip"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(t.TempDir(), name)
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		src, err := NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a, err := OpenAppend(p)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(a.File) != len(src.File) {
+			t.Fatalf("%s: got %d existing files, want %d", name, len(a.File), len(src.File))
+		}
+		if !a.Remove(a.File[0]) {
+			t.Errorf("%s: Remove did not find %s", name, a.File[0].Name)
+		}
+		fw, err := a.Create("appended.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, "appended")
+		if err := a.Close(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		dst, err := OpenReader(p)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(dst.File) != len(src.File) || dst.Comment != src.Comment {
+			t.Fatalf("%s: got %d files, comment %q", name, len(dst.File), dst.Comment)
+		}
+		for i, f := range dst.File[:len(dst.File)-1] {
+			sf := src.File[i+1]
+			if f.Name != sf.Name || f.CRC32 != sf.CRC32 || f.Mode() != sf.Mode() || f.Encryption() != sf.Encryption() {
+				t.Errorf("%s: %s: header mismatch", name, f.Name)
+			}
+			if err := f.CheckHeaders(); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			if f.IsEncrypted() {
+				f.SetPassword([]byte("golang"))
+				sf.SetPassword([]byte("golang"))
+			}
+			if !bytes.Equal(readAll(t, f), readAll(t, sf)) {
+				t.Errorf("%s: %s: content mismatch", name, f.Name)
+			}
+		}
+		if f := dst.File[len(dst.File)-1]; f.Name != "appended.txt" || string(readAll(t, f)) != "appended" {
+			t.Errorf("%s: appended entry mismatch: %s", name, f.Name)
+		}
+		if f := dst.File[len(dst.File)-1]; f.headerOffset != src.dirOffset {
+			t.Errorf("%s: appended entry at %d, want %d", name, f.headerOffset, src.dirOffset)
+		}
+		dst.Close()
+	}
+}
+
+type errorWriter struct{}
+
+func (errorWriter) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestAppendRestoresDirectory(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/readme.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "readme.zip")
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := OpenAppend(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw, err := a.Create("appended.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, "appended")
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = ioutil.ReadFile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed Close writes the old directory back, whether or not
+	// entries were added
+	for _, add := range []bool{true, false} {
+		a, err := OpenAppend(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if add {
+			fw, err := a.Create("appended.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(fw, strings.Repeat("appended", 100))
+		} else {
+			a.Remove(a.File[1])
+		}
+		if err := a.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		a.cw.w = bufio.NewWriter(errorWriter{})
+		if err := a.Close(); err == nil {
+			t.Fatalf("add %v: Close succeeded", add)
+		}
+		if got, _ := ioutil.ReadFile(p); !bytes.Equal(got, data) {
+			t.Errorf("add %v: archive not restored", add)
+		}
+	}
+
+	// without new entries the directory is replaced in place
+	a, err = OpenAppend(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Remove(a.File[1])
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenReader(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.File) != 1 || r.File[0].Name != "README" {
+		t.Errorf("after Remove: %d files", len(r.File))
+	}
+	if fi, _ := os.Stat(p); fi.Size() >= int64(len(data)) {
+		t.Errorf("archive grew from %d to %d bytes", len(data), fi.Size())
+	}
+}
+
+func TestRewriteFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "rewrite.zip")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f)
+	w.SetComment("comment")
+	for _, name := range []string{"secret.txt", "drop.txt", "\xb2\xe2.txt"} {
+		fh := &FileHeader{Name: name, Method: Deflate}
+		if name == "secret.txt" {
+			fh.SetPassword([]byte("golang"))
+			fh.SetEncryptionMethod(AES256Encryption)
+		}
+		if name[0] >= 0x80 {
+			fh.SetUnicodePath("测.txt")
+		}
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, "data of "+name)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	err = RewriteFile(p, func(f *File, fh *FileHeader) (bool, error) {
+		switch f.Name {
+		case "drop.txt":
+			return false, nil
+		case "\xb2\xe2.txt":
+			fh.Name = "\xd0\xc2.txt"
+			fh.SetUnicodePath("新.txt")
+		}
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenReader(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.File) != 2 || r.Comment != "comment" {
+		t.Fatalf("got %d files, comment %q", len(r.File), r.Comment)
+	}
+	secret := r.File[0]
+	if secret.Encryption() != AES256Encryption {
+		t.Errorf("encryption: got %v", secret.Encryption())
+	}
+	secret.SetPassword([]byte("golang"))
+	if got := string(readAll(t, secret)); got != "data of secret.txt" {
+		t.Errorf("secret.txt: got %q", got)
+	}
+	renamed := r.File[1]
+	if err := renamed.CheckHeaders(); err != nil {
+		t.Error(err)
+	}
+	up := renamed.UnicodePath
+	if renamed.Name != "\xd0\xc2.txt" || up == nil || up.Name != "新.txt" || up.NameCrc != crc32.ChecksumIEEE([]byte(renamed.Name)) {
+		t.Errorf("renamed entry: %q %+v", renamed.Name, up)
+	}
+	if got := string(readAll(t, renamed)); got != "data of \xb2\xe2.txt" {
+		t.Errorf("renamed content: got %q", got)
+	}
+}
+
+func TestWriterReencrypt(t *testing.T) {
+	small := []byte("tiny")
+	large := bytes.Repeat([]byte("re-encrypt me, keep the payload. "), 100)
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	sources := []EncryptionMethod{0, StandardEncryption, AES128Encryption, AES256Encryption}
+	for i, enc := range sources {
+		for _, data := range [][]byte{small, large} {
+			fh := &FileHeader{Name: fmt.Sprintf("%d-%d.txt", i, len(data)), Method: Deflate}
+			if enc != 0 {
+				fh.SetPassword([]byte("old"))
+				fh.SetEncryptionMethod(enc)
+			}
+			fw, err := w.CreateHeader(fh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write(data)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	src, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, enc := range []EncryptionMethod{0, StandardEncryption, AES192Encryption, AES256Encryption} {
+		var password []byte
+		if enc != 0 {
+			password = []byte("new")
+		}
+		out := new(bytes.Buffer)
+		w := NewWriter(out)
+		for _, f := range src.File {
+			if f.IsEncrypted() {
+				f.SetPassword([]byte("old"))
+			}
+			if err := w.Reencrypt(f, password, enc); err != nil {
+				t.Fatalf("%v: %s: %v", enc, f.Name, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		dst, err := NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, f := range dst.File {
+			sf := src.File[i]
+			if f.Encryption() != enc {
+				t.Errorf("%v: %s: encryption %v", enc, f.Name, f.Encryption())
+			}
+			if f.Method != sf.Method {
+				t.Errorf("%v: %s: method %d, want %d", enc, f.Name, f.Method, sf.Method)
+			}
+			if err := f.CheckHeaders(); err != nil {
+				t.Errorf("%v: %v", enc, err)
+			}
+			if enc != 0 {
+				f.SetPassword(password)
+			}
+			want := readAll(t, sf)
+			if got := readAll(t, f); !bytes.Equal(got, want) {
+				t.Errorf("%v: %s: content mismatch", enc, f.Name)
+			}
+			switch {
+			case enc == 0 || enc == StandardEncryption:
+				if f.CRC32 != crc32.ChecksumIEEE(want) {
+					t.Errorf("%v: %s: missing crc32", enc, f.Name)
+				}
+			case len(want) < 20 || sf.IsAE2():
+				if f.AESVersion() != 2 || f.CRC32 != 0 {
+					t.Errorf("%v: %s: want AE-2 without crc32, got AE-%d %08x", enc, f.Name, f.AESVersion(), f.CRC32)
+				}
+			default:
+				if f.AESVersion() != 1 || f.CRC32 != crc32.ChecksumIEEE(want) {
+					t.Errorf("%v: %s: want AE-1 with crc32, got AE-%d %08x", enc, f.Name, f.AESVersion(), f.CRC32)
+				}
+			}
+		}
+	}
+
+	f := src.File[2]
+	f.SetPassword([]byte("wrong"))
+	if err := NewWriter(ioutil.Discard).Reencrypt(f, nil, 0); err != ErrPassword {
+		t.Errorf("wrong ZipCrypto password: got %v", err)
+	}
+}
+
+func TestWriterReencryptEmpty(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	for _, fh := range []*FileHeader{
+		{Name: "dir/", Method: Store},
+		{Name: "empty.txt", Method: Store},
+		{Name: "empty.gz", Method: Deflate},
+	} {
+		if _, err := w.CreateHeader(fh); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	src, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, enc := range []EncryptionMethod{StandardEncryption, AES256Encryption} {
+		out := new(bytes.Buffer)
+		w := NewWriter(out)
+		for _, f := range src.File {
+			if err := w.Reencrypt(f, []byte("new"), enc); err != nil {
+				t.Fatalf("%v: %s: %v", enc, f.Name, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		dst, err := NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range dst.File {
+			if want := !f.FileInfo().IsDir(); f.IsEncrypted() != want {
+				t.Errorf("%v: %s: encrypted %v, want %v", enc, f.Name, f.IsEncrypted(), want)
+			}
+			if err := f.CheckHeaders(); err != nil {
+				t.Errorf("%v: %v", enc, err)
+			}
+			f.SetPassword([]byte("new"))
+			if got := readAll(t, f); len(got) != 0 {
+				t.Errorf("%v: %s: %d bytes, want none", enc, f.Name, len(got))
+			}
+		}
+	}
+}
+
+func TestZipCryptoEmpty(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	fh := &FileHeader{Name: "empty.txt", Method: Store}
+	fh.SetPassword([]byte("golang"))
+	fh.SetEncryptionMethod(StandardEncryption)
+	if _, err := w.CreateHeader(fh); err != nil {
+		t.Fatal(err)
+	}
+	// as written before the encryption header was forced out
+	if _, err := w.CreateRaw(&FileHeader{Name: "old.txt", Method: Store, Flags: 0x1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := r.File[0].CompressedSize64; n != 12 {
+		t.Errorf("compressed size %d, want the 12 byte encryption header", n)
+	}
+	for _, f := range r.File {
+		if !f.IsEncrypted() {
+			t.Fatalf("%s: not encrypted", f.Name)
+		}
+		f.SetPassword([]byte("golang"))
+		if got := readAll(t, f); len(got) != 0 {
+			t.Errorf("%s: %d bytes, want none", f.Name, len(got))
+		}
+	}
+}
+
+func readAll(t *testing.T, f *File) []byte {
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatalf("%s: %v", f.Name, err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("%s: %v", f.Name, err)
+	}
+	return b
+}
+
+func TestSeekableWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("seekable "), 1000)
+	path := filepath.Join(t.TempDir(), "seek.zip")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	prefix := []byte("#!/bin/sh\nexit 0\n")
+	out.Write(prefix)
+
+	w := NewSeekableWriter(out)
+	w.SetOffset(int64(len(prefix)))
+	for _, fh := range []*FileHeader{
+		{Name: "deflate.txt", Method: Deflate},
+		{Name: "store.txt", Method: Store, Flags: 0x8},
+		{Name: "zip64.txt", Method: Deflate, UncompressedSize64: 1 << 32},
+		{Name: "aes.txt", Method: Deflate},
+		{Name: "zipcrypto.txt", Method: Deflate},
+		{Name: "empty/", Method: Store},
+	} {
+		switch fh.Name {
+		case "aes.txt":
+			fh.SetPassword([]byte("golang"))
+			fh.SetEncryptionMethod(AES256Encryption)
+		case "zipcrypto.txt":
+			fh.SetPassword([]byte("golang"))
+			fh.SetEncryptionMethod(StandardEncryption)
+		}
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fh.Name != "empty/" {
+			fw.Write(data)
+		}
+	}
+	dd, err := OpenReader("testdata/dd.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dd.Close()
+	if !dd.File[0].hasDataDescriptor() {
+		t.Fatal("dd.zip: no data descriptor")
+	}
+	if err := w.Copy(dd.File[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.File) != 7 {
+		t.Fatalf("got %d files, want 7", len(r.File))
+	}
+	for _, f := range r.File {
+		if got, want := f.hasDataDescriptor(), f.Name == "zipcrypto.txt"; got != want {
+			t.Errorf("%s: data descriptor flag %v, want %v", f.Name, got, want)
+		}
+		if err := f.CheckHeaders(); err != nil {
+			t.Errorf("%s: %v", f.Name, err)
+		}
+		if f.IsEncrypted() {
+			f.SetPassword([]byte("golang"))
+		}
+		b := readAll(t, f)
+		switch {
+		case f.Name == "empty/":
+		case f.Name == dd.File[0].Name:
+			if want := readAll(t, dd.File[0]); !bytes.Equal(b, want) {
+				t.Errorf("%s: content mismatch", f.Name)
+			}
+		case !bytes.Equal(b, data):
+			t.Errorf("%s: content mismatch", f.Name)
+		}
+	}
+	if f := r.File[2]; f.ReaderVersion < zipVersion45 {
+		t.Errorf("%s: reader version %d, want %d", f.Name, f.ReaderVersion, zipVersion45)
+	}
+}
+
+func TestWriterContainer(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	if err := w.SetContainer(ODF, ""); err == nil {
+		t.Error("ODF without media type: no error")
+	}
+	if err := w.SetContainer(EPUB, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, fh := range []*FileHeader{
+		{Name: "mimetype", Method: Store},
+		{Name: "OEBPS/secret.xhtml", Method: Deflate, Flags: 0x1},
+		{Name: "OEBPS/book.xhtml", Method: LZMA},
+	} {
+		var cerr *ContainerError
+		if _, err := w.CreateHeader(fh); !errors.As(err, &cerr) {
+			t.Errorf("%s: got %v, want a ContainerError", fh.Name, err)
+		}
+	}
+	fw, err := w.Create("OEBPS/book.xhtml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("<html/>"))
+	var cerr *ContainerError
+	if err := w.Close(); !errors.As(err, &cerr) || cerr.Violations[0] != "missing META-INF/container.xml" {
+		t.Fatalf("Close without container.xml: got %v", err)
+	}
+	fw, err = w.Create("META-INF/container.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("<container/>"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := buf.Bytes()
+	if got := string(b[fileHeaderLen : fileHeaderLen+len("mimetypeapplication/epub+zip")]); got != "mimetypeapplication/epub+zip" {
+		t.Errorf("archive starts with %q", got)
+	}
+	r, err := NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CheckContainer(EPUB); err != nil {
+		t.Error(err)
+	}
+	if err := r.CheckContainer(OOXML); err == nil {
+		t.Error("EPUB passes as OOXML")
+	}
+}
+
+func TestWriterContainerAlignment(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	if err := w.SetAlignment(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetContainer(EPUB, ""); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := w.CreateHeader(&FileHeader{Name: "META-INF/container.xml", Method: Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("<container/>"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CheckContainer(EPUB); err != nil {
+		t.Error(err)
+	}
+	off, err := r.File[1].DataOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off%4 != 0 {
+		t.Errorf("container.xml data at %d, want a multiple of 4", off)
+	}
+}
+
+func TestWriterAlignment(t *testing.T) {
+	data := []byte("aligned data")
+	buf := new(bytes.Buffer)
+	prefix := []byte("prefix")
+	buf.Write(prefix)
+	w := NewWriter(buf)
+	w.SetOffset(int64(len(prefix)))
+	if err := w.SetAlignment(3); err == nil {
+		t.Error("alignment 3: no error")
+	}
+	if err := w.SetAlignment(4); err != nil {
+		t.Fatal(err)
+	}
+	lib := &FileHeader{Name: "lib/arm64/libfoo.so", Method: Store}
+	lib.SetAlignment(4096)
+	for _, fh := range []*FileHeader{
+		{Name: "a", Method: Store},
+		{Name: "deflate.txt", Method: Deflate},
+		lib,
+		{Name: "extra", Method: Store, Extra: []byte{0x35, 0xd9, 2, 0, 1, 0}},
+		{Name: "zipcrypto.txt", Method: Store},
+	} {
+		if fh.Name == "zipcrypto.txt" {
+			fh.SetPassword([]byte("golang"))
+			fh.SetEncryptionMethod(StandardEncryption)
+		}
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+	}
+	raw := &FileHeader{
+		Name:               "raw",
+		Method:             Store,
+		CRC32:              crc32.ChecksumIEEE(data),
+		CompressedSize64:   uint64(len(data)),
+		UncompressedSize64: uint64(len(data)),
+	}
+	raw.SetAlignment(64)
+	fw, err := w.CreateRaw(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Copying keeps the alignment of the destination writer.
+	buf2 := new(bytes.Buffer)
+	w2 := NewWriter(buf2)
+	w2.SetAlignment(8192)
+	for _, f := range r.File {
+		if err := w2.Copy(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r2, err := NewReader(bytes.NewReader(buf2.Bytes()), int64(buf2.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		r     *Reader
+		align map[string]int64 // alignment wanted of each entry, or 0 if none
+	}{
+		{r, map[string]int64{"a": 4, "lib/arm64/libfoo.so": 4096, "extra": 4, "raw": 64}},
+		{r2, map[string]int64{"a": 8192, "lib/arm64/libfoo.so": 8192, "extra": 8192, "raw": 8192}},
+	} {
+		for _, f := range tt.r.File {
+			if err := f.CheckHeaders(); err != nil {
+				t.Errorf("%s: %v", f.Name, err)
+			}
+			if len(f.Extra) != 0 {
+				t.Errorf("%s: central extra %x", f.Name, f.Extra)
+			}
+			off, err := f.DataOffset()
+			if err != nil {
+				t.Fatal(err)
+			}
+			align := tt.align[f.Name]
+			if align == 0 {
+				if _, ok, _ := f.DataAligned(1); ok {
+					t.Errorf("%s: aligned, but not stored in place", f.Name)
+				}
+				continue
+			}
+			got, ok, err := f.DataAligned(align)
+			if err != nil || !ok || got != off {
+				t.Errorf("%s: DataAligned(%d) = %d, %v, %v; data at %d", f.Name, align, got, ok, err, off)
+			}
+			if f.IsEncrypted() {
+				f.SetPassword([]byte("golang"))
+			}
+			if b := readAll(t, f); !bytes.Equal(b, data) {
+				t.Errorf("%s: content mismatch", f.Name)
+			}
+		}
+	}
+}
+
+func TestWriterReproducible(t *testing.T) {
+	epoch := time.Date(2020, 2, 2, 12, 0, 0, 0, time.UTC)
+	t.Setenv("SOURCE_DATE_EPOCH", fmt.Sprint(epoch.Unix()))
+	build := func(modTime time.Time, perm fs.FileMode, rnd io.Reader) ([]byte, error) {
+		fsys := fstest.MapFS{
+			"a/b.txt":  {Data: []byte("b"), Mode: perm, ModTime: modTime},
+			"a":        {Mode: fs.ModeDir | perm | 0100, ModTime: modTime},
+			"a.txt":    {Data: []byte("a"), Mode: perm, ModTime: modTime},
+			"run.sh":   {Data: []byte("#!/bin/sh\n"), Mode: perm | 0100, ModTime: modTime},
+			"link":     {Data: []byte("a.txt"), Mode: fs.ModeSymlink | 0755, ModTime: modTime},
+			"zzz.txt":  {Data: []byte("renamed"), Mode: perm, ModTime: modTime},
+			"zzz2.txt": {Data: []byte("secret"), Mode: perm, ModTime: modTime},
+		}
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf)
+		if err := w.SetReproducible(&ReproducibleOptions{Rand: rnd}); err != nil {
+			return nil, err
+		}
+		err := w.AddFS(fsys, &AddFSOptions{Header: func(fh *FileHeader, path string, info fs.FileInfo) error {
+			switch path {
+			case "zzz.txt":
+				fh.Name = "0.txt"
+			case "zzz2.txt":
+				fh.SetPassword([]byte("golang"))
+				fh.SetEncryptionMethod(AES256Encryption)
+			}
+			fh.CreatorVersion |= zipVersion45
+			fh.Extra = []byte{0x55, 0x54, 1, 0, 1}
+			return nil
+		}})
+		if err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	if _, err := build(epoch, 0644, nil); err != errNotReproducible {
+		t.Fatalf("AES without Rand: got %v, want %v", err, errNotReproducible)
+	}
+	b1, err := build(epoch.Add(time.Hour), 0600, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := build(time.Now(), 0664, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b1, b2) {
+		t.Fatal("archives differ")
+	}
+
+	r, err := NewReader(bytes.NewReader(b1), int64(len(b1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name string
+		mode fs.FileMode
+	}{
+		{"0.txt", 0644},
+		{"a.txt", 0644},
+		{"a/", fs.ModeDir | 0755},
+		{"a/b.txt", 0644},
+		{"link", fs.ModeSymlink | 0777},
+		{"run.sh", 0755},
+		{"zzz2.txt", 0644},
+	}
+	if len(r.File) != len(want) {
+		t.Fatalf("got %d files, want %d", len(r.File), len(want))
+	}
+	for i, f := range r.File {
+		if f.Name != want[i].name || f.Mode() != want[i].mode {
+			t.Errorf("file %d: got %s %v, want %s %v", i, f.Name, f.Mode(), want[i].name, want[i].mode)
+		}
+		if f.CreatorVersion != creatorUnix<<8|zipVersion20 {
+			t.Errorf("%s: creator version %#x", f.Name, f.CreatorVersion)
+		}
+		if !f.ModTime().Equal(epoch) {
+			t.Errorf("%s: modified %v, want %v", f.Name, f.ModTime(), epoch)
+		}
+		if f.Name != "zzz2.txt" && len(f.Extra) != 0 {
+			t.Errorf("%s: extra %x", f.Name, f.Extra)
+		}
+	}
+	f := r.File[len(r.File)-1]
+	f.SetPassword([]byte("golang"))
+	if b := readAll(t, f); string(b) != "secret" {
+		t.Errorf("%s: got %q", f.Name, b)
+	}
+
+	// Earlier times are kept.
+	old := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	w.SetReproducible(nil)
+	fh := &FileHeader{Name: "old", Method: Store}
+	fh.SetModTime(old)
+	if _, err := w.CreateHeader(fh); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if !fh.ModTime().Equal(old) {
+		t.Errorf("old: modified %v, want %v", fh.ModTime(), old)
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	if err := NewWriter(io.Discard).SetReproducible(nil); err == nil {
+		t.Error("invalid SOURCE_DATE_EPOCH: no error")
+	}
+}
+
+func TestParallelWriter(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	contents := make([][]byte, 20)
+	for i := range contents {
+		b := bytes.Repeat([]byte(fmt.Sprintf("entry %d ", i)), rnd.Intn(20000))
+		if i%3 == 0 {
+			b = make([]byte, rnd.Intn(100000))
+			rnd.Read(b) // incompressible, spilled
+		}
+		contents[i] = b
+	}
+	tmp := t.TempDir()
+	buf := new(bytes.Buffer)
+	p := NewParallelWriter(NewWriter(buf), &ParallelOptions{Concurrency: 4, MaxMemory: 64 << 10, TempDir: tmp})
+	var wg sync.WaitGroup
+	for i, b := range contents {
+		fh := &FileHeader{Name: fmt.Sprintf("%02d.txt", i), Method: Deflate}
+		switch i % 5 {
+		case 1:
+			fh.Method = Store
+		case 2:
+			fh.SetPassword([]byte("golang"))
+			fh.SetEncryptionMethod(AES256Encryption)
+		case 3:
+			fh.SetPassword([]byte("golang"))
+			fh.SetEncryptionMethod(StandardEncryption)
+		}
+		fw, err := p.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for len(b) > 0 {
+				n := min(len(b), 1000)
+				fw.Write(b[:n])
+				b = b[n:]
+			}
+			if err := fw.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(tmp); len(files) != 0 {
+		t.Errorf("%d temporary files left", len(files))
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != len(contents) {
+		t.Fatalf("got %d files, want %d", len(r.File), len(contents))
+	}
+	for i, f := range r.File {
+		if want := fmt.Sprintf("%02d.txt", i); f.Name != want {
+			t.Errorf("file %d: got %s, want %s", i, f.Name, want)
+		}
+		if got, want := f.hasDataDescriptor(), i%5 == 3; got != want {
+			t.Errorf("%s: data descriptor flag %v, want %v", f.Name, got, want)
+		}
+		if err := f.CheckHeaders(); err != nil {
+			t.Errorf("%s: %v", f.Name, err)
+		}
+		if f.IsEncrypted() {
+			f.SetPassword([]byte("golang"))
+		}
+		if b := readAll(t, f); !bytes.Equal(b, contents[i]) {
+			t.Errorf("%s: content mismatch", f.Name)
+		}
+	}
+}
+
+func TestParallelWriterFailedEntry(t *testing.T) {
+	errClose := errors.New("close failed")
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	w.RegisterCompressor(99, func(out io.Writer) (io.WriteCloser, error) {
+		return failCloser{out, errClose}, nil
+	})
+	p := NewParallelWriter(w, nil)
+	for _, fh := range []*FileHeader{
+		{Name: "a.txt", Method: Deflate},
+		{Name: "bad.txt", Method: 99},
+		{Name: "c.txt", Method: Store},
+	} {
+		fw, err := p.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(fh.Name))
+		if err := fw.Close(); (err != nil) != (fh.Method == 99) {
+			t.Errorf("%s: Close: %v", fh.Name, err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the failed entry is left out
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != 2 || r.File[0].Name != "a.txt" || r.File[1].Name != "c.txt" {
+		t.Fatalf("got %d files", len(r.File))
+	}
+	for _, f := range r.File {
+		if got := readAll(t, f); string(got) != f.Name {
+			t.Errorf("%s: got %q", f.Name, got)
+		}
+	}
+}
+
+// failCloser fails to close with err.
+type failCloser struct {
+	io.Writer
+	err error
+}
+
+func (f failCloser) Close() error { return f.err }
+
+func TestParallelWriterAddFS(t *testing.T) {
+	fsys := fstest.MapFS{}
+	for i := 0; i < 50; i++ {
+		fsys[fmt.Sprintf("d%d/f%d.txt", i%7, i)] = &fstest.MapFile{Data: bytes.Repeat([]byte{byte(i)}, i*1000)}
+	}
+
+	// With sizes in the local headers, as CreateRaw writes them, and
+	// sorted entries, the archive matches that of a single Writer.
+	path := filepath.Join(t.TempDir(), "seq.zip")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w := NewSeekableWriter(out)
+	w.SetReproducible(nil)
+	if err := w.AddFS(fsys, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	w = NewWriter(buf)
+	w.SetReproducible(nil)
+	p := NewParallelWriter(w, &ParallelOptions{Concurrency: 3})
+	if err := p.AddFS(fsys, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Error("parallel archive differs")
+	}
+
+	// An error reading a file is reported and stops the archive.
+	p = NewParallelWriter(NewWriter(io.Discard), nil)
+	if err := p.AddFS(openErrorFS{fsys, "d3/f10.txt"}, nil); !errors.Is(err, errOpen) {
+		t.Errorf("got %v, want %v", err, errOpen)
+	}
+	if _, err := p.Create("more"); !errors.Is(err, errOpen) {
+		t.Errorf("Create after error: got %v, want %v", err, errOpen)
+	}
+}
+
+var errOpen = errors.New("open failed")
+
+// openErrorFS fails to open the file name.
+type openErrorFS struct {
+	fs.FS
+	name string
+}
+
+func (f openErrorFS) Open(name string) (fs.File, error) {
+	if name == f.name {
+		return nil, errOpen
+	}
+	return f.FS.Open(name)
+}
+
+func TestParallelFlateCompressor(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	period := make([]byte, 10000)
+	rnd.Read(period)
+	random := make([]byte, 100000)
+	rnd.Read(random)
+	const blockSize = 16 << 10
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("hello")},
+		{"block", bytes.Repeat([]byte{'a'}, blockSize)},
+		{"periodic", bytes.Repeat(period, 30)},
+		{"random", random},
+	} {
+		comp := ParallelFlateCompressor(flate.DefaultCompression, &ParallelFlateOptions{BlockSize: blockSize, Concurrency: 3})
+		var par, seq bytes.Buffer
+		zw, err := comp(&par)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for b := tt.data; len(b) > 0; {
+			n := min(len(b), 1+rnd.Intn(3*blockSize))
+			zw.Write(b[:n])
+			b = b[n:]
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		fw, _ := flate.NewWriter(&seq, flate.DefaultCompression)
+		fw.Write(tt.data)
+		fw.Close()
+
+		got, err := io.ReadAll(flate.NewReader(&par))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(got, tt.data) {
+			t.Fatalf("%s: data differs", tt.name)
+		}
+		// The dictionary keeps repetitions across blocks compressed.
+		if par.Len() > seq.Len()+seq.Len()/20+64 {
+			t.Errorf("%s: %d bytes, %d compressed serially", tt.name, par.Len(), seq.Len())
+		}
+	}
+
+	if _, err := ParallelFlateCompressor(10, nil)(io.Discard); err == nil {
+		t.Error("level 10: no error")
+	}
+
+	// Selected for a single entry, also when the Writer is adaptive.
+	data := bytes.Repeat(period, 10)
+	for _, adaptive := range []bool{false, true} {
+		used := 0
+		comp := ParallelFlateCompressor(5, &ParallelFlateOptions{BlockSize: blockSize})
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf)
+		if adaptive {
+			w.SetAdaptive(nil)
+		}
+		for _, name := range []string{"small", "large", "small2"} {
+			fh := &FileHeader{Name: name, Method: Deflate}
+			if name == "large" {
+				fh.SetCompressor(func(w io.Writer) (io.WriteCloser, error) {
+					used++
+					return comp(w)
+				})
+			}
+			fw, err := w.CreateHeader(fh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write(data)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if used == 0 {
+			t.Errorf("adaptive %v: compressor not used", adaptive)
+		}
+		r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range r.File {
+			if b := readAll(t, f); !bytes.Equal(b, data) {
+				t.Errorf("adaptive %v: %s: content mismatch", adaptive, f.Name)
+			}
+		}
+		if r.File[0].CompressedSize64 != r.File[2].CompressedSize64 {
+			t.Errorf("adaptive %v: small entries differ: %d and %d bytes", adaptive, r.File[0].CompressedSize64, r.File[2].CompressedSize64)
+		}
+	}
+}
+
+func TestWriterAdaptive(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 300<<10)
+	rnd.Read(random)
+	text := bytes.Repeat([]byte("adaptive "), 30000)
+	mixed := append(append([]byte(nil), text[:100<<10]...), random...)
+	entries := []struct {
+		name   string
+		data   []byte
+		method uint16 // wanted without forced compression
+	}{
+		{"photo.JPG", text[:1000], Store},
+		{"small.txt", text[:1000], Deflate},
+		{"small.bin", random[:1000], Store},
+		{"empty.txt", nil, Store},
+		{"large.txt", text, Deflate},
+		{"large.bin", random, Store},
+		{"mixed.bin", mixed, Deflate},
+	}
+	// neverStore compresses every entry not stored by its name.
+	neverStore := func(*FileHeader, []byte, int, bool) bool { return false }
+
+	for _, tt := range []struct {
+		name     string
+		seekable bool
+		store    func(*FileHeader, []byte, int, bool) bool
+	}{
+		{"default", false, nil},
+		{"seekable", true, nil},
+		{"forced", false, neverStore},
+		{"fallback", true, neverStore},
+	} {
+		path := filepath.Join(t.TempDir(), "adaptive.zip")
+		out, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var w *Writer
+		if tt.seekable {
+			w = NewSeekableWriter(out)
+		} else {
+			w = NewWriter(out)
+		}
+		w.SetAdaptive(&AdaptiveOptions{Store: tt.store})
+		for _, e := range entries {
+			fw, err := w.Create(e.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for b := e.data; len(b) > 0; {
+				n := min(len(b), 1+rnd.Intn(50000))
+				if _, err := fw.Write(b[:n]); err != nil {
+					t.Fatal(err)
+				}
+				b = b[n:]
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		out.Close()
+
+		r, err := OpenReader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, f := range r.File {
+			e := entries[i]
+			want := e.method
+			if tt.store != nil && e.name != "photo.JPG" {
+				want = Deflate
+				// compressed random data grows, and is rewritten
+				// stored if the writer can seek
+				if tt.seekable && strings.HasSuffix(e.name, ".bin") && e.name != "mixed.bin" {
+					want = Store
+				}
+			}
+			if f.Method != want {
+				t.Errorf("%s: %s: method %d, want %d", tt.name, f.Name, f.Method, want)
+			}
+			if err := f.CheckHeaders(); err != nil {
+				t.Errorf("%s: %s: %v", tt.name, f.Name, err)
+			}
+			if b := readAll(t, f); !bytes.Equal(b, e.data) {
+				t.Errorf("%s: %s: content mismatch", tt.name, f.Name)
+			}
+		}
+		r.Close()
+	}
+}
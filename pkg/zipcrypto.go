@@ -76,6 +76,46 @@ func ZipCryptoDecryptor(r *io.SectionReader, password []byte) (*io.SectionReader
 	return io.NewSectionReader(bytes.NewReader(m), 12, int64(len(m))), nil
 }
 
+// zipCryptoDecrypt decrypts the encryption header of f and checks its
+// last byte, which holds the high byte of the CRC-32 or, for entries
+// with a data descriptor, of the modification time. The returned reader
+// decrypts the rest of the data as it is read.
+func zipCryptoDecrypt(r *io.SectionReader, f *File) (io.Reader, error) {
+	if r.Size() == 0 && f.UncompressedSize64 == 0 {
+		// Empty entries written before the header was forced out
+		// have no encryption header.
+		return r, nil
+	}
+	if r.Size() < 12 {
+		return nil, ErrDecryption
+	}
+	z := NewZipCrypto(f.password())
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	m := z.Decrypt(header[:])
+	if check := m[11]; check != byte(f.CRC32>>24) && check != byte(f.ModifiedTime>>8) {
+		return nil, ErrPassword
+	}
+	return &zipCryptoReader{r, z}, nil
+}
+
+// zipCryptoReader decrypts the data read from r in place.
+type zipCryptoReader struct {
+	r io.Reader
+	z *ZipCrypto
+}
+
+func (z *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	for i, c := range p[:n] {
+		p[i] = c ^ z.z.magicByte()
+		z.z.updateKeys(p[i])
+	}
+	return n, err
+}
+
 type zipCryptoWriter struct {
 	w     io.Writer
 	z     *ZipCrypto
@@ -95,11 +135,14 @@ func (z *zipCryptoWriter) Write(p []byte) (n int, err error) {
 		header[11] = byte(crc >> 8)
 
 		z.z.init()
-		z.w.Write(z.z.Encrypt(header))
-		n += 12
+		if _, err = z.w.Write(z.z.Encrypt(header)); err != nil {
+			return
+		}
+	}
+	if _, err = z.w.Write(z.z.Encrypt(p)); err != nil {
+		return
 	}
-	z.w.Write(z.z.Encrypt(p))
-	return
+	return len(p), nil
 }
 
 func ZipCryptoEncryptor(i io.Writer, pass passwordFn, fw *fileWriter) (io.Writer, error)  {
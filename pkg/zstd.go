@@ -0,0 +1,109 @@
+package zip
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdSpeed maps a compression level on the flate scale, as accepted by
+// Writer.SetLevel and FileHeader.SetLevel, to a zstd encoder level:
+// 1 and 2 are the fastest, 3 to 6 the default, 7 and 8 better and 9
+// the best compression. Levels zstd cannot honor, such as
+// flate.NoCompression, use the fastest encoder and
+// flate.DefaultCompression the default one.
+func zstdSpeed(level int) zstd.EncoderLevel {
+	switch {
+	case level == -1:
+		return zstd.SpeedDefault
+	case level <= 2:
+		return zstd.SpeedFastest
+	case level <= 6:
+		return zstd.SpeedDefault
+	case level <= 8:
+		return zstd.SpeedBetterCompression
+	}
+	return zstd.SpeedBestCompression
+}
+
+// zstdWriterPools holds one pool per encoder level, as a zstd.Encoder
+// keeps its level across Reset.
+var zstdWriterPools [zstd.SpeedBestCompression + 1]sync.Pool
+
+// zstdCompressor returns a Zstd Compressor using the given level.
+func zstdCompressor(level int) Compressor {
+	speed := zstdSpeed(level)
+	return func(w io.Writer) (io.WriteCloser, error) {
+		pool := &zstdWriterPools[speed]
+		zw, ok := pool.Get().(*zstd.Encoder)
+		if ok {
+			zw.Reset(w)
+		} else {
+			var err error
+			// entries are compressed one at a time, so the encoder
+			// does not need goroutines of its own
+			zw, err = zstd.NewWriter(w, zstd.WithEncoderLevel(speed), zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &pooledZstdWriter{zw: zw, pool: pool}, nil
+	}
+}
+
+type pooledZstdWriter struct {
+	mu   sync.Mutex // guards Close and Write
+	zw   *zstd.Encoder
+	pool *sync.Pool
+}
+
+func (w *pooledZstdWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.zw == nil {
+		return 0, errors.New("Write after Close")
+	}
+	return w.zw.Write(p)
+}
+
+func (w *pooledZstdWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var err error
+	if w.zw != nil {
+		err = w.zw.Close()
+		w.zw.Reset(nil)
+		w.pool.Put(w.zw)
+		w.zw = nil
+	}
+	return err
+}
+
+// zstdReader releases the decoder on Close.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (r zstdReader) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+func newZstdReader(r io.Reader) io.ReadCloser {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return io.NopCloser(&errReader{err})
+	}
+	return zstdReader{d}
+}
+
+// errReader returns err from every Read.
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}